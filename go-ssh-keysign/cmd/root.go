@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -13,6 +16,9 @@ import (
 
 	"binarycodes/ssh-keysign/internal/apperror"
 	"binarycodes/ssh-keysign/internal/cli"
+	"binarycodes/ssh-keysign/internal/cli/configcmd"
+	"binarycodes/ssh-keysign/internal/cli/devservercmd"
+	"binarycodes/ssh-keysign/internal/cli/doctorcmd"
 	"binarycodes/ssh-keysign/internal/cli/hostcmd"
 	"binarycodes/ssh-keysign/internal/cli/usercmd"
 	"binarycodes/ssh-keysign/internal/cli/versioncmd"
@@ -24,6 +30,9 @@ import (
 	"binarycodes/ssh-keysign/internal/service/usersvc"
 )
 
+// cancelRun releases the --timeout deadline of the current run.
+var cancelRun context.CancelFunc = func() {}
+
 var rootCmd = &cobra.Command{
 	Use:           constants.AppName,
 	Short:         "ssh key certificate generator - get ssh keys signed by the configured CA server",
@@ -46,7 +55,9 @@ var rootCmd = &cobra.Command{
 			return err
 		}
 
-		if err := cli.ReadConfigFile(cmd, v); err != nil {
+		// for the log settings; the command reads the files again, doctor to
+		// report what is wrong with them
+		if err := cli.ReadConfigFile(cmd, v); err != nil && !cli.ReportsConfigErrors(cmd) {
 			return err
 		}
 
@@ -58,10 +69,21 @@ var rootCmd = &cobra.Command{
 		}
 
 		zl, cleanup, err := logging.Build(logging.Logging{
-			Level: logLevel, Destination: logDest, Sample: true,
+			Level:       logLevel,
+			Destination: logDest,
+			File:        v.GetString("log-file"),
+			Rotation: logging.Rotation{
+				MaxSize:    v.GetInt64("log-max-size") << 20,
+				MaxAge:     v.GetDuration("log-max-age"),
+				MaxBackups: v.GetInt("log-max-backups"),
+			},
+			Sampling: logging.Sampling{
+				First:      v.GetInt("log-sample-first"),
+				Thereafter: v.GetInt("log-sample-thereafter"),
+			},
 		})
 		if err != nil {
-			return err
+			return apperror.ErrFileSystem(fmt.Errorf("failed to set up logging: %w", err))
 		}
 
 		zl = zl.With(
@@ -80,12 +102,27 @@ var rootCmd = &cobra.Command{
 		cmd.SetContext(ctxkeys.WithLogCleanup(cmd.Context(), cleanup))
 		cmd.SetContext(ctxkeys.WithPrinter(cmd.Context(), printer))
 
+		if timeout := v.GetDuration("timeout"); timeout > 0 {
+			ctx, cancel := context.WithTimeoutCause(cmd.Context(), timeout,
+				fmt.Errorf("run did not finish within --timeout %s", timeout))
+			cmd.SetContext(ctx)
+			cancelRun = cancel
+		}
+
 		return nil
 	},
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// a second signal terminates immediately
+	context.AfterFunc(ctx, stop)
+
+	err := rootCmd.ExecuteContext(ctx)
+	defer stop()
+	defer cancelRun()
+
+	if err != nil {
 
 		// Find which command was triggered
 		args := os.Args[1:]
@@ -95,6 +132,14 @@ func Execute() {
 		}
 
 		kind := apperror.KindOf(err)
+		if runCtx := cmd.Context(); runCtx != nil && runCtx.Err() != nil {
+			// whatever failed last, the run was interrupted or timed out
+			kind = apperror.KCanceled
+			if cause := context.Cause(runCtx); cause != nil && !errors.Is(err, cause) {
+				err = fmt.Errorf("%w: %w", cause, err)
+			}
+		}
+
 		if kind == apperror.KUnknown {
 			log.Fatal(err)
 		}
@@ -107,6 +152,8 @@ func Execute() {
 		}
 
 		_, _ = fmt.Fprintln(rootCmd.ErrOrStderr(), err)
+		cancelRun()
+		stop()
 		os.Exit(kind.ExitCode())
 	}
 }
@@ -115,10 +162,20 @@ func InitRoot() error {
 	rootCmd.AddCommand(versioncmd.NewCommand())
 	rootCmd.AddCommand(hostcmd.NewCommand(hostcmd.Deps{Service: hostsvc.HostService{}}))
 	rootCmd.AddCommand(usercmd.NewCommand(usercmd.Deps{Service: usersvc.UserService{}}))
+	rootCmd.AddCommand(configcmd.NewCommand())
+	rootCmd.AddCommand(doctorcmd.NewCommand())
+	rootCmd.AddCommand(devservercmd.NewCommand())
 
 	rootCmd.PersistentFlags().String("log-level", "warn", "info level: error|warn|info|debug")
-	rootCmd.PersistentFlags().String("log-dest", "stderr", "log destination: stderr|stdout|file")
+	rootCmd.PersistentFlags().String("log-dest", "stderr", "log destination: stderr|stdout|file|syslog|journald")
+	rootCmd.PersistentFlags().String("log-file", "", "log file for --log-dest file (default /var/log/ssh-keysign.log as root, else $XDG_STATE_HOME/ssh-keysign/ssh-keysign.log)")
+	rootCmd.PersistentFlags().Int("log-max-size", 10, "rotate the log file once it would grow beyond this many MiB, 0 for no limit")
+	rootCmd.PersistentFlags().Duration("log-max-age", 0, "rotate the log file once its first entry is older than this, e.g. 168h (default no limit)")
+	rootCmd.PersistentFlags().Int("log-max-backups", 3, "rotated log files to keep")
+	rootCmd.PersistentFlags().Int("log-sample-first", 10, "log the first N entries with the same level and message each second, then sample; 0 logs every entry")
+	rootCmd.PersistentFlags().Int("log-sample-thereafter", 100, "after --log-sample-first, log every Nth entry with the same level and message each second")
 	rootCmd.PersistentFlags().CountP("verbose", "v", "Increase user output verbosity (-v, -vv, -vvv)")
+	rootCmd.PersistentFlags().Duration("timeout", 0, "abort the run after this long, e.g. 5m (default no limit)")
 
 	return nil
 }
@@ -3,8 +3,6 @@ package apperror
 import (
 	"context"
 	"errors"
-	"fmt"
-	"io"
 	"net/http"
 )
 
@@ -22,12 +20,19 @@ const (
 	KCanceled        // context canceled/deadline
 	KHttp            // http errors
 	KCert            // cert/keys error
+
+	KAuthExpired         // access token expired or not accepted by the CA server
+	KPrincipalNotAllowed // CA server refused the requested principal
+	KKeyRejected         // CA server could not sign the public key
+	KServerError         // CA server failed (5xx)
+	KCheckFailed         // doctor found a problem with the setup
 )
 
 type appError struct {
 	Op      string // optional: "cert.IssueUser"
 	Type    Kind
 	OpError error
+	Hint    string // optional: what the user should change
 }
 
 func (kind Kind) ExitCode() int {
@@ -46,16 +51,30 @@ func (kind Kind) ExitCode() int {
 		return 14
 	case KCert:
 		return 15
+	case KAuthExpired:
+		return 16
+	case KPrincipalNotAllowed:
+		return 17
+	case KKeyRejected:
+		return 18
+	case KServerError:
+		return 19
+	case KCheckFailed:
+		return 20
 	default:
 		return 1
 	}
 }
 
 func (appErr *appError) Error() string {
+	msg := appErr.OpError.Error()
 	if appErr.Op != "" {
-		return appErr.Op + ": " + appErr.OpError.Error()
+		msg = appErr.Op + ": " + msg
+	}
+	if appErr.Hint != "" {
+		msg += " [Hint: " + appErr.Hint + "]"
 	}
-	return appErr.OpError.Error()
+	return msg
 }
 
 func (appErr *appError) Unwrap() error {
@@ -87,19 +106,34 @@ func ErrCert(err error) error {
 	return &appError{Type: KCert, OpError: err}
 }
 
+// ErrHTTP reads the error response, see ReadProblem.
 func ErrHTTP(resp *http.Response) error {
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return &appError{Type: KHttp, OpError: err}
-	}
+	return &appError{Type: KHttp, OpError: ReadProblem(resp)}
+}
 
-	if len(body) > 0 {
-		err = errors.New(string(body))
-		return &appError{Type: KHttp, OpError: err}
-	}
+// ErrProblem is ErrHTTP for a response already read with ReadProblem.
+func ErrProblem(p *Problem) error {
+	return &appError{Type: KHttp, OpError: p}
+}
+
+func ErrAuthExpired(err error, hint string) error {
+	return &appError{Type: KAuthExpired, OpError: err, Hint: hint}
+}
 
-	err = fmt.Errorf("statuscode: %d", resp.StatusCode)
-	return &appError{Type: KHttp, OpError: err}
+func ErrPrincipalNotAllowed(err error, hint string) error {
+	return &appError{Type: KPrincipalNotAllowed, OpError: err, Hint: hint}
+}
+
+func ErrKeyRejected(err error, hint string) error {
+	return &appError{Type: KKeyRejected, OpError: err, Hint: hint}
+}
+
+func ErrServer(err error, hint string) error {
+	return &appError{Type: KServerError, OpError: err, Hint: hint}
+}
+
+func ErrCheckFailed(err error) error {
+	return &appError{Type: KCheckFailed, OpError: err}
 }
 
 func Op(op string, err error) error {
@@ -113,6 +147,42 @@ func Op(op string, err error) error {
 	return &appError{Op: op, Type: KUnknown, OpError: err}
 }
 
+// OpOr is Op for errors that may not carry a kind yet; those are given
+// fallback instead of KUnknown.
+func OpOr(op string, fallback Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var appErr *appError
+	if errors.As(err, &appErr) {
+		return &appError{Op: op, Type: appErr.Type, OpError: appErr}
+	}
+	return &appError{Op: op, Type: fallback, OpError: err}
+}
+
+// WithHint attaches what the user should change to err, keeping its kind.
+func WithHint(err error, hint string) error {
+	if err == nil {
+		return nil
+	}
+	return &appError{Type: KindOf(err), OpError: err, Hint: hint}
+}
+
+// HintOf returns the outermost hint attached to err.
+func HintOf(err error) string {
+	for err != nil {
+		var appErr *appError
+		if !errors.As(err, &appErr) {
+			return ""
+		}
+		if appErr.Hint != "" {
+			return appErr.Hint
+		}
+		err = appErr.OpError
+	}
+	return ""
+}
+
 func KindOf(err error) Kind {
 	var appErr *appError
 	if errors.As(err, &appErr) {
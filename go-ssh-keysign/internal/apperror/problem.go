@@ -0,0 +1,117 @@
+package apperror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const maxErrorBody = 64 << 10
+
+// Problem is an HTTP error response. application/problem+json bodies
+// (RFC 9457) are decoded as such; Spring Boot's default JSON error body and
+// plain text are mapped onto the same fields.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+
+	// WWWAuthenticate holds the challenge of a 401 or 403 response.
+	WWWAuthenticate string `json:"-"`
+}
+
+// jsonError covers the body of Spring Boot's BasicErrorController and the
+// OAuth 2.0 error response (RFC 6749, section 5.2).
+type jsonError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	Message          string `json:"message"`
+	Path             string `json:"path"`
+}
+
+// ReadProblem consumes the body of a failed response.
+func ReadProblem(resp *http.Response) *Problem {
+	p := &Problem{
+		Status:          resp.StatusCode,
+		WWWAuthenticate: resp.Header.Get("WWW-Authenticate"),
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	body = []byte(strings.TrimSpace(string(body)))
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case len(body) == 0:
+	case mediaType == "application/problem+json":
+		if err := json.Unmarshal(body, p); err != nil {
+			p.Detail = string(body)
+		}
+	case mediaType == "application/json":
+		var je jsonError
+		if err := json.Unmarshal(body, &je); err == nil && (je.Error != "" || je.Message != "") {
+			p.Title, p.Detail, p.Instance = je.Error, je.Message, je.Path
+			if p.Detail == "" {
+				p.Detail = je.ErrorDescription
+			}
+		} else {
+			p.Detail = string(body)
+		}
+	default:
+		p.Detail = string(body)
+	}
+
+	if p.Status == 0 {
+		p.Status = resp.StatusCode
+	}
+
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+
+	if p.Detail == "" {
+		p.Detail = p.BearerDescription()
+	}
+
+	return p
+}
+
+// BearerError returns the error code of a Bearer challenge, e.g.
+// "invalid_token" (RFC 6750, section 3.1).
+func (p *Problem) BearerError() string {
+	_, params, ok := strings.Cut(p.WWWAuthenticate, " ")
+	if !ok {
+		return ""
+	}
+
+	for _, param := range strings.Split(params, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && k == "error" {
+			return strings.Trim(v, `"`)
+		}
+	}
+
+	return ""
+}
+
+// BearerDescription returns the error_description of a Bearer challenge.
+func (p *Problem) BearerDescription() string {
+	_, params, ok := strings.Cut(p.WWWAuthenticate, "error_description=\"")
+	if !ok {
+		return ""
+	}
+	desc, _, _ := strings.Cut(params, "\"")
+	return desc
+}
+
+func (p *Problem) Error() string {
+	msg := fmt.Sprintf("%d %s", p.Status, p.Title)
+	if p.Detail != "" && p.Detail != p.Title {
+		msg += ": " + p.Detail
+	}
+	return msg
+}
@@ -0,0 +1,30 @@
+package configcmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Create, inspect and validate the configuration",
+		Long: "Settings come from flags, SSH_KEYSIGN_* environment variables and config files, in that order of precedence.\n\n" +
+			"Config files are read in order, later ones override earlier ones: /etc/ssh-keysign and then each $XDG_CONFIG_DIRS/ssh-keysign " +
+			"(the first entry last), then --config or, for user only, ~/.config/ssh-keysign. In each directory config.yml is read, then conf.d/*.yml " +
+			"in lexical order and, for host only, host.yml, the place for the host's credentials such as client-secret. " +
+			"Settings listed under locked: in a system file cannot be overridden by later files, the environment or flags.\n\n" +
+			"--profile picks an entry of a config file's profiles map, whose settings override the shared ones.\n\n" +
+			"The certificate is signed by the first backend that is configured:\n" +
+			"  --ca-key                      locally, with no CA server or login\n" +
+			"  --vault-addr and --vault-role HashiCorp Vault's SSH secrets engine\n" +
+			"  --ca-server-type step-ca      a smallstep step-ca at --ca-server-url; --step-provisioner-key signs its one-time token without an IdP login\n" +
+			"  otherwise                     the CA server at --ca-server-url, after an OAuth login at the IdP\n\n" +
+			"user logs in with device flow unless a token URL or subject token is set; it works with a public client, " +
+			"--client-secret is optional and PKCE is used by default.",
+		Args: cobra.NoArgs,
+	}
+
+	configCmd.AddCommand(newInitCommand(), newShowCommand(), newValidateCommand(), newSchemaCommand())
+
+	return configCmd
+}
@@ -0,0 +1,252 @@
+package configcmd_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli/configcmd"
+	"binarycodes/ssh-keysign/internal/cli/testutil"
+	"binarycodes/ssh-keysign/internal/devserver"
+)
+
+func newDevServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	s, err := devserver.New(devserver.Options{ClientID: "public-cli", AutoApprove: "alice"})
+	require.NoError(t, err)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestConfigInit_InteractiveSuggestsPrincipalsFromLogin(t *testing.T) {
+	srv := newDevServer(t)
+	out := filepath.Join(t.TempDir(), "config.yml")
+
+	answers := strings.Join([]string{
+		srv.URL,      // issuer
+		srv.URL,      // CA server
+		"public-cli", // client ID
+		"y",          // log in
+		"",           // principals: take the suggestion
+		"",           // key mode: agent
+		"600",        // lifetime
+	}, "\n") + "\n"
+
+	cmd := configcmd.NewCommand()
+	cmd.SetIn(strings.NewReader(answers))
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "init", "--output", out)
+	require.NoError(t, err)
+
+	assert.Contains(t, stdout, "Principals, comma-separated [alice]")
+	assert.Contains(t, stdout, "wrote "+out)
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "ca-server-url: "+srv.URL+"\n"+
+		"issuer: "+srv.URL+"\n"+
+		"client-id: public-cli\n"+
+		"pkce: true\n"+
+		"user:\n"+
+		"  principal:\n"+
+		"    - alice\n"+
+		"  duration: 600\n", string(b))
+
+	info, err := os.Stat(out)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestConfigInit_NonInteractive(t *testing.T) {
+	srv := newDevServer(t)
+	out := filepath.Join(t.TempDir(), "config.yml")
+	key := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	cmd := configcmd.NewCommand()
+	_, _, _, err := testutil.ExecuteCommand(t, cmd, "init", "--non-interactive",
+		"--output", out,
+		"--issuer", srv.URL+"/",
+		"--ca-server-url", srv.URL,
+		"--client-id", "public-cli",
+		"--principal", "alice,devops",
+		"--key", key,
+	)
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "issuer: "+srv.URL+"\n")
+	assert.Contains(t, string(b), "key: "+key)
+	assert.Contains(t, string(b), "- devops")
+
+	// an existing file is kept
+	cmd = configcmd.NewCommand()
+	_, _, _, err = testutil.ExecuteCommand(t, cmd, "init", "--non-interactive", "--output", out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--force")
+}
+
+func TestConfigInit_NonInteractiveMissingFlags(t *testing.T) {
+	cmd := configcmd.NewCommand()
+	_, _, _, err := testutil.ExecuteCommand(t, cmd, "init", "--non-interactive",
+		"--output", filepath.Join(t.TempDir(), "config.yml"),
+		"--client-id", "public-cli",
+	)
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "--issuer, --ca-server-url, --principal")
+}
+
+const showConfig = `
+ca-server-url: "https://ca.example.test"
+client-id: "cli"
+client-secret: "hunter2"
+vault-token: "env:VAULT_TOKEN"
+user:
+  principal: [alice]
+host:
+  principal: [web01]
+profiles:
+  staging:
+    ca-server-url: "https://ca.staging.example.test"
+    user:
+      duration: 600
+`
+
+func TestConfigShow_AnnotatesSourcesAndRedactsSecrets(t *testing.T) {
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(showConfig))
+	t.Setenv("SSH_KEYSIGN_ISSUER", "https://idp.example.test")
+
+	cmd := configcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "show", "user",
+		"--config", cfgPath,
+		"--profile", "staging",
+		"--key", "/home/alice/.ssh/id_ed25519.pub",
+	)
+	require.NoError(t, err)
+
+	assert.Contains(t, stdout, "profile: staging # flag --profile\n")
+	assert.Contains(t, stdout, "ca-server-url: https://ca.staging.example.test # config "+cfgPath+" (profile staging)\n")
+	assert.Contains(t, stdout, "client-id: cli # config "+cfgPath+"\n")
+	assert.Contains(t, stdout, "issuer: https://idp.example.test # env SSH_KEYSIGN_ISSUER\n")
+	assert.Contains(t, stdout, "client-secret: <redacted> # config "+cfgPath+"\n")
+	assert.Contains(t, stdout, "vault-token: env:VAULT_TOKEN # config "+cfgPath+"\n")
+	assert.Contains(t, stdout, "  key: /home/alice/.ssh/id_ed25519.pub # flag --key\n")
+	assert.Contains(t, stdout, "  duration: 600 # config "+cfgPath+" (profile staging)\n")
+	assert.NotContains(t, stdout, "hunter2")
+	assert.NotContains(t, stdout, "web01")
+}
+
+func TestConfigShow_JSON(t *testing.T) {
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(showConfig))
+
+	cmd := configcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "show", "host", "--config", cfgPath, "--format", "json")
+	require.NoError(t, err)
+
+	var got map[string]struct {
+		Value  any
+		Source string
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+
+	assert.Equal(t, []any{"web01"}, got["host.principal"].Value)
+	assert.Equal(t, "config "+cfgPath, got["host.principal"].Source)
+	assert.Equal(t, "<redacted>", got["client-secret"].Value)
+	assert.Equal(t, "default", got["retries"].Source)
+	assert.NotContains(t, got, "user.principal")
+	assert.NotContains(t, got, "vault-addr")
+}
+
+func TestConfigShow_SystemConfigAndLocks(t *testing.T) {
+	system := t.TempDir()
+	t.Setenv("XDG_CONFIG_DIRS", system)
+
+	systemCfg := filepath.Join(system, "ssh-keysign", "config.yml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(systemCfg), 0o755))
+	require.NoError(t, os.WriteFile(systemCfg, []byte("issuer: https://idp.example.test\nlocked: [ca-server-url]\n"), 0o644))
+
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte("ca-server-url: https://ca.example.test\nclient-id: cli\n"))
+
+	cmd := configcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "show", "user", "--config", cfgPath, "--format", "json", "--all")
+	require.NoError(t, err)
+
+	var got map[string]struct {
+		Value  any
+		Source string
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+
+	assert.Equal(t, "https://idp.example.test", got["issuer"].Value)
+	assert.Equal(t, "config "+systemCfg, got["issuer"].Source)
+	assert.Equal(t, "config "+cfgPath, got["client-id"].Source)
+	// locked without a value keeps the default
+	assert.Equal(t, "", got["ca-server-url"].Value)
+	assert.Equal(t, "locked in "+systemCfg, got["ca-server-url"].Source)
+}
+
+func TestConfigValidate_ReportsEveryProblemWithItsLine(t *testing.T) {
+	good := testutil.WriteTempFile(t, "good.yml", []byte(showConfig))
+	bad := filepath.Join(t.TempDir(), "bad.yml")
+	require.NoError(t, os.WriteFile(bad, []byte(`ca-server-url: "https://ca.example.test"
+retries: three
+pkce: "yes"
+client-auth-method: client_secret_basic
+user:
+  principal: alice
+  duration: 1h
+profiles:
+  staging:
+    issuer: "https://idp.example.test"
+    token_url: "https://idp.example.test/token"
+`), 0o600))
+
+	cmd := configcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "validate", good, bad)
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+
+	assert.True(t, strings.HasPrefix(stdout, good+": ok\n"))
+	assert.Equal(t, "invalid config file:\n"+
+		bad+`:2: retries must be a number, got "three"`+"\n"+
+		bad+`:3: pkce must be true or false, got "yes"`+"\n"+
+		bad+`:4: client-auth-method must be one of client_secret_post|private_key_jwt|tls_client_auth, got "client_secret_basic"`+"\n"+
+		bad+`:7: user.duration must be a positive number, got "1h"`+"\n"+
+		bad+`:11: unknown key "token_url", did you mean "token-url"?`, err.Error())
+}
+
+func TestConfigSchema_DescribesSettingsAndProfiles(t *testing.T) {
+	cmd := configcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "schema")
+	require.NoError(t, err)
+
+	var schema struct {
+		AdditionalProperties bool
+		Properties           map[string]struct {
+			Type                 any
+			Description          string
+			Enum                 []string
+			Properties           map[string]json.RawMessage
+			AdditionalProperties json.RawMessage
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &schema))
+
+	assert.False(t, schema.AdditionalProperties)
+	assert.Equal(t, "OIDC client ID", schema.Properties["client-id"].Description)
+	assert.Equal(t, []string{"ssh-keysign", "step-ca"}, schema.Properties["ca-server-type"].Enum)
+	assert.Contains(t, schema.Properties["user"].Properties, "principal")
+	assert.Contains(t, string(schema.Properties["profiles"].AdditionalProperties), `"ca-server-url"`)
+	assert.NotContains(t, string(schema.Properties["profiles"].AdditionalProperties), `"profiles"`)
+}
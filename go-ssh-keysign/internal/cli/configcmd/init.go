@@ -0,0 +1,403 @@
+package configcmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/service/oauth"
+	"binarycodes/ssh-keysign/internal/service/oidc"
+	"binarycodes/ssh-keysign/internal/service/paths"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+const (
+	keyModeAgent = "agent"
+	keyModeFile  = "file"
+
+	defaultKeyFile = "~/.ssh/id_ed25519.pub"
+)
+
+// fileConfig is what config init writes, in this order. Endpoints are left
+// to discovery at run time.
+type fileConfig struct {
+	CAServerURL string   `yaml:"ca-server-url"`
+	Issuer      string   `yaml:"issuer"`
+	ClientID    string   `yaml:"client-id"`
+	PKCE        bool     `yaml:"pkce"`
+	User        fileUser `yaml:"user"`
+}
+
+type fileUser struct {
+	Key        string   `yaml:"key,omitempty"`
+	Principals []string `yaml:"principal"`
+	Duration   uint64   `yaml:"duration"`
+}
+
+type answers struct {
+	issuer, caServerURL, clientID string
+	principals                    []string
+	keyMode, key                  string
+	duration                      uint64
+}
+
+func newInitCommand() *cobra.Command {
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Write a user config file, asking for the few settings that are needed",
+		Long: "Asks for the OIDC issuer, the CA server URL and the client ID, checks the issuer with OIDC discovery, " +
+			"offers the principals of your identity after an optional login and writes " + constants.ConfigFileName + " where the user command reads it.\n\n" +
+			"Flags prefill the answers; with --non-interactive nothing is asked and --issuer, --ca-server-url, --client-id and --principal are required.",
+		Args: cobra.NoArgs,
+		RunE: runInit,
+	}
+
+	initCmd.Flags().String("issuer", "", "OIDC issuer URL")
+	initCmd.Flags().String("ca-server-url", "", "CA server URL")
+	initCmd.Flags().String("client-id", "", "OIDC client ID, a public client with device flow enabled")
+	initCmd.Flags().StringSliceP("principal", "p", nil, "comma-separated principal names (default: from your identity after login)")
+	initCmd.Flags().String("key-mode", "", "where certificates go: agent (a new key in ssh-agent each run)|file (next to --key) (default agent, file with --key)")
+	initCmd.Flags().StringP("key", "k", "", "public key file to sign in file mode")
+	initCmd.Flags().Uint64P("duration", "d", constants.DefaultDurationForUserKey(), "certificate lifetime in seconds")
+	initCmd.Flags().StringP("output", "o", "", "file to write (default "+filepath.Join("$XDG_CONFIG_HOME", constants.AppName, constants.ConfigFileName)+")")
+	initCmd.Flags().Bool("force", false, "overwrite an existing file")
+	initCmd.Flags().Bool("non-interactive", false, "do not ask, take everything from flags")
+
+	return initCmd
+}
+
+func runInit(cmd *cobra.Command, _ []string) error {
+	f := cmd.Flags()
+	out, _ := f.GetString("output")
+	force, _ := f.GetBool("force")
+	nonInteractive, _ := f.GetBool("non-interactive")
+
+	if out == "" {
+		if out = cli.UserConfigPath(); out == "" {
+			return apperror.ErrUsage("cannot determine the config directory; use --output")
+		}
+	}
+
+	if _, err := os.Stat(out); err == nil && !force {
+		return apperror.ErrUsage(fmt.Sprintf("%s already exists; use --force to overwrite it", out))
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return apperror.ErrFileSystem(err)
+	}
+
+	a := answers{}
+	a.issuer, _ = f.GetString("issuer")
+	a.caServerURL, _ = f.GetString("ca-server-url")
+	a.clientID, _ = f.GetString("client-id")
+	a.principals, _ = f.GetStringSlice("principal")
+	a.keyMode, _ = f.GetString("key-mode")
+	a.key, _ = f.GetString("key")
+	a.duration, _ = f.GetUint64("duration")
+
+	client, err := transport.New(transport.Options{
+		ConnectTimeout:      constants.DefaultConnectTimeout,
+		TLSHandshakeTimeout: constants.DefaultTLSHandshakeTimeout,
+		Timeout:             constants.DefaultHTTPTimeout,
+		Retries:             constants.DefaultRetries,
+		RetryMaxTime:        constants.DefaultRetryMaxTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	w := &wizard{cmd: cmd, client: client}
+	if !nonInteractive {
+		w.p = newPrompter(cmd.InOrStdin(), cmd.OutOrStdout())
+	}
+
+	if err := w.run(&a); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(fileConfig{
+		CAServerURL: a.caServerURL,
+		Issuer:      a.issuer,
+		ClientID:    a.clientID,
+		PKCE:        true,
+		User:        fileUser{Key: a.key, Principals: a.principals, Duration: a.duration},
+	}); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+
+	if err := w.validate(b); err != nil {
+		return fmt.Errorf("the new configuration is not valid: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0o700); err != nil {
+		return apperror.ErrFileSystem(err)
+	}
+	if err := paths.WriteFileAtomic(out, b, 0o600); err != nil {
+		return apperror.ErrFileSystem(err)
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "wrote %s\nget a certificate with: %s user\n", out, cmd.Root().Name())
+	return nil
+}
+
+type wizard struct {
+	cmd    *cobra.Command
+	client *http.Client
+	p      *prompter // nil with --non-interactive
+
+	provider *oidc.ProviderMetadata
+}
+
+func (w *wizard) run(a *answers) error {
+	if w.p == nil {
+		if err := requireFlags(a); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if a.issuer, err = w.askURL("OIDC issuer URL", a.issuer); err != nil {
+		return err
+	}
+
+	if err := w.discover(a.issuer); err != nil {
+		return err
+	}
+
+	if a.caServerURL, err = w.askURL("CA server URL", a.caServerURL); err != nil {
+		return err
+	}
+
+	if w.p != nil {
+		if a.clientID, err = w.p.required("Client ID", a.clientID); err != nil {
+			return err
+		}
+		if a.principals, err = w.askPrincipals(a); err != nil {
+			return err
+		}
+	}
+
+	if err := w.askKey(a); err != nil {
+		return err
+	}
+
+	if w.p != nil {
+		d, err := w.p.required("Certificate lifetime in seconds", strconv.FormatUint(a.duration, 10))
+		if err != nil {
+			return err
+		}
+		if a.duration, err = strconv.ParseUint(d, 10, 64); err != nil || a.duration == 0 {
+			return apperror.ErrUsage(fmt.Sprintf("invalid certificate lifetime %q: expected a number of seconds", d))
+		}
+	}
+
+	return nil
+}
+
+func requireFlags(a *answers) error {
+	var missing []string
+	if a.issuer == "" {
+		missing = append(missing, "--issuer")
+	}
+	if a.caServerURL == "" {
+		missing = append(missing, "--ca-server-url")
+	}
+	if a.clientID == "" {
+		missing = append(missing, "--client-id")
+	}
+	if len(a.principals) == 0 {
+		missing = append(missing, "--principal")
+	}
+
+	if len(missing) > 0 {
+		return apperror.ErrUsage(fmt.Sprintf("missing required parameters: %s", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+// askURL asks for an http(s) URL, or checks the one given as a flag.
+func (w *wizard) askURL(question, value string) (string, error) {
+	for {
+		if w.p != nil {
+			var err error
+			if value, err = w.p.required(question, value); err != nil {
+				return "", err
+			}
+		}
+
+		u, err := url.Parse(value)
+		if err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+			return strings.TrimSuffix(value, "/"), nil
+		}
+
+		msg := fmt.Sprintf("%q is not an http(s) URL", value)
+		if w.p == nil {
+			return "", apperror.ErrUsage(msg)
+		}
+		fmt.Fprintf(w.p.out, "  %s\n", msg)
+		value = ""
+	}
+}
+
+func (w *wizard) discover(issuer string) error {
+	m, err := oidc.Discovery{HTTPClient: w.client}.Fetch(w.cmd.Context(), issuer)
+	if err != nil {
+		return apperror.Op("OIDC discovery of "+issuer, err)
+	}
+
+	if m.DeviceAuthorizationEndpoint == "" {
+		return apperror.WithHint(apperror.ErrUsage(issuer+" does not offer device flow"),
+			"enable the OAuth 2.0 Device Authorization Grant for the client")
+	}
+
+	w.provider = m
+	fmt.Fprintf(w.cmd.OutOrStdout(), "  found device flow at %s\n", m.DeviceAuthorizationEndpoint)
+	return nil
+}
+
+// askPrincipals offers the principals of the identity the user logs in as,
+// else the local user name.
+func (w *wizard) askPrincipals(a *answers) ([]string, error) {
+	suggested := a.principals
+
+	if len(suggested) == 0 && w.provider.UserinfoEndpoint != "" {
+		login, err := w.p.confirm("Log in now to look up your principals?", true)
+		if err != nil {
+			return nil, err
+		}
+		if login {
+			suggested = w.identityPrincipals(a.clientID)
+		}
+	}
+
+	if len(suggested) == 0 {
+		if u, err := user.Current(); err == nil {
+			suggested = []string{u.Username}
+		}
+	}
+
+	answer, err := w.p.required("Principals, comma-separated", strings.Join(suggested, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	var principals []string
+	for _, s := range strings.Split(answer, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			principals = append(principals, s)
+		}
+	}
+	return principals, nil
+}
+
+// identityPrincipals logs in with device flow and asks the userinfo endpoint
+// who that is. A failed login only loses the suggestion.
+func (w *wizard) identityPrincipals(clientID string) []string {
+	ctx := w.cmd.Context()
+	o := config.OAuth{
+		ClientID:      clientID,
+		DeviceFlowURL: w.provider.DeviceAuthorizationEndpoint,
+		TokenPollURL:  w.provider.TokenEndpoint,
+		PKCE:          true,
+	}
+
+	token, err := oauth.CAAuthClient{HTTPClient: w.client}.DeviceFlowLogin(ctx, o)
+	if err == nil {
+		var id *oidc.Identity
+		if id, err = oidc.UserInfo(ctx, w.client, w.provider.UserinfoEndpoint, token.AccessToken); err == nil {
+			return id.Principals()
+		}
+	}
+
+	fmt.Fprintf(w.p.out, "  could not look up your identity: %v\n", err)
+	return nil
+}
+
+func (w *wizard) askKey(a *answers) error {
+	if a.keyMode == "" {
+		a.keyMode = keyModeAgent
+		if a.key != "" {
+			a.keyMode = keyModeFile
+		}
+	}
+
+	if w.p == nil {
+		switch a.keyMode {
+		case keyModeAgent:
+			a.key = ""
+			return nil
+		case keyModeFile:
+			if a.key == "" {
+				return apperror.ErrUsage("--key-mode file needs --key")
+			}
+			return config.ValidateKeyFile(a.key, false)
+		default:
+			return apperror.ErrUsage(fmt.Sprintf("unsupported --key-mode %q (expected %s|%s)", a.keyMode, keyModeAgent, keyModeFile))
+		}
+	}
+
+	fmt.Fprintln(w.p.out, "Certificates can go to ssh-agent with a fresh key each run, or next to an existing key file.")
+
+	var err error
+	if a.keyMode, err = w.p.choose("Key mode", []string{keyModeAgent, keyModeFile}, a.keyMode); err != nil {
+		return err
+	}
+
+	if a.keyMode == keyModeAgent {
+		a.key = ""
+		return nil
+	}
+
+	if a.key == "" {
+		a.key = defaultKeyFile
+	}
+	for {
+		if a.key, err = w.p.required("Public key file", a.key); err != nil {
+			return err
+		}
+		if err := config.ValidateKeyFile(a.key, false); err != nil {
+			fmt.Fprintf(w.p.out, "  %v\n", err)
+			a.key = ""
+			continue
+		}
+		return nil
+	}
+}
+
+// validate loads the written YAML the way the user command does.
+func (w *wizard) validate(b []byte) error {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(v)
+	if err != nil {
+		return err
+	}
+
+	if cfg.OAuth, err = (oidc.Discovery{HTTPClient: w.client}).Resolve(w.cmd.Context(), cfg.OAuth, false); err != nil {
+		return err
+	}
+
+	return cfg.ValidateUser()
+}
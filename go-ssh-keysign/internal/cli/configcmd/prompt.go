@@ -0,0 +1,79 @@
+package configcmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+)
+
+// prompter asks questions line by line, so answers can be piped in.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
+}
+
+// ask returns the answer to question, or def for an empty answer.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	line, err := p.in.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		if errors.Is(err, io.EOF) {
+			return "", apperror.ErrUsage("no answer on stdin; run with --non-interactive and flags instead")
+		}
+		return "", err
+	}
+
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// required asks until the answer is not empty.
+func (p *prompter) required(question, def string) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil || answer != "" {
+			return answer, err
+		}
+		fmt.Fprintln(p.out, "  an answer is required")
+	}
+}
+
+// choose asks until the answer is one of options.
+func (p *prompter) choose(question string, options []string, def string) (string, error) {
+	for {
+		answer, err := p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(options, "/")), def)
+		if err != nil {
+			return "", err
+		}
+		if answer = strings.ToLower(answer); slices.Contains(options, answer) {
+			return answer, nil
+		}
+		fmt.Fprintf(p.out, "  answer one of: %s\n", strings.Join(options, ", "))
+	}
+}
+
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	d := "n"
+	if def {
+		d = "y"
+	}
+
+	answer, err := p.choose(question, []string{"y", "n"}, d)
+	return answer == "y", err
+}
@@ -0,0 +1,179 @@
+package configcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli"
+	"binarycodes/ssh-keysign/internal/cli/hostcmd"
+	"binarycodes/ssh-keysign/internal/cli/usercmd"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/logging"
+)
+
+// entry is a setting as shown, with where its value comes from.
+type entry struct {
+	Key    string `json:"-"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+func newShowCommand() *cobra.Command {
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration of the user or host command and where each value comes from",
+		Long: "config show user and config show host take the flags of that command and layer flags, SSH_KEYSIGN_* environment variables, " +
+			"the system, drop-in and user config files and their profiles exactly like it, then print each value with its source instead of running.\n\n" +
+			"Secrets are redacted, secret references such as env:NAME are shown as they are and not resolved.",
+		Args: cobra.NoArgs,
+	}
+
+	showCmd.PersistentFlags().String("format", "yaml", "output format: yaml|json")
+	showCmd.PersistentFlags().Bool("all", false, "also list settings that are not set")
+
+	showCmd.AddCommand(
+		showFor(usercmd.NewCommand(usercmd.Deps{}), "host"),
+		showFor(hostcmd.NewCommand(hostcmd.Deps{}), "user"),
+	)
+
+	return showCmd
+}
+
+// showFor turns the user or host command into its config show subcommand. It
+// keeps the flags and the PreRunE that reads the config file, so values are
+// layered the same way, and prints them instead of running. Settings under
+// skip belong to the other command.
+func showFor(c *cobra.Command, skip string) *cobra.Command {
+	c.Short = fmt.Sprintf("Print the effective configuration of the %s command", c.Name())
+	c.Long = ""
+	c.RunE = func(cmd *cobra.Command, _ []string) error {
+		return show(cmd, skip)
+	}
+	return c
+}
+
+func show(cmd *cobra.Command, skip string) error {
+	v := ctxkeys.ViperFrom(cmd.Context())
+
+	cfg, err := config.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	all, _ := cmd.Flags().GetBool("all")
+
+	var entries []entry
+	for _, s := range config.Settings(cfg) {
+		if strings.HasPrefix(s.Key, skip+".") {
+			continue
+		}
+
+		src := cli.SettingSource(cmd, v, s.Key)
+		if !all && src == cli.SourceDefault && isEmpty(s.Value) {
+			continue
+		}
+
+		entries = append(entries, entry{Key: s.Key, Value: displayValue(s), Source: src})
+	}
+
+	switch format {
+	case "yaml":
+		return writeYAML(cmd.OutOrStdout(), entries)
+	case "json":
+		return writeJSON(cmd.OutOrStdout(), entries)
+	default:
+		return apperror.ErrUsage(fmt.Sprintf("unsupported --format %q (expected yaml|json)", format))
+	}
+}
+
+func isEmpty(value any) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+func displayValue(s config.Setting) any {
+	switch val := s.Value.(type) {
+	case time.Duration:
+		return val.String()
+	case string:
+		if s.Secret && val != "" && !config.IsSecretReference(val) {
+			return logging.Redacted
+		}
+		// e.g. a proxy URL with a password
+		return logging.Redact(val)
+	}
+	return s.Value
+}
+
+// writeYAML prints the settings the way a config file holds them, with the
+// source as a comment.
+func writeYAML(w io.Writer, entries []entry) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, e := range entries {
+		m := root
+		parts := strings.Split(e.Key, ".")
+		for _, p := range parts[:len(parts)-1] {
+			m = childMapping(m, p)
+		}
+
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: parts[len(parts)-1]}
+		val := &yaml.Node{}
+		if err := val.Encode(e.Value); err != nil {
+			return err
+		}
+
+		// a block sequence or mapping starts on the next line
+		if val.Kind == yaml.ScalarNode || val.Style&yaml.FlowStyle != 0 || len(val.Content) == 0 {
+			val.LineComment = e.Source
+		} else {
+			key.LineComment = e.Source
+		}
+		m.Content = append(m.Content, key, val)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func childMapping(m *yaml.Node, name string) *yaml.Node {
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == name {
+			return m.Content[i+1]
+		}
+	}
+
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, child)
+	return child
+}
+
+func writeJSON(w io.Writer, entries []entry) error {
+	out := make(map[string]entry, len(entries))
+	for _, e := range entries {
+		out[e.Key] = e
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
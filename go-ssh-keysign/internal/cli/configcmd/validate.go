@@ -0,0 +1,87 @@
+package configcmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli"
+	"binarycodes/ssh-keysign/internal/cli/hostcmd"
+	"binarycodes/ssh-keysign/internal/cli/usercmd"
+	"binarycodes/ssh-keysign/internal/config"
+)
+
+func newValidateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate [file...]",
+		Short: "Check config files for unknown keys and values of the wrong type",
+		Long: "Checks each file, including its profiles, the way user and host read it, and prints every problem with its line. " +
+			"Without arguments the user config file is checked.\n\n" +
+			"Settings that only have to be present for a run, such as --principal, are not required here; use doctor for that.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files := args
+			if len(files) == 0 {
+				if p := cli.UserConfigPath(); p != "" {
+					files = []string{p}
+				} else {
+					return apperror.ErrUsage("no config file given and no user config directory found")
+				}
+			}
+
+			var errs []error
+			for _, f := range files {
+				if err := config.CheckFile(f); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: ok\n", f)
+			}
+
+			return errors.Join(errs...)
+		},
+	}
+}
+
+func newSchemaCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the config file",
+		Long: "Point an editor at the schema to validate and complete config files, e.g. with the YAML language server:\n\n" +
+			"  # yaml-language-server: $schema=/etc/ssh-keysign/config.schema.json",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(config.Schema(flagUsage(cmd.Root())))
+		},
+	}
+}
+
+// flagUsage documents a setting with the help of the flag that sets it.
+func flagUsage(root *cobra.Command) func(key string) string {
+	user := usercmd.NewCommand(usercmd.Deps{}).Flags()
+	host := hostcmd.NewCommand(hostcmd.Deps{}).Flags()
+
+	return func(key string) string {
+		sets := []*pflag.FlagSet{user, host, root.PersistentFlags()}
+		switch {
+		case strings.HasPrefix(key, "user."):
+			sets = sets[:1]
+		case strings.HasPrefix(key, "host."):
+			sets = sets[1:2]
+		}
+
+		name := key[strings.LastIndex(key, ".")+1:]
+		for _, fs := range sets {
+			if f := fs.Lookup(name); f != nil {
+				return f.Usage
+			}
+		}
+		return ""
+	}
+}
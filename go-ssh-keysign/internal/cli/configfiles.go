@@ -0,0 +1,253 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+)
+
+// SourceDefault is the source of a setting that nothing sets.
+const SourceDefault = "default"
+
+// reportsConfigErrors is the annotation of a command that reports config
+// files it cannot read instead of failing on them.
+const reportsConfigErrors = "reports-config-errors"
+
+// ReportConfigErrors marks cmd as reporting config file errors itself, see
+// ReportsConfigErrors.
+func ReportConfigErrors(cmd *cobra.Command) {
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[reportsConfigErrors] = "true"
+}
+
+// ReportsConfigErrors tells whether a failing ReadConfigFile should be left
+// to cmd, otherwise the run stops on it.
+func ReportsConfigErrors(cmd *cobra.Command) bool {
+	return cmd.Annotations[reportsConfigErrors] == "true"
+}
+
+// configFile is a file ReadConfigFile reads if it exists.
+type configFile struct {
+	path     string
+	system   bool
+	required bool
+}
+
+// UserConfigPath is the config file the user command reads by default,
+// empty when neither XDG_CONFIG_HOME nor the home directory is known.
+func UserConfigPath() string {
+	if dir := userConfigDir(); dir != "" {
+		return filepath.Join(dir, constants.ConfigFileName)
+	}
+	return ""
+}
+
+func userConfigDir() string {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return filepath.Join(configHome, constants.AppName)
+	}
+
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		return filepath.Join(home, ".config", constants.AppName)
+	}
+
+	return ""
+}
+
+// systemConfigDirs are read by both commands, lowest precedence first:
+// /etc/ssh-keysign, then the $XDG_CONFIG_DIRS entries (default /etc/xdg) of
+// which the first is the most important.
+func systemConfigDirs() []string {
+	dirs := []string{filepath.Join(constants.EtcDir, constants.AppName)}
+
+	xdgDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if xdgDirs == "" {
+		xdgDirs = "/etc/xdg"
+	}
+
+	entries := filepath.SplitList(xdgDirs)
+	for i := len(entries) - 1; i >= 0; i-- {
+		// the spec says to ignore relative paths
+		if !filepath.IsAbs(entries[i]) {
+			continue
+		}
+		if dir := filepath.Join(entries[i], constants.AppName); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// dirConfigFiles lists config.yml of dir and then its conf.d drop-ins in
+// lexical order, so that 10-ca.yml is overridden by 20-site.yml.
+func dirConfigFiles(dir string) []string {
+	dropIns, _ := filepath.Glob(filepath.Join(dir, "conf.d", "*.yml"))
+	slices.Sort(dropIns)
+	return append([]string{filepath.Join(dir, constants.ConfigFileName)}, dropIns...)
+}
+
+// configFiles lists the files of a run, lowest precedence first: the system
+// files, then --config or the user's own files for the user command. The host
+// command also reads host.yml of each system directory, which keeps the host's
+// credentials out of the files every user run reads.
+func configFiles(cmd *cobra.Command) ([]configFile, error) {
+	var files []configFile
+	for _, dir := range systemConfigDirs() {
+		for _, f := range dirConfigFiles(dir) {
+			files = append(files, configFile{path: f, system: true})
+		}
+		if cmd.Name() == "host" {
+			files = append(files, configFile{path: filepath.Join(dir, constants.HostConfigFileName), system: true})
+		}
+	}
+
+	explicit, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case explicit != "":
+		files = append(files, configFile{path: explicit, required: true})
+	case cmd.Name() == "user":
+		if dir := userConfigDir(); dir != "" {
+			for _, f := range dirConfigFiles(dir) {
+				files = append(files, configFile{path: f})
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// ReadConfigFile merges the config files of the command into v, applies the
+// selected profile and then the settings locked by the system files. The
+// files are kept in the context for SettingSource.
+func ReadConfigFile(cmd *cobra.Command, v *viper.Viper) error {
+	if f := cmd.Flags().Lookup("config"); f == nil {
+		return nil
+	}
+
+	files, err := configFiles(cmd)
+	if err != nil {
+		return err
+	}
+
+	log := ctxkeys.LoggerFrom(cmd.Context())
+
+	var layers config.Layers
+	for _, f := range files {
+		b, err := os.ReadFile(f.path)
+		switch {
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist) && !f.required:
+			continue
+		case errors.Is(err, fs.ErrPermission) && f.system:
+			// e.g. a host.yml with the client secret inline
+			log.Info("skipping unreadable system config file", zap.String("path", f.path))
+			continue
+		default:
+			return apperror.ErrFileSystem(fmt.Errorf("failed to read config %q: %w", f.path, err))
+		}
+
+		fv := viper.New()
+		fv.SetConfigType("yaml")
+		if err := fv.ReadConfig(bytes.NewReader(b)); err != nil {
+			return apperror.ErrFileSystem(fmt.Errorf("failed to read config %q: %w", f.path, err))
+		}
+
+		if err := config.Check(f.path, b); err != nil {
+			return err
+		}
+
+		settings := fv.AllSettings()
+		if _, ok := settings[config.LockedKey]; ok && !f.system {
+			return apperror.ErrUsage(fmt.Sprintf("%s: locked can only be set in a system config file", f.path))
+		}
+
+		// the file itself, AllSettings drops empty keys such as a profile
+		// that only selects the shared settings
+		v.SetConfigType("yaml")
+		if err := v.MergeConfig(bytes.NewReader(b)); err != nil {
+			return apperror.ErrFileSystem(fmt.Errorf("failed to read config %q: %w", f.path, err))
+		}
+		layers = append(layers, config.Layer{Path: f.path, System: f.system, Settings: settings})
+	}
+
+	cmd.SetContext(ctxkeys.WithConfigLayers(cmd.Context(), layers))
+
+	if err := config.ApplyProfile(v); err != nil {
+		return err
+	}
+
+	// an override of a locked setting is ignored rather than an error, so a
+	// user config shared between machines keeps working
+	for _, lock := range layers.Locks() {
+		if src, layer := settingSource(cmd, v, layers, lock.Key); src != SourceDefault && !layer.System {
+			log.Warn("setting is locked by a system config file, ignoring the override",
+				zap.String("key", lock.Key),
+				zap.String("locked-in", lock.Path),
+				zap.String("override", src),
+			)
+		}
+		v.Set(lock.Key, lock.Value)
+	}
+
+	return nil
+}
+
+// SettingSource tells where the value of key comes from, in the order viper
+// applies them: a lock, flag, environment, the selected profile, the config
+// files.
+func SettingSource(cmd *cobra.Command, v *viper.Viper, key string) string {
+	layers := ctxkeys.ConfigLayersFrom(cmd.Context())
+	if lock, ok := layers.Lock(key); ok {
+		return "locked in " + lock.Path
+	}
+
+	src, _ := settingSource(cmd, v, layers, key)
+	return src
+}
+
+// settingSource is SettingSource without locks, it also returns the config
+// file of the value; a flag or environment variable has the zero Layer.
+func settingSource(cmd *cobra.Command, v *viper.Viper, layers config.Layers, key string) (string, config.Layer) {
+	// user.key and host.key are set by --key
+	flagName := key[strings.LastIndex(key, ".")+1:]
+	if f := cmd.Flags().Lookup(flagName); f != nil && f.Changed {
+		return "flag --" + flagName, config.Layer{}
+	}
+
+	env := strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(constants.AppName + "_" + key))
+	if _, ok := os.LookupEnv(env); ok {
+		return "env " + env, config.Layer{}
+	}
+
+	if profile := v.GetString("profile"); profile != "" {
+		if _, layer, ok := layers.Value("profiles." + profile + "." + key); ok {
+			return fmt.Sprintf("config %s (profile %s)", layer.Path, profile), *layer
+		}
+	}
+
+	if _, layer, ok := layers.Value(key); ok {
+		return "config " + layer.Path, *layer
+	}
+
+	return SourceDefault, config.Layer{}
+}
@@ -0,0 +1,87 @@
+package devservercmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/devserver"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+func NewCommand() *cobra.Command {
+	devCmd := &cobra.Command{
+		Use:   "dev-server",
+		Short: "Run an in-memory CA and OIDC stand-in server (development only)",
+		Long: "Serves OIDC discovery, a token endpoint for client credentials and device flow, and the CA server's sign endpoints from memory, " +
+			"so the host and user commands can be tried without Keycloak or the CA server. The CA key is generated on start and lost on exit.\n\n" +
+			"Device logins wait until approved: POST user_code and username to /dev/approve, or start with --auto-approve. " +
+			"POST path, status and times to /dev/fail to make the next requests to path fail.",
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return ctxkeys.ViperFrom(cmd.Context()).BindPFlags(cmd.Flags())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v := ctxkeys.ViperFrom(cmd.Context())
+			log := ctxkeys.LoggerFrom(cmd.Context())
+			p := ctxkeys.PrinterFrom(cmd.Context())
+
+			srv, err := devserver.New(devserver.Options{
+				ClientID:     v.GetString("client-id"),
+				ClientSecret: v.GetString("client-secret"),
+				AutoApprove:  v.GetString("auto-approve"),
+				PendingPolls: v.GetInt("pending-polls"),
+			})
+			if err != nil {
+				return err
+			}
+
+			l, err := net.Listen("tcp", v.GetString("listen"))
+			if err != nil {
+				return apperror.ErrUsage(err.Error())
+			}
+
+			base := "http://" + l.Addr().String()
+			p.Printf("dev-server listening on %s (development only: tokens and the CA key live in memory)\n\n", base)
+			p.Printf("CA public key, for TrustedUserCAKeys or an @cert-authority line:\n%s\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(srv.CAPublicKey()))))
+			p.Printf("Use it with:\n  --issuer %s --ca-server-url %s --client-id %s\n", base, base, v.GetString("client-id"))
+
+			httpSrv := &http.Server{Handler: srv.Handler(), ReadHeaderTimeout: 10 * time.Second}
+			serveErr := make(chan error, 1)
+			go func() { serveErr <- httpSrv.Serve(l) }()
+
+			select {
+			case err := <-serveErr:
+				return apperror.ErrNet(err)
+			case <-cmd.Context().Done():
+			}
+
+			log.Info("shutting down dev-server")
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(cmd.Context()), shutdownTimeout)
+			defer cancel()
+
+			if err := httpSrv.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Warn("dev-server shutdown", zap.Error(err))
+			}
+			return nil
+		},
+	}
+
+	devCmd.Flags().String("listen", "127.0.0.1:8088", "address to listen on")
+	devCmd.Flags().String("client-id", "dev-client", "the only OAuth client accepted")
+	devCmd.Flags().String("client-secret", "", "secret of the client, enables client credentials")
+	devCmd.Flags().String("auto-approve", "", "approve every device login as this user")
+	devCmd.Flags().Int("pending-polls", 1, "answer this many polls with authorization_pending before --auto-approve")
+
+	return devCmd
+}
@@ -0,0 +1,470 @@
+package doctorcmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/keys"
+	"binarycodes/ssh-keysign/internal/service/oauth"
+	"binarycodes/ssh-keysign/internal/service/oidc"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+// Clock skew against the CA server's Date header. Certificates are checked
+// against the current time, so a few minutes off makes a fresh one look not
+// yet valid.
+const (
+	skewWarn = 30 * time.Second
+	skewFail = 5 * time.Minute
+)
+
+type status string
+
+const (
+	statusPass status = "pass"
+	statusWarn status = "warn"
+	statusFail status = "fail"
+	statusSkip status = "skip"
+)
+
+type check struct {
+	Name    string `json:"name"`
+	Status  status `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// doctor runs the checks for the user or host command. A failed check does
+// not stop the run unless the checks after it cannot work without it.
+type doctor struct {
+	cmd    *cobra.Command
+	cfg    config.Config
+	idp    *http.Client
+	ca     *http.Client
+	valid  bool
+	checks []check
+}
+
+func (d *doctor) add(name string, s status, message, hint string) {
+	d.checks = append(d.checks, check{Name: name, Status: s, Message: message, Hint: hint})
+}
+
+// fail reports err, with the hint attached to it if there is one.
+func (d *doctor) fail(name string, err error, hint string) {
+	if h := apperror.HintOf(err); h != "" {
+		hint = h
+	}
+	d.add(name, statusFail, err.Error(), hint)
+}
+
+func (d *doctor) count(s status) int {
+	n := 0
+	for _, c := range d.checks {
+		if c.Status == s {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *doctor) user() bool {
+	return d.cmd.Name() == "user"
+}
+
+// usesIdP tells whether a token is needed from the IdP.
+func (d *doctor) usesIdP() bool {
+	return !d.cfg.LocalCA.Enabled() && !d.cfg.Vault.Enabled() && !d.cfg.StepCA.SignsOTT()
+}
+
+func (d *doctor) keyPath() string {
+	if d.user() {
+		return d.cfg.User.Key
+	}
+	return d.cfg.Host.Key
+}
+
+func (d *doctor) principals() []string {
+	if d.user() {
+		return d.cfg.User.Principals
+	}
+	return d.cfg.Host.Principals
+}
+
+// signedPrincipals are the principals a new certificate is for: the CA
+// server and the local CA sign only the first configured one.
+func (d *doctor) signedPrincipals() []string {
+	p := d.principals()
+	if len(p) == 0 || d.cfg.Vault.Enabled() || d.cfg.StepCA.Enabled() {
+		return p
+	}
+	return p[:1]
+}
+
+// run starts from the outcome of reading the config file.
+func (d *doctor) run(readErr error) {
+	if !d.checkConfig(readErr) || !d.checkTransport() {
+		return
+	}
+
+	d.checkDiscovery()
+	d.checkSettings()
+	d.checkKey()
+	if d.user() {
+		d.checkAgent()
+	}
+	d.checkCAServer()
+	d.checkToken()
+	d.checkCertificate()
+}
+
+func (d *doctor) checkConfig(readErr error) bool {
+	if readErr != nil {
+		d.fail("config", readErr, "config validate lists every problem of the file")
+		return false
+	}
+
+	v := ctxkeys.ViperFrom(d.cmd.Context())
+
+	cfg, err := config.Load(v)
+	if err != nil {
+		d.fail("config", err, fmt.Sprintf("config show %s prints each value and where it comes from", d.cmd.Name()))
+		return false
+	}
+	d.cfg = cfg
+
+	layers := ctxkeys.ConfigLayersFrom(d.cmd.Context())
+	msg := "no config file, using flags and environment"
+	if len(layers) > 0 {
+		paths := make([]string, len(layers))
+		for i, l := range layers {
+			paths[i] = l.Path
+		}
+		msg = "read " + strings.Join(paths, ", ")
+	}
+	if locks := layers.Locks(); len(locks) > 0 {
+		msg += fmt.Sprintf(", %d settings locked", len(locks))
+	}
+	if cfg.Profile != "" {
+		msg += fmt.Sprintf(" (profile %s)", cfg.Profile)
+	}
+
+	d.add("config", statusPass, msg, "")
+	return true
+}
+
+func (d *doctor) checkTransport() bool {
+	if d.cfg.LocalCA.Enabled() {
+		return true
+	}
+
+	idp, ca, err := cli.NewHTTPClients(d.cmd, d.cfg)
+	if err != nil {
+		d.fail("transport", err, "check the TLS, proxy and client certificate settings")
+		return false
+	}
+	d.idp, d.ca = idp, ca
+	return true
+}
+
+func (d *doctor) checkDiscovery() {
+	if d.cfg.OAuth.Issuer == "" || !d.usesIdP() {
+		return
+	}
+
+	disc := oidc.Discovery{HTTPClient: d.idp}
+
+	m, err := disc.Fetch(d.cmd.Context(), d.cfg.OAuth.Issuer)
+	if err != nil {
+		d.fail("discovery", err, "check --issuer, the network and --proxy; the issuer must serve /.well-known/openid-configuration")
+		return
+	}
+
+	o, err := disc.Resolve(d.cmd.Context(), d.cfg.OAuth, !d.user() || d.cfg.OAuth.HasTokenExchange())
+	if err != nil {
+		d.fail("discovery", err, "")
+		return
+	}
+	d.cfg.OAuth = o
+
+	d.add("discovery", statusPass, fmt.Sprintf("issuer %s, token endpoint %s", m.Issuer, m.TokenEndpoint), "")
+}
+
+func (d *doctor) checkSettings() {
+	var err error
+	if d.user() {
+		err = d.cfg.ValidateUser()
+	} else {
+		err = d.cfg.ValidateHost()
+	}
+
+	if err != nil {
+		d.fail("settings", err, fmt.Sprintf("set it with a flag, an SSH_KEYSIGN_* variable or in the config file; config show %s lists the effective values", d.cmd.Name()))
+		return
+	}
+
+	d.valid = true
+	d.add("settings", statusPass, "all required settings are present", "")
+}
+
+func (d *doctor) checkKey() {
+	path := d.keyPath()
+	if path == "" {
+		if d.user() {
+			d.add("key", statusPass, "no --key, a new ed25519 key is created for each run and kept in ssh-agent", "")
+		}
+		return
+	}
+
+	hint := "point --key at the .pub file of an existing key, e.g. ~/.ssh/id_ed25519.pub"
+	if err := config.ValidateKeyFile(path, false); err != nil {
+		d.fail("key", err, hint)
+		return
+	}
+
+	keyType, _, err := keys.CAKeyHandler{}.ReadPublicKey(d.cmd.Context(), path)
+	if err != nil {
+		d.fail("key", apperror.ErrCert(fmt.Errorf("read %s: %w", path, err)), hint)
+		return
+	}
+
+	d.add("key", statusPass, fmt.Sprintf("%s public key %s", keyType, path), "")
+}
+
+func (d *doctor) checkAgent() {
+	// only agent mode stores the certificate in ssh-agent
+	missing := statusFail
+	if d.cfg.User.Key != "" {
+		missing = statusWarn
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		d.add("ssh-agent", missing, "SSH_AUTH_SOCK is not set", `start an agent with eval "$(ssh-agent)" or enable the one of your desktop session`)
+		return
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(d.cmd.Context(), "unix", sock)
+	if err != nil {
+		d.add("ssh-agent", missing, fmt.Sprintf("cannot connect to %s: %v", sock, err), "the agent is gone; start a new one and update SSH_AUTH_SOCK")
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	list, err := agent.NewClient(conn).List()
+	if err != nil {
+		d.add("ssh-agent", missing, fmt.Sprintf("listing keys in %s: %v", sock, err), "")
+		return
+	}
+
+	var certs []*ssh.Certificate
+	for _, k := range list {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			certs = append(certs, cert)
+		}
+	}
+
+	d.add("ssh-agent", statusPass, fmt.Sprintf("%s holds %d keys, %d of them certificates", sock, len(list), len(certs)), "")
+
+	for _, cert := range certs {
+		s, msg, hint := inspectCert(cert, d.signedPrincipals(), time.Now(), "remove it with ssh-add -d or ssh-add -D and run ssh-keysign user")
+		d.add("agent certificate", s, fmt.Sprintf("%q %s", cert.KeyId, msg), hint)
+	}
+}
+
+func (d *doctor) checkCAServer() {
+	var url string
+	switch {
+	case d.cfg.LocalCA.Enabled():
+		return
+	case d.cfg.Vault.Enabled():
+		url = strings.TrimSuffix(d.cfg.Vault.Addr, "/") + "/v1/sys/health"
+	case d.cfg.StepCA.Enabled():
+		url = strings.TrimSuffix(d.cfg.OAuth.ServerURL, "/") + "/health"
+	default:
+		url = d.cfg.OAuth.ServerURL
+	}
+
+	if url == "" {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(d.cmd.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		d.fail("ca server", apperror.ErrUsage(err.Error()), "check --ca-server-url")
+		return
+	}
+
+	resp, err := d.ca.Do(req)
+	if err != nil {
+		d.fail("ca server", apperror.ErrNet(err), "check --ca-server-url, the network and --proxy; for TLS errors see --ca-server-ca-bundle")
+		return
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		d.add("ca server", statusWarn, fmt.Sprintf("%s answered %s", url, resp.Status), "the CA server is up but failing; retry later or contact its operators")
+	} else {
+		d.add("ca server", statusPass, fmt.Sprintf("%s answered %s", url, resp.Status), "")
+	}
+
+	d.checkClock(resp.Header.Get("Date"))
+}
+
+func (d *doctor) checkClock(date string) {
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+
+	// Date has a resolution of a second
+	skew := time.Since(serverTime).Truncate(time.Second)
+	msg := fmt.Sprintf("local clock is %s off the CA server", skew.Abs())
+
+	switch {
+	case skew.Abs() >= skewFail:
+		d.add("clock", statusFail, msg, "certificates are checked against the current time; sync the clock, e.g. timedatectl set-ntp true")
+	case skew.Abs() >= skewWarn:
+		d.add("clock", statusWarn, msg, "sync the clock, e.g. timedatectl set-ntp true")
+	default:
+		d.add("clock", statusPass, msg, "")
+	}
+}
+
+func (d *doctor) checkToken() {
+	if !d.usesIdP() {
+		return
+	}
+
+	if !d.valid {
+		d.add("token", statusSkip, "not tried, the settings are incomplete", "")
+		return
+	}
+
+	ctx := d.cmd.Context()
+	client := oauth.CAAuthClient{HTTPClient: d.idp}
+
+	var (
+		token *service.AccessToken
+		err   error
+		grant string
+	)
+
+	switch {
+	case d.user() && d.cfg.OAuth.HasTokenExchange():
+		grant = "token exchange"
+		token, err = client.TokenExchangeLogin(ctx, d.cfg.OAuth)
+	case !d.user() || d.cfg.OAuth.HasClientCredential():
+		grant = "client credentials"
+		token, err = client.ClientCredentialLogin(ctx, d.cfg.OAuth)
+	default:
+		if login, _ := d.cmd.Flags().GetBool("login"); !login {
+			d.add("token", statusSkip, "not tried, device flow needs a browser login", "run doctor user --login to try it")
+			return
+		}
+		grant = "device flow"
+		token, err = client.DeviceFlowLogin(ctx, d.cfg.OAuth)
+	}
+
+	if err == nil && (token == nil || !token.OK(ctx)) {
+		err = apperror.ErrAuth(errors.New("the token response is incomplete"))
+	}
+	if err != nil {
+		d.fail("token", apperror.OpOr(grant, apperror.KAuth, err), "check --client-id and its secret or key with the IdP administrators")
+		return
+	}
+
+	d.add("token", statusPass, fmt.Sprintf("%s: received a %s token valid for %s", grant, token.TokenType, time.Duration(token.ExpiresIn)*time.Second), "")
+}
+
+func (d *doctor) checkCertificate() {
+	if d.keyPath() == "" {
+		return
+	}
+
+	certPath, err := paths.GetCertificateFilePath(d.keyPath(), d.cfg.Profile)
+	if err != nil {
+		d.fail("certificate", err, "")
+		return
+	}
+
+	b, err := os.ReadFile(certPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		d.add("certificate", statusWarn, "no certificate at "+certPath+" yet", d.renewHint())
+		return
+	}
+	if err != nil {
+		d.fail("certificate", apperror.ErrFileSystem(err), "")
+		return
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	cert, ok := pub.(*ssh.Certificate)
+	if err != nil || !ok {
+		d.add("certificate", statusFail, certPath+" does not hold an SSH certificate", "remove it and "+d.renewHint())
+		return
+	}
+
+	s, msg, hint := inspectCert(cert, d.signedPrincipals(), time.Now(), d.renewHint())
+	d.add("certificate", s, certPath+" "+msg, hint)
+}
+
+func (d *doctor) renewHint() string {
+	return "run ssh-keysign " + d.cmd.Name() + " to get a new one"
+}
+
+// inspectCert tells whether cert can be used at now for principals. renew is
+// the hint for a certificate that has to be replaced.
+func inspectCert(cert *ssh.Certificate, principals []string, now time.Time, renew string) (status, string, string) {
+	unix := uint64(now.Unix())
+
+	if unix < cert.ValidAfter {
+		return statusWarn, "is not valid until " + certTime(cert.ValidAfter),
+			"the local clock may be behind; sync it, e.g. timedatectl set-ntp true"
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return statusWarn, "expired at " + certTime(cert.ValidBefore), renew
+	}
+
+	var missing []string
+	for _, p := range principals {
+		if !slices.Contains(cert.ValidPrincipals, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return statusWarn, fmt.Sprintf("is for %s, not %s", strings.Join(cert.ValidPrincipals, ","), strings.Join(missing, ",")),
+			"the configured principals changed since it was signed; " + renew
+	}
+
+	until := "forever"
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		until = "until " + certTime(cert.ValidBefore)
+	}
+	return statusPass, fmt.Sprintf("is valid %s for %s", until, strings.Join(cert.ValidPrincipals, ",")), ""
+}
+
+func certTime(t uint64) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,65 @@
+package doctorcmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli"
+	"binarycodes/ssh-keysign/internal/cli/hostcmd"
+	"binarycodes/ssh-keysign/internal/cli/usercmd"
+)
+
+func NewCommand() *cobra.Command {
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the configuration, ssh-agent, IdP and CA server and explain what is wrong",
+		Long: "doctor user and doctor host take the flags and config of that command and run a sequence of checks instead of signing: " +
+			"the configuration, the key file, ssh-agent, OIDC discovery, the CA server and the clock, getting a token and the existing certificates.\n\n" +
+			"Each check passes, warns or fails with a hint on how to fix it. --format json prints a report that can be pasted into a support ticket. " +
+			"The exit code is 20 when a check fails.",
+		Args: cobra.NoArgs,
+	}
+
+	doctorCmd.PersistentFlags().String("format", "text", "output format: text|json")
+
+	userCmd := doctorFor(usercmd.NewCommand(usercmd.Deps{}))
+	userCmd.Flags().Bool("login", false, "also try the device flow login, which needs a browser")
+
+	doctorCmd.AddCommand(userCmd, doctorFor(hostcmd.NewCommand(hostcmd.Deps{})))
+
+	return doctorCmd
+}
+
+// doctorFor turns the user or host command into its doctor subcommand, see
+// showFor in configcmd.
+func doctorFor(c *cobra.Command) *cobra.Command {
+	c.Short = fmt.Sprintf("Check the setup of the %s command", c.Name())
+	c.Long = ""
+
+	// a config file that cannot be read is reported as a check
+	readConfig := c.PreRunE
+	c.PreRunE = nil
+	cli.ReportConfigErrors(c)
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		if format != "text" && format != "json" {
+			return apperror.ErrUsage(fmt.Sprintf("unsupported --format %q (expected text|json)", format))
+		}
+
+		d := &doctor{cmd: cmd}
+		d.run(readConfig(cmd, args))
+
+		if err := d.report(cmd.OutOrStdout(), format); err != nil {
+			return err
+		}
+
+		if n := d.count(statusFail); n > 0 {
+			return apperror.ErrCheckFailed(fmt.Errorf("%d of %d checks failed", n, len(d.checks)))
+		}
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,173 @@
+package doctorcmd_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/cli/doctorcmd"
+	"binarycodes/ssh-keysign/internal/cli/testutil"
+	"binarycodes/ssh-keysign/internal/devserver"
+)
+
+func newDevServer(t *testing.T, opts devserver.Options) *httptest.Server {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	s, err := devserver.New(opts)
+	require.NoError(t, err)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func copyTestKey(t *testing.T) string {
+	t.Helper()
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	return testutil.WriteTempFile(t, "id.pub", pub)
+}
+
+func TestDoctorHost_DevServerJSON(t *testing.T) {
+	srv := newDevServer(t, devserver.Options{ClientID: "web01", ClientSecret: "s3cret"})
+	keyPath := copyTestKey(t)
+
+	cmd := doctorcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "host",
+		"--key", keyPath,
+		"--principal", "web01",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "web01",
+		"--client-secret", "s3cret",
+		"--format", "json",
+	)
+	require.NoError(t, err)
+
+	var got struct {
+		Command string
+		Checks  []struct{ Name, Status, Message, Hint string }
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+	assert.Equal(t, "host", got.Command)
+
+	status := map[string]string{}
+	for _, c := range got.Checks {
+		status[c.Name] = c.Status
+	}
+	assert.Equal(t, map[string]string{
+		"config":      "pass",
+		"discovery":   "pass",
+		"settings":    "pass",
+		"key":         "pass",
+		"ca server":   "pass",
+		"clock":       "pass",
+		"token":       "pass",
+		"certificate": "warn",
+	}, status)
+}
+
+func TestDoctorUser_FailuresCarryHints(t *testing.T) {
+	cmd := doctorcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "user",
+		"--ca-server-url", "http://127.0.0.1:1",
+		"--client-id", "cli",
+		"--device-flow-url", "http://127.0.0.1:1/device",
+		"--token-poll-url", "http://127.0.0.1:1/token",
+		"--retries", "0",
+	)
+	require.Error(t, err)
+	assert.Equal(t, apperror.KCheckFailed, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "2 of 6 checks failed")
+
+	assert.Regexp(t, `FAIL  settings +missing required parameters: --principal\n +hint: set it with a flag`, stdout)
+	assert.Regexp(t, `PASS  ssh-agent `, stdout)
+	assert.Regexp(t, `FAIL  ca server +Get "http://127.0.0.1:1"`, stdout)
+	assert.Regexp(t, `SKIP  token +not tried, the settings are incomplete`, stdout)
+	assert.Contains(t, stdout, "3 passed, 0 warned, 2 failed")
+}
+
+func TestDoctorUser_ExpiredCertificate(t *testing.T) {
+	srv := newDevServer(t, devserver.Options{ClientID: "cli"})
+	keyPath := copyTestKey(t)
+
+	writeUserCert(t, keyPath, []string{"alice"}, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	cmd := doctorcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "user",
+		"--key", keyPath,
+		"--principal", "alice",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "cli",
+	)
+	require.NoError(t, err)
+
+	assert.Regexp(t, `SKIP  token +not tried, device flow needs a browser login`, stdout)
+	assert.Regexp(t, `WARN  certificate +`+regexp.QuoteMeta(filepath.Join(filepath.Dir(keyPath), "id-cert.pub"))+` expired at .*\n +hint: run ssh-keysign user to get a new one`, stdout)
+	assert.Contains(t, stdout, "7 passed, 1 warned, 0 failed")
+}
+
+func TestDoctorUser_CertificateForFirstPrincipal(t *testing.T) {
+	srv := newDevServer(t, devserver.Options{ClientID: "cli"})
+	keyPath := copyTestKey(t)
+
+	// the CA server signs the first principal only
+	writeUserCert(t, keyPath, []string{"alice"}, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+
+	cmd := doctorcmd.NewCommand()
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd, "user",
+		"--key", keyPath,
+		"--principal", "alice,admin",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "cli",
+	)
+	require.NoError(t, err)
+
+	assert.Regexp(t, `PASS  certificate +.* is valid until .* for alice\n`, stdout)
+	assert.Contains(t, stdout, "0 warned, 0 failed")
+}
+
+// writeUserCert writes id-cert.pub next to keyPath, signed by a throwaway CA.
+func writeUserCert(t *testing.T, keyPath string, principals []string, after, before time.Time) {
+	t.Helper()
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(mustRead(t, keyPath))
+	require.NoError(t, err)
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           principals[0],
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(after.Unix()),
+		ValidBefore:     uint64(before.Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, signer))
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(keyPath), "id-cert.pub"), ssh.MarshalAuthorizedKey(cert), 0o600))
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return b
+}
@@ -0,0 +1,47 @@
+package doctorcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/meta"
+)
+
+type report struct {
+	Command string  `json:"command"`
+	Version string  `json:"version"`
+	Profile string  `json:"profile,omitempty"`
+	Checks  []check `json:"checks"`
+}
+
+func (d *doctor) report(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report{
+			Command: d.cmd.Name(),
+			Version: meta.Version,
+			Profile: d.cfg.Profile,
+			Checks:  d.checks,
+		})
+	}
+
+	width := 0
+	for _, c := range d.checks {
+		width = max(width, len(c.Name))
+	}
+
+	indent := strings.Repeat(" ", 4+2+width+2)
+	for _, c := range d.checks {
+		msg := strings.ReplaceAll(c.Message, "\n", "\n"+indent)
+		fmt.Fprintf(w, "%-4s  %-*s  %s\n", strings.ToUpper(string(c.Status)), width, c.Name, msg)
+		if c.Hint != "" {
+			fmt.Fprintf(w, "%shint: %s\n", indent, c.Hint)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d passed, %d warned, %d failed\n", d.count(statusPass), d.count(statusWarn), d.count(statusFail))
+	return err
+}
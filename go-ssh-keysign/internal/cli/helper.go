@@ -3,25 +3,77 @@ package cli
 import (
 	"errors"
 	"fmt"
-	"io/fs"
-	"os"
-	"path/filepath"
+	"net/http"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
 
-	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
 	"binarycodes/ssh-keysign/internal/constants"
 	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/cacert"
+	"binarycodes/ssh-keysign/internal/service/localca"
+	"binarycodes/ssh-keysign/internal/service/oauth"
+	"binarycodes/ssh-keysign/internal/service/oidc"
+	"binarycodes/ssh-keysign/internal/service/stepca"
+	"binarycodes/ssh-keysign/internal/service/transport"
+	"binarycodes/ssh-keysign/internal/service/vault"
 )
 
 func WireCommonFlags(c *cobra.Command) {
-	c.Flags().StringP("config", "c", "", "path to config file")
+	c.Flags().StringP("config", "c", "", "config file read after the system config files, instead of the user's own")
+	c.Flags().String("profile", "", "profile from the config file's profiles section (default: its profile key, else \"default\" if defined); "+
+		"a profile other than \"default\" writes <key>-<profile>-cert.pub, which ssh only offers with a CertificateFile entry")
 	c.Flags().String("ca-server-url", "", "CA server URL")
 	c.Flags().String("client-id", "", "OIDC client ID")
-	c.Flags().String("client-secret", "", "OIDC client secret")
+	c.Flags().String("client-secret", "", "OIDC client secret, or a reference: file:PATH|env:NAME|stdin|cred:NAME|exec:COMMAND")
+	c.Flags().String("client-auth-method", "", "token endpoint client authentication: client_secret_post|private_key_jwt|tls_client_auth")
+	c.Flags().String("client-assertion-key", "", "private key used to sign the private_key_jwt client assertion, e.g. /etc/ssh/ssh_host_ed25519_key")
+	c.Flags().String("issuer", "", "OIDC issuer URL, endpoints are discovered from its /.well-known/openid-configuration")
 	c.Flags().String("token-url", "", "OIDC token URL")
+	c.Flags().StringSlice("scopes", nil, "comma-separated scopes to request (device flow defaults to openid)")
+	c.Flags().String("audience", "", "audience to request the access token for, as expected by the CA server")
+	c.Flags().StringSlice("resource", nil, "comma-separated resource indicators (RFC 8707), e.g. the CA server URL")
+	c.Flags().String("tls-client-cert", "", "client certificate presented to the IdP and CA server (mutual TLS)")
+	c.Flags().String("tls-client-key", "", "private key for --tls-client-cert")
+	c.Flags().String("proxy", "", "proxy URL for requests to the IdP and CA server (default from HTTPS_PROXY, NO_PROXY is honored)")
+	c.Flags().Duration("connect-timeout", constants.DefaultConnectTimeout, "timeout for establishing a connection")
+	c.Flags().Duration("tls-handshake-timeout", constants.DefaultTLSHandshakeTimeout, "timeout for the TLS handshake")
+	c.Flags().Duration("http-timeout", constants.DefaultHTTPTimeout, "overall timeout for a single HTTP call, including retries")
+	c.Flags().Int("retries", constants.DefaultRetries, "retries for connection errors and 429, 502, 503 and 504 responses")
+	c.Flags().Duration("retry-max-time", constants.DefaultRetryMaxTime, "give up retrying once this much time has passed")
+	c.Flags().String("ca-key", "", "sign locally with this CA private key instead of asking the CA server; no OAuth login is done")
+	c.Flags().String("ca-key-passphrase", "", "passphrase of --ca-key, or a reference: file:PATH|env:NAME|stdin|cred:NAME|exec:COMMAND (prompted on a terminal when unset)")
+	c.Flags().StringSlice("ca-extensions", constants.DefaultUserCertExtensions, "extensions granted to user certificates signed with --ca-key")
+	c.Flags().StringSlice("ca-source-address", nil, "comma-separated source-address restriction for user certificates signed with --ca-key")
+	c.Flags().String("ca-audit-log", "", "file every certificate signed with --ca-key is recorded in (default $XDG_STATE_HOME/ssh-keysign/local-ca-audit.jsonl)")
+	c.Flags().String("vault-addr", "", "sign with HashiCorp Vault's SSH secrets engine at this address instead of the CA server (TLS settings: --ca-server-*)")
+	c.Flags().String("vault-namespace", "", "Vault Enterprise namespace")
+	c.Flags().String("vault-mount", constants.DefaultVaultMount, "mount path of the SSH secrets engine")
+	c.Flags().String("vault-role", "", "Vault SSH role to sign with")
+	c.Flags().String("vault-auth-method", "", "how to get a Vault token: token|approle|jwt (inferred from the credentials when unset)")
+	c.Flags().String("vault-auth-mount", "", "mount path of the Vault auth method (default: the method name)")
+	c.Flags().String("vault-token", "", "Vault token, or a reference: file:PATH|env:NAME|stdin|cred:NAME|exec:COMMAND (default from VAULT_TOKEN or ~/.vault-token)")
+	c.Flags().String("vault-role-id", "", "AppRole role_id")
+	c.Flags().String("vault-secret-id", "", "AppRole secret_id, or a reference: file:PATH|env:NAME|stdin|cred:NAME|exec:COMMAND")
+	c.Flags().String("vault-jwt-role", "", "Vault JWT auth role")
+	c.Flags().String("vault-jwt", "", "JWT to log in to Vault with, or a reference, e.g. file:/var/run/secrets/tokens/vault")
+	c.Flags().StringSlice("vault-extensions", nil, "comma-separated extensions to request for user certificates (default: the role's default_extensions)")
+	c.Flags().StringToString("vault-critical-options", nil, "critical options to request for user certificates, e.g. source-address=10.0.0.0/8")
+	c.Flags().String("ca-server-type", config.CAServerKeysign, "kind of CA at --ca-server-url: ssh-keysign|step-ca")
+	c.Flags().String("step-root-fingerprint", "", "SHA-256 fingerprint of the step-ca root; the root is downloaded and trusted instead of the system roots")
+	c.Flags().String("step-provisioner", "", "step-ca JWK provisioner name, the issuer of the one-time token")
+	c.Flags().String("step-provisioner-key", "", "private key of the JWK provisioner (PEM or OpenSSH) to sign the one-time token with; no IdP login is done")
+	c.Flags().String("step-provisioner-kid", "", "key ID of the JWK provisioner (default: the JWK thumbprint of --step-provisioner-key)")
+	for _, ep := range []struct{ prefix, name string }{{"idp", "IdP"}, {"ca-server", "CA server"}} {
+		c.Flags().String(ep.prefix+"-ca-bundle", "", "PEM file with additional root certificates trusted for the "+ep.name)
+		c.Flags().String(ep.prefix+"-tls-min-version", "1.2", "minimum TLS version for the "+ep.name+": 1.2|1.3")
+		c.Flags().StringSlice(ep.prefix+"-pin-sha256", nil, "comma-separated sha256/BASE64 pins of the "+ep.name+" certificate public key")
+		c.Flags().Bool(ep.prefix+"-insecure-skip-verify", false, "DEVELOPMENT ONLY: do not verify the "+ep.name+" certificate")
+	}
 
 	prevPreRunE := c.PreRunE
 	c.PreRunE = func(cmd *cobra.Command, args []string) error {
@@ -36,14 +88,15 @@ func WireCommonFlags(c *cobra.Command) {
 
 		cmd.SetContext(ctxkeys.WithViper(cmd.Context(), v))
 
-		if err := ReadConfigFile(cmd, v); err != nil {
-			return err
-		}
-
+		// before the config file is read, SSH_KEYSIGN_PROFILE selects the profile
 		v.SetEnvPrefix(strings.ToUpper(constants.AppName))
 		v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 		v.AutomaticEnv()
 
+		if err := ReadConfigFile(cmd, v); err != nil {
+			return err
+		}
+
 		if prevPreRunE != nil {
 			if err := prevPreRunE(cmd, args); err != nil {
 				return err
@@ -54,43 +107,105 @@ func WireCommonFlags(c *cobra.Command) {
 	}
 }
 
-func ReadConfigFile(cmd *cobra.Command, v *viper.Viper) error {
-	if f := cmd.Flags().Lookup("config"); f == nil {
-		return nil
+// NewClients picks the backend that signs the certificate: the local CA,
+// Vault, or step-ca or the CA server after an OAuth login. The returned OAuth
+// client is nil when no login is done, and the returned config has the
+// endpoints found by OIDC discovery. withTokenURL is passed on to
+// oidc.Discovery.Resolve.
+func NewClients(cmd *cobra.Command, cfg config.Config, withTokenURL bool) (service.OAuthClient, service.CertClient, config.Config, error) {
+	switch {
+	case cfg.LocalCA.Enabled():
+		ca := localca.New(cfg.LocalCA)
+		ca.Prompt = cmd.ErrOrStderr()
+		return nil, ca, cfg, nil
+	case cfg.Vault.Enabled():
+		_, caClient, err := NewHTTPClients(cmd, cfg)
+		if err != nil {
+			return nil, nil, cfg, err
+		}
+
+		return nil, vault.New(caClient, cfg.Vault), cfg, nil
 	}
 
-	configFilePath, err := cmd.Flags().GetString("config")
+	idpClient, caClient, err := NewHTTPClients(cmd, cfg)
 	if err != nil {
-		return err
+		return nil, nil, cfg, err
 	}
 
-	if configFilePath != "" {
-		v.SetConfigFile(configFilePath)
-		v.SetConfigType("yaml")
-
-		if err := v.ReadInConfig(); err != nil {
-			return apperror.ErrFileSystem(fmt.Errorf("failed to read config %q: %w", configFilePath, err))
-		}
+	var certClient service.CertClient
+	if cfg.StepCA.Enabled() {
+		certClient = stepca.New(caClient, cfg.OAuth.ServerURL, cfg.StepCA)
 	} else {
-		switch cmd.Name() {
-		case "user":
-			if runtimeDir := os.Getenv("XDG_CONFIG_HOME"); runtimeDir != "" {
-				v.SetConfigFile(filepath.Join(runtimeDir, constants.AppName, constants.ConfigFileName))
-			} else if home, err := os.UserHomeDir(); err == nil && home != "" {
-				v.SetConfigFile(filepath.Join(home, ".config", constants.AppName, constants.ConfigFileName))
-			}
-		case "host":
-			configPath := filepath.Join(constants.EtcDir, constants.AppName, constants.ConfigFileName)
-			v.SetConfigFile(configPath)
-		}
-		v.SetConfigType("yaml")
+		certClient = cacert.CACertClient{HTTPClient: caClient}
+	}
 
-		if err := v.ReadInConfig(); err != nil {
-			if !errors.Is(err, fs.ErrNotExist) {
-				return apperror.ErrFileSystem(fmt.Errorf("failed to read default config: %w", err))
-			}
+	// a JWK provisioner key signs the step-ca token, no IdP involved
+	if cfg.StepCA.SignsOTT() {
+		return nil, certClient, cfg, nil
+	}
+
+	if cfg.OAuth, err = (oidc.Discovery{HTTPClient: idpClient}).Resolve(cmd.Context(), cfg.OAuth, withTokenURL); err != nil {
+		return nil, nil, cfg, err
+	}
+
+	return oauth.CAAuthClient{HTTPClient: idpClient}, certClient, cfg, nil
+}
+
+// NewHTTPClients builds the clients for the IdP and for the CA server, each
+// with the TLS settings of its endpoint.
+func NewHTTPClients(cmd *cobra.Command, cfg config.Config) (idp, ca *http.Client, err error) {
+	// a half configured client certificate is a usage error, not a missing file
+	if err := config.ValidateTLSClientCert(cfg.OAuth); err != nil {
+		return nil, nil, err
+	}
+
+	idpTLS, caTLS := cfg.HTTP.IdPTLS(), cfg.HTTP.CAServerTLS()
+
+	warnInsecure(cmd, "idp", idpTLS)
+	warnInsecure(cmd, "ca-server", caTLS)
+
+	if idp, err = transport.New(transport.OptionsFromConfig(cfg, idpTLS)); err != nil {
+		return nil, nil, err
+	}
+
+	caOpts := transport.OptionsFromConfig(cfg, caTLS)
+	if cfg.StepCA.Enabled() && cfg.StepCA.RootFingerprint != "" {
+		if caOpts.RootCAFile, err = bootstrapStepCA(cmd, cfg, caTLS); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return nil
+	if ca, err = transport.New(caOpts); err != nil {
+		return nil, nil, err
+	}
+
+	return idp, ca, nil
+}
+
+// bootstrapStepCA fetches the step-ca root without verifying the server,
+// trust comes from --step-root-fingerprint.
+func bootstrapStepCA(cmd *cobra.Command, cfg config.Config, caTLS config.TLS) (string, error) {
+	if err := config.ValidateStepCA(cfg.StepCA); err != nil {
+		return "", err
+	}
+
+	caTLS.CABundle, caTLS.InsecureSkipVerify = "", true
+
+	client, err := transport.New(transport.OptionsFromConfig(cfg, caTLS))
+	if err != nil {
+		return "", err
+	}
+
+	return stepca.Bootstrap(cmd.Context(), client, cfg.OAuth.ServerURL, cfg.StepCA.RootFingerprint)
+}
+
+// warnInsecure is written to stderr directly so that it shows up regardless
+// of the log level.
+func warnInsecure(cmd *cobra.Command, prefix string, t config.TLS) {
+	if !t.InsecureSkipVerify {
+		return
+	}
+
+	fmt.Fprintf(cmd.ErrOrStderr(), "WARNING: --%s-insecure-skip-verify is set, the %s certificate is NOT verified. Never use this outside development.\n", prefix, prefix)
+	ctxkeys.LoggerFrom(cmd.Context()).Warn("TLS certificate verification disabled", zap.String("endpoint", prefix))
 }
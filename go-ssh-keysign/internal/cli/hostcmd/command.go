@@ -14,7 +14,6 @@ import (
 	"binarycodes/ssh-keysign/internal/service/cacert"
 	"binarycodes/ssh-keysign/internal/service/hostsvc"
 	"binarycodes/ssh-keysign/internal/service/keys"
-	"binarycodes/ssh-keysign/internal/service/oauth"
 )
 
 type Deps struct {
@@ -25,8 +24,9 @@ func NewCommand(d Deps) *cobra.Command {
 	hostCmd := &cobra.Command{
 		Use:   "host",
 		Short: "Sign host SSH key and generate host ssh certificate",
-		Long:  "Required (may come from flag, config, or env): --ca-server-url, --client-id, --client-secret, --token-url, --key, --principal",
-		Args:  cobra.NoArgs,
+		Long: "Required (may come from flag, config, or env): --ca-server-url, --client-id, --client-secret (or --client-assertion-key), --token-url (or --issuer), --key, --principal\n\n" +
+			"Config files, profiles and the signing backends are described in \"ssh-keysign config --help\".",
+		Args: cobra.NoArgs,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			v := ctxkeys.ViperFrom(cmd.Context())
 
@@ -45,6 +45,11 @@ func NewCommand(d Deps) *cobra.Command {
 				return fmt.Errorf("invalid configuration: %w", errC)
 			}
 
+			oauthClient, certClient, cfg, err := cli.NewClients(cmd, cfg, true)
+			if err != nil {
+				return err
+			}
+
 			if err := cfg.ValidateHost(); err != nil {
 				return err
 			}
@@ -52,11 +57,11 @@ func NewCommand(d Deps) *cobra.Command {
 			runner := &service.Runner{
 				Config:      cfg,
 				KeyHandler:  keys.CAKeyHandler{},
-				OAuthClient: oauth.CAAuthClient{},
-				CertClient:  cacert.CACertClient{},
+				OAuthClient: oauthClient,
+				CertClient:  certClient,
 				CertHandler: cacert.CACertHandler{},
 			}
-			err := d.Service.SignHostKey(cmd.Context(), runner)
+			err = d.Service.SignHostKey(cmd.Context(), runner)
 			return err
 		},
 	}
@@ -1,15 +1,30 @@
 package hostcmd_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 
+	"binarycodes/ssh-keysign/internal/apperror"
 	"binarycodes/ssh-keysign/internal/cli/hostcmd"
 	"binarycodes/ssh-keysign/internal/cli/testutil"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/devserver"
 	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/hostsvc"
+	"binarycodes/ssh-keysign/internal/service/localca"
+	"binarycodes/ssh-keysign/internal/service/stepca"
+	"binarycodes/ssh-keysign/internal/service/vault"
 )
 
 type fakeHostService struct {
@@ -36,6 +51,57 @@ func TestHostCmd_MissingKeyFails(t *testing.T) {
 	assert.Empty(t, logs)
 }
 
+func TestHostCmd_ReadsHostConfig(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	dir := filepath.Join(t.TempDir(), "ssh-keysign")
+	t.Setenv("XDG_CONFIG_DIRS", filepath.Dir(dir))
+	t.Setenv("HOST_SECRET", "s3cret")
+
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yml"), []byte(`
+ca-server-url: "https://ca.example.test"
+token-url: "https://idp.example.test/token"
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "host.yml"), []byte(`
+client-id: "web01"
+client-secret: "env:HOST_SECRET"
+`), 0o600))
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web01",
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, "https://ca.example.test", fake.got.Config.OAuth.ServerURL)
+	assert.Equal(t, "web01", fake.got.Config.OAuth.ClientID)
+	assert.Equal(t, "s3cret", fake.got.Config.OAuth.ClientSecret)
+}
+
+func TestHostCmd_TLSClientCertWithoutKeyFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web01",
+		"--ca-server-url", "https://ca.example.test",
+		"--token-url", "https://idp.example.test/token",
+		"--client-id", "web01",
+		"--client-auth-method", "tls_client_auth",
+		"--tls-client-cert", "/etc/ssh-keysign/client.crt",
+	)
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "--tls-client-cert requires --tls-client-key")
+	assert.False(t, fake.called)
+}
+
 func TestHostCmd_MissingOIDCFails(t *testing.T) {
 	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
 
@@ -134,10 +200,10 @@ host:
   key: "/from/config.pub"
   principal:
     - config_principal
-ca_server_url: "https://ca.from.config"
-client_id: "id_from_config"
-client_secret: "secret_from_config"
-token_url: "https://idp.from.config/token"
+ca-server-url: "https://ca.from.config"
+client-id: "id_from_config"
+client-secret: "secret_from_config"
+token-url: "https://idp.from.config/token"
 `)
 	cfgPath := testutil.WriteTempFile(t, "config.yml", content)
 
@@ -168,3 +234,430 @@ token_url: "https://idp.from.config/token"
 	assert.Equal(t, "https://idp.from.flag/token", fake.got.Config.OAuth.TokenURL)
 	assert.Equal(t, uint64(31536000), fake.got.Config.Host.DurationSeconds)
 }
+
+func TestHostCmd_PrivateKeyJWTNeedsNoSecret(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	assertionKeyPath := testutil.ProjectPath(t, "testdata", "id")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "http://localhost:8888",
+		"--client-id", "clientId",
+		"--client-assertion-key", assertionKeyPath,
+		"--token-url", "http://localhost:3939",
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, fake.called)
+	assert.Equal(t, "", fake.got.Config.OAuth.ClientSecret)
+	assert.Equal(t, config.PrivateKeyJWT, fake.got.Config.OAuth.AuthMethod())
+	assert.Equal(t, assertionKeyPath, fake.got.Config.OAuth.ClientAssertionKey)
+}
+
+func TestHostCmd_UnknownClientAuthMethodFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "http://localhost:8888",
+		"--client-id", "clientId",
+		"--client-auth-method", "client_secret_jwt",
+		"--token-url", "http://localhost:3939",
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported --client-auth-method")
+	assert.Equal(t, false, fake.called)
+}
+
+func TestHostCmd_SecretSources(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	secretFile := filepath.Join(t.TempDir(), "client-secret")
+	if err := os.WriteFile(secretFile, []byte("secret_from_file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	credDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(credDir, "client-secret"), []byte("secret_from_systemd"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOST_CLIENT_SECRET", "secret_from_env_ref")
+
+	tests := []struct {
+		name     string
+		ref      string
+		credDir  string
+		expected string
+	}{
+		{"file", "file:" + secretFile, "", "secret_from_file"},
+		{"env", "env:HOST_CLIENT_SECRET", "", "secret_from_env_ref"},
+		{"exec", "exec:echo secret_from_exec", "", "secret_from_exec"},
+		{"systemd named", "cred:client-secret", credDir, "secret_from_systemd"},
+		{"systemd implicit", "", credDir, "secret_from_systemd"},
+		{"literal", "plain_secret", "", "plain_secret"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("CREDENTIALS_DIRECTORY", tc.credDir)
+
+			fake := &fakeHostService{}
+			cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+			_, _, _, err := testutil.ExecuteCommand(t, cmd,
+				"--key", validKeyFilePath,
+				"--principal", "web",
+				"--ca-server-url", "http://localhost:8888",
+				"--client-id", "clientId",
+				"--client-secret", tc.ref,
+				"--token-url", "http://localhost:3939",
+			)
+
+			assert.NoError(t, err)
+			assert.Equal(t, true, fake.called)
+			assert.Equal(t, tc.expected, fake.got.Config.OAuth.ClientSecret)
+		})
+	}
+}
+
+func TestHostCmd_WorldReadableSecretFileFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	secretFile := testutil.WriteTempFile(t, "client-secret", []byte("leaky"))
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "http://localhost:8888",
+		"--client-id", "clientId",
+		"--client-secret", "file:"+secretFile,
+		"--token-url", "http://localhost:3939",
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "world-readable")
+	assert.Equal(t, false, fake.called)
+}
+
+func TestHostCmd_InsecureSkipVerifyWarns(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, stderr, logs, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "https://localhost:8888",
+		"--client-id", "clientId",
+		"--client-secret", "secret",
+		"--token-url", "https://localhost:3939",
+		"--ca-server-insecure-skip-verify",
+		"--idp-tls-min-version", "1.3",
+	)
+
+	assert.NoError(t, err)
+	assert.Contains(t, stderr, "--ca-server-insecure-skip-verify")
+	assert.NotContains(t, stderr, "--idp-insecure-skip-verify")
+	assert.Len(t, logs, 1)
+	assert.Equal(t, true, fake.called)
+	assert.Equal(t, "1.3", fake.got.Config.HTTP.IdPTLSMinVersion)
+	assert.True(t, fake.got.Config.HTTP.CAServerInsecureSkipVerify)
+}
+
+func TestHostCmd_InvalidPinFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "https://localhost:8888",
+		"--client-id", "clientId",
+		"--client-secret", "secret",
+		"--token-url", "https://localhost:3939",
+		"--ca-server-pin-sha256", "sha256/not-a-pin",
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid pin")
+	assert.Equal(t, false, fake.called)
+}
+
+func TestHostCmd_LocalCANeedsNoServer(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	caKey := filepath.Join(t.TempDir(), "ca")
+	assert.NoError(t, os.WriteFile(caKey, []byte("key"), 0o600))
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-key", caKey,
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, fake.called)
+	assert.Nil(t, fake.got.OAuthClient)
+	assert.IsType(t, &localca.LocalCAClient{}, fake.got.CertClient)
+	assert.Equal(t, caKey, fake.got.Config.LocalCA.Key)
+}
+
+func TestHostCmd_WorldReadableCAKeyFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	caKey := filepath.Join(t.TempDir(), "ca")
+	assert.NoError(t, os.WriteFile(caKey, []byte("key"), 0o600))
+	assert.NoError(t, os.Chmod(caKey, 0o644))
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-key", caKey,
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "world-readable CA key")
+	assert.Equal(t, false, fake.called)
+}
+
+func TestHostCmd_VaultNeedsNoOAuth(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--vault-addr", "https://vault.example.test:8200",
+		"--vault-role", "hosts",
+		"--vault-role-id", "rid",
+		"--vault-secret-id", "sid",
+		"--vault-critical-options", "force-command=true,source-address=10.0.0.0/8",
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, fake.called)
+	assert.Nil(t, fake.got.OAuthClient)
+	assert.IsType(t, &vault.VaultClient{}, fake.got.CertClient)
+	assert.Equal(t, config.VaultAuthAppRole, fake.got.Config.Vault.Auth())
+	assert.Equal(t, map[string]string{"force-command": "true", "source-address": "10.0.0.0/8"}, fake.got.Config.Vault.CriticalOptions)
+}
+
+func TestHostCmd_VaultAndCAKeyConflict(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	caKey := filepath.Join(t.TempDir(), "ca")
+	assert.NoError(t, os.WriteFile(caKey, []byte("key"), 0o600))
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-key", caKey,
+		"--vault-addr", "https://vault.example.test:8200",
+		"--vault-role", "hosts",
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mutually exclusive")
+	assert.Equal(t, false, fake.called)
+}
+
+func TestHostCmd_StepCAProvisionerKeyNeedsNoOAuth(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "https://ca.example.test",
+		"--ca-server-type", "step-ca",
+		"--step-provisioner", "hosts",
+		"--step-provisioner-key", "/etc/ssh-keysign/provisioner.key",
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, fake.called)
+	assert.Nil(t, fake.got.OAuthClient)
+	assert.IsType(t, stepca.StepCAClient{}, fake.got.CertClient)
+}
+
+func TestHostCmd_UnknownCAServerTypeFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeHostService{}
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "https://ca.example.test",
+		"--ca-server-type", "openssh",
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "--ca-server-type")
+	assert.Equal(t, false, fake.called)
+}
+
+// newDevServer runs the dev-server in process for end-to-end runs of the real
+// host service.
+func newDevServer(t *testing.T) (*devserver.Server, *httptest.Server) {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	s, err := devserver.New(devserver.Options{ClientID: "web01", ClientSecret: "s3cret"})
+	require.NoError(t, err)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func TestHostCmd_DevServerEndToEnd(t *testing.T) {
+	s, srv := newDevServer(t)
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "ssh_host_ed25519_key.pub", pub)
+
+	// a transient IdP failure is retried with a fresh token request
+	s.Fail("/token", http.StatusServiceUnavailable, 1, "")
+
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: hostsvc.HostService{}})
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", keyPath,
+		"--principal", "web01",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "web01",
+		"--client-secret", "s3cret",
+	)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(filepath.Dir(keyPath), "ssh_host_ed25519_key-cert.pub")
+	assert.Contains(t, stdout, certPath)
+
+	b, err := os.ReadFile(certPath)
+	require.NoError(t, err)
+	certKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	require.NoError(t, err)
+	cert := certKey.(*ssh.Certificate)
+
+	checker := ssh.CertChecker{IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+		return bytes.Equal(auth.Marshal(), s.CAPublicKey().Marshal())
+	}}
+	assert.NoError(t, checker.CheckHostKey("web01:22", &net.TCPAddr{}, cert))
+	assert.Equal(t, []string{"web01"}, cert.ValidPrincipals)
+}
+
+func TestHostCmd_DevServerSignIsRetried(t *testing.T) {
+	s, srv := newDevServer(t)
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "ssh_host_ed25519_key.pub", pub)
+
+	// e.g. a 502 from the reverse proxy in front of the CA server
+	s.Fail("/rest/key/hostSign", http.StatusBadGateway, 1, "")
+
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: hostsvc.HostService{}})
+	stdout, _, logs, err := testutil.ExecuteCommand(t, cmd,
+		"--key", keyPath,
+		"--principal", "web01",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "web01",
+		"--client-secret", "s3cret",
+	)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, filepath.Join(filepath.Dir(keyPath), "ssh_host_ed25519_key-cert.pub"))
+
+	var retried bool
+	for _, l := range logs {
+		retried = retried || l.Message == "retrying request"
+	}
+	assert.True(t, retried)
+}
+
+func TestHostCmd_UnreachableIdPIsNetworkError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "ssh_host_ed25519_key.pub", pub)
+
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: hostsvc.HostService{}})
+	_, _, _, err = testutil.ExecuteCommand(t, cmd,
+		"--key", keyPath,
+		"--principal", "web01",
+		"--token-url", srv.URL+"/token",
+		"--ca-server-url", srv.URL,
+		"--client-id", "web01",
+		"--client-secret", "s3cret",
+		"--retries", "0",
+	)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "client credential login")
+	assert.Equal(t, apperror.KNetwork, apperror.KindOf(err))
+}
+
+func TestHostCmd_DevServerPrincipalNotAllowed(t *testing.T) {
+	_, srv := newDevServer(t)
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "ssh_host_ed25519_key.pub", pub)
+
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: hostsvc.HostService{}})
+	_, _, _, err = testutil.ExecuteCommand(t, cmd,
+		"--key", keyPath,
+		"--principal", "db01",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "web01",
+		"--client-secret", "s3cret",
+	)
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KPrincipalNotAllowed, apperror.KindOf(err))
+}
+
+func TestHostCmd_DevServerProfileKeepsItsOwnCert(t *testing.T) {
+	_, srv := newDevServer(t)
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "ssh_host_ed25519_key.pub", pub)
+
+	content := fmt.Sprintf(`
+client-id: web01
+client-secret: s3cret
+host:
+  key: %s
+  principal: [web01]
+profiles:
+  staging:
+    issuer: %s
+    ca-server-url: %s
+`, keyPath, srv.URL, srv.URL)
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(content))
+
+	cmd := hostcmd.NewCommand(hostcmd.Deps{Service: hostsvc.HostService{}})
+	_, _, _, err = testutil.ExecuteCommand(t, cmd, "--config", cfgPath, "--profile", "staging")
+	require.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(filepath.Dir(keyPath), "ssh_host_ed25519_key-staging-cert.pub"))
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(keyPath), "ssh_host_ed25519_key-cert.pub"))
+}
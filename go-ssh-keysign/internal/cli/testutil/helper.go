@@ -22,6 +22,13 @@ import (
 
 func ExecuteCommand(t *testing.T, cmd *cobra.Command, args ...string) (stoutStr, stderrStr string, logs []observer.LoggedEntry, err error) {
 	t.Helper()
+	return ExecuteCommandVerbose(t, int(logging.Normal), cmd, args...)
+}
+
+// ExecuteCommandVerbose is ExecuteCommand with the output verbosity of -v
+// given that many times.
+func ExecuteCommandVerbose(t *testing.T, verbosity int, cmd *cobra.Command, args ...string) (stoutStr, stderrStr string, logs []observer.LoggedEntry, err error) {
+	t.Helper()
 
 	var stdout, stderr bytes.Buffer
 
@@ -31,10 +38,10 @@ func ExecuteCommand(t *testing.T, cmd *cobra.Command, args ...string) (stoutStr,
 	ctx = ctxkeys.WithViper(ctx, v)
 
 	obsCore, observed := observer.New(zap.InfoLevel)
-	logger := zap.New(obsCore)
+	logger := zap.New(logging.NewRedactingCore(obsCore))
 	ctx = ctxkeys.WithLogger(ctx, logger)
 
-	pr := logging.NewPrinter(&stdout, int(logging.Normal))
+	pr := logging.NewPrinter(&stdout, verbosity)
 	ctx = ctxkeys.WithPrinter(ctx, pr)
 
 	cmd.SetContext(ctx)
@@ -96,6 +103,13 @@ func ExecuteCommand(t *testing.T, cmd *cobra.Command, args ...string) (stoutStr,
 		t.Fatalf("setenv: %v", err)
 	}
 
+	// keep the machine's system config files out, unless the test sets its own
+	if os.Getenv("XDG_CONFIG_DIRS") == "" {
+		if err := os.Setenv("XDG_CONFIG_DIRS", filepath.Join(tempPath, "xdg")); err != nil {
+			t.Fatalf("setenv: %v", err)
+		}
+	}
+
 	err = cmd.Execute()
 	logs = observed.All()
 	return stdout.String(), stderr.String(), logs, err
@@ -1,10 +1,12 @@
 package usercmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 
 	"binarycodes/ssh-keysign/internal/cli"
 	"binarycodes/ssh-keysign/internal/config"
@@ -13,7 +15,6 @@ import (
 	"binarycodes/ssh-keysign/internal/service"
 	"binarycodes/ssh-keysign/internal/service/cacert"
 	"binarycodes/ssh-keysign/internal/service/keys"
-	"binarycodes/ssh-keysign/internal/service/oauth"
 	"binarycodes/ssh-keysign/internal/service/usersvc"
 )
 
@@ -25,8 +26,9 @@ func NewCommand(d Deps) *cobra.Command {
 	userCmd := &cobra.Command{
 		Use:   "user",
 		Short: "Sign user SSH key and generate user ssh certificate",
-		Long:  "Required (may come from flag, config, or env): --key, --principal",
-		Args:  cobra.NoArgs,
+		Long: "Required (may come from flag, config, or env): --key, --principal\n\n" +
+			"Config files, profiles and the signing backends are described in \"ssh-keysign config --help\".",
+		Args: cobra.NoArgs,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			v := ctxkeys.ViperFrom(cmd.Context())
 
@@ -45,18 +47,28 @@ func NewCommand(d Deps) *cobra.Command {
 				return fmt.Errorf("invalid configuration: %w", errC)
 			}
 
+			oauthClient, certClient, cfg, err := cli.NewClients(cmd, cfg, cfg.OAuth.HasTokenExchange())
+			if err != nil {
+				return err
+			}
+
 			if err := cfg.ValidateUser(); err != nil {
 				return err
 			}
 
+			// the local CA and Vault never send the client secret
+			if oauthClient != nil {
+				warnPlainTextSecret(cmd.Context())
+			}
+
 			runner := &service.Runner{
 				Config:      cfg,
 				KeyHandler:  keys.CAKeyHandler{},
-				OAuthClient: oauth.CAAuthClient{},
-				CertClient:  cacert.CACertClient{},
+				OAuthClient: oauthClient,
+				CertClient:  certClient,
 				CertHandler: cacert.CACertHandler{},
 			}
-			err := d.Service.SignUserKey(cmd.Context(), runner)
+			err = d.Service.SignUserKey(cmd.Context(), runner)
 			return err
 		},
 	}
@@ -66,8 +78,29 @@ func NewCommand(d Deps) *cobra.Command {
 	userCmd.Flags().Uint64P("duration", "d", constants.DefaultDurationForUserKey(), "duration in seconds")
 	userCmd.Flags().String("device-flow-url", "", "OIDC device flow URL")
 	userCmd.Flags().String("token-poll-url", "", "OIDC token poll URL")
+	userCmd.Flags().Bool("pkce", true, "send a PKCE code challenge with device flow (RFC 7636)")
+	userCmd.Flags().Duration("device-flow-timeout", constants.DefaultDeviceFlowTimeout, "how long to wait for the device login to be approved")
+	userCmd.Flags().String("subject-token-file", "", "file holding an OIDC token to exchange for an access token (RFC 8693), e.g. a CI ID token")
+	userCmd.Flags().String("subject-token-env", "", "environment variable holding an OIDC token to exchange for an access token (RFC 8693)")
 
 	cli.WireCommonFlags(userCmd)
 
 	return userCmd
 }
+
+// warnPlainTextSecret flags a client secret written literally into one of
+// the config files rather than as a reference. The file's mode is not looked
+// at: whoever runs the CLI can read the secret either way, so a CLI handed to
+// every laptop should use a public client instead.
+func warnPlainTextSecret(ctx context.Context) {
+	// the viper also holds flags and env, look at what the files contain
+	value, layer, ok := ctxkeys.ConfigLayersFrom(ctx).Value("client-secret")
+	if secret, _ := value.(string); !ok || secret == "" || config.IsSecretReference(secret) {
+		return
+	}
+
+	ctxkeys.LoggerFrom(ctx).Warn("client-secret is written in plain text in a config file",
+		zap.String("path", layer.Path),
+		zap.String("hint", "configure the client as public and remove client-secret; device flow does not need it"),
+	)
+}
@@ -2,14 +2,26 @@ package usercmd_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 
+	"binarycodes/ssh-keysign/internal/apperror"
 	"binarycodes/ssh-keysign/internal/cli/testutil"
 	"binarycodes/ssh-keysign/internal/cli/usercmd"
+	"binarycodes/ssh-keysign/internal/devserver"
 	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/usersvc"
 )
 
 type fakeUserService struct {
@@ -49,6 +61,7 @@ func TestUsercmd_TokenURLIsOptional(t *testing.T) {
 		"--client-secret", "secret",
 		"--device-flow-url", "http://localhost:3939/device",
 		"--token-poll-url", "http://localhost:3939/token-poll",
+		"--device-flow-timeout", "10m",
 	)
 
 	assert.NoError(t, err)
@@ -65,6 +78,7 @@ func TestUsercmd_TokenURLIsOptional(t *testing.T) {
 	assert.Equal(t, "", fake.got.Config.OAuth.TokenURL)
 	assert.Equal(t, "http://localhost:3939/device", fake.got.Config.OAuth.DeviceFlowURL)
 	assert.Equal(t, "http://localhost:3939/token-poll", fake.got.Config.OAuth.TokenPollURL)
+	assert.Equal(t, 10*time.Minute, fake.got.Config.OAuth.DeviceFlowTimeout)
 	assert.Equal(t, uint64(1800), fake.got.Config.User.DurationSeconds)
 }
 
@@ -135,7 +149,11 @@ token-url: "https://idp.example.test/token"
 	assert.NoError(t, err)
 	assert.Empty(t, stdout)
 	assert.Empty(t, stderr)
-	assert.Empty(t, logs)
+
+	// a literal secret in the user's config file is not secret from the user
+	assert.Len(t, logs, 1)
+	assert.Equal(t, "client-secret is written in plain text in a config file", logs[0].Message)
+	testutil.LogContains(t, logs[0], "path", cfgPath)
 
 	assert.Equal(t, true, fake.called)
 	assert.Equal(t, validKeyFilePath, fake.got.Config.User.Key)
@@ -147,6 +165,30 @@ token-url: "https://idp.example.test/token"
 	assert.Equal(t, uint64(1800), fake.got.Config.User.DurationSeconds)
 }
 
+func TestUsercmd_LocalCAIgnoresPlainTextSecret(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	content := fmt.Sprintf(`
+user:
+  key: %s
+  principal:
+    - web
+ca-key: %s
+client-secret: "secret"
+`, validKeyFilePath, testutil.ProjectPath(t, "testdata", "id"))
+
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(content))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, logs, err := testutil.ExecuteCommand(t, cmd, "--config", cfgPath)
+
+	// the local CA does no login, the secret is never sent anywhere
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+	assert.Nil(t, fake.got.OAuthClient)
+}
+
 func TestUsercmd_Precedence_ConfigEnvFlag(t *testing.T) {
 	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
 
@@ -155,10 +197,10 @@ user:
   key: "/from/config.pub"
   principal:
     - config_principal
-ca_server_url: "https://ca.from.config"
-client_id: "id_from_config"
-client_secret: "secret_from_config"
-token_url: "https://idp.from.config/token"
+ca-server-url: "https://ca.from.config"
+client-id: "id_from_config"
+client-secret: "env:SECRET_FROM_CONFIG"
+token-url: "https://idp.from.config/token"
 `)
 
 	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(content))
@@ -190,3 +232,401 @@ token_url: "https://idp.from.config/token"
 	assert.Equal(t, "https://idp.from.flag/token", fake.got.Config.OAuth.TokenURL)
 	assert.Equal(t, uint64(1800), fake.got.Config.User.DurationSeconds)
 }
+
+func TestUsercmd_IssuerDiscovery(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/realms/test/.well-known/openid-configuration", r.URL.Path)
+		issuer := srv.URL + "/realms/test"
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        issuer,
+			"token_endpoint":                issuer + "/protocol/openid-connect/token",
+			"device_authorization_endpoint": issuer + "/protocol/openid-connect/auth/device",
+			"jwks_uri":                      issuer + "/protocol/openid-connect/certs",
+		})
+	}))
+	defer srv.Close()
+
+	issuer := srv.URL + "/realms/test"
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "http://localhost:8888",
+		"--client-id", "clientId",
+		"--client-secret", "secret",
+		"--issuer", issuer,
+		"--token-poll-url", "http://localhost:3939/explicit-poll",
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, fake.called)
+	assert.Equal(t, issuer, fake.got.Config.OAuth.Issuer)
+	assert.Equal(t, "", fake.got.Config.OAuth.TokenURL)
+	assert.Equal(t, issuer+"/protocol/openid-connect/auth/device", fake.got.Config.OAuth.DeviceFlowURL)
+	assert.Equal(t, "http://localhost:3939/explicit-poll", fake.got.Config.OAuth.TokenPollURL)
+	assert.Equal(t, issuer+"/protocol/openid-connect/certs", fake.got.Config.OAuth.JWKSURL)
+}
+
+func TestUsercmd_TokenExchangeNeedsNoSecret(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+		"--ca-server-url", "http://localhost:8888",
+		"--client-id", "ci-client",
+		"--token-url", "http://localhost:3939/token",
+		"--subject-token-env", "CI_JOB_JWT",
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, fake.called)
+	assert.Equal(t, true, fake.got.Config.OAuth.HasTokenExchange())
+	assert.Equal(t, "CI_JOB_JWT", fake.got.Config.OAuth.SubjectTokenEnv)
+}
+
+func TestUsercmd_PublicClientDeviceFlow(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	content := []byte(`
+ca-server-url: "https://ca.example.test"
+client-id: "public-cli"
+device-flow-url: "https://idp.example.test/device"
+token-poll-url: "https://idp.example.test/token"
+`)
+	cfgPath := testutil.WriteTempFile(t, "config.yml", content)
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	stdout, stderr, logs, err := testutil.ExecuteCommand(t, cmd,
+		"--config", cfgPath,
+		"--key", validKeyFilePath,
+		"--principal", "web",
+	)
+
+	assert.NoError(t, err)
+	assert.Empty(t, stdout)
+	assert.Empty(t, stderr)
+	assert.Empty(t, logs)
+
+	assert.Equal(t, true, fake.called)
+	assert.Equal(t, "", fake.got.Config.OAuth.ClientSecret)
+	assert.Equal(t, true, fake.got.Config.OAuth.PKCE)
+}
+
+func TestUsercmd_DevServerDeviceFlowEndToEnd(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	s, err := devserver.New(devserver.Options{ClientID: "public-cli", AutoApprove: "alice"})
+	require.NoError(t, err)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "id_ed25519.pub", pub)
+
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: usersvc.UserService{}})
+	stdout, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", keyPath,
+		"--principal", "alice",
+		"--issuer", srv.URL,
+		"--ca-server-url", srv.URL,
+		"--client-id", "public-cli",
+	)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "/device/verify")
+
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(keyPath), "id_ed25519-cert.pub"))
+	require.NoError(t, err)
+	certKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	require.NoError(t, err)
+	cert := certKey.(*ssh.Certificate)
+
+	assert.Equal(t, []string{"alice"}, cert.ValidPrincipals)
+	assert.Equal(t, s.CAPublicKey().Marshal(), cert.SignatureKey.Marshal())
+}
+
+const profilesConfig = `
+ca-server-url: "https://ca.example.test"
+client-id: "public-cli"
+device-flow-url: "https://idp.example.test/realms/prod/device"
+token-poll-url: "https://idp.example.test/realms/prod/token"
+user:
+  duration: 1800
+  principal:
+    - alice
+profiles:
+  default: {}
+  staging:
+    ca-server-url: "https://ca.staging.example.test"
+    device-flow-url: "https://idp.example.test/realms/staging/device"
+    token-poll-url: "https://idp.example.test/realms/staging/token"
+    user:
+      principal:
+        - alice-admin
+`
+
+func TestUsercmd_ProfileInheritsSharedSettings(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(profilesConfig))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--config", cfgPath,
+		"--key", validKeyFilePath,
+		"--profile", "staging",
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, "staging", fake.got.Config.Profile)
+	assert.Equal(t, "https://ca.staging.example.test", fake.got.Config.OAuth.ServerURL)
+	assert.Equal(t, "https://idp.example.test/realms/staging/token", fake.got.Config.OAuth.TokenPollURL)
+	assert.Equal(t, []string{"alice-admin"}, fake.got.Config.User.Principals)
+	// not overridden by the profile
+	assert.Equal(t, "public-cli", fake.got.Config.OAuth.ClientID)
+	assert.Equal(t, uint64(1800), fake.got.Config.User.DurationSeconds)
+}
+
+func TestUsercmd_ProfileFromEnvAndDefault(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(profilesConfig))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd, "--config", cfgPath, "--key", validKeyFilePath)
+
+	require.NoError(t, err)
+	assert.Equal(t, "default", fake.got.Config.Profile)
+	assert.Equal(t, "https://ca.example.test", fake.got.Config.OAuth.ServerURL)
+
+	t.Setenv("SSH_KEYSIGN_PROFILE", "staging")
+
+	fake = &fakeUserService{}
+	cmd = usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err = testutil.ExecuteCommand(t, cmd, "--config", cfgPath, "--key", validKeyFilePath)
+
+	require.NoError(t, err)
+	assert.Equal(t, "staging", fake.got.Config.Profile)
+	assert.Equal(t, "https://ca.staging.example.test", fake.got.Config.OAuth.ServerURL)
+}
+
+func TestUsercmd_UnknownProfileFails(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(profilesConfig))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--config", cfgPath,
+		"--key", validKeyFilePath,
+		"--profile", "prod",
+	)
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "default, staging")
+	assert.Equal(t, false, fake.called)
+}
+
+func TestUsercmd_ConfigTypoFails(t *testing.T) {
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(`
+ca-server-url: "https://ca.example.test"
+user:
+  principals: [alice]
+`))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd, "--config", cfgPath)
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), cfgPath+`:4: unknown key "user.principals", did you mean "user.principal"?`)
+	assert.Equal(t, false, fake.called)
+}
+
+func TestUsercmd_SystemConfigDropInsAndLocks(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	// the first $XDG_CONFIG_DIRS entry is read last
+	site, vendor := t.TempDir(), t.TempDir()
+	t.Setenv("XDG_CONFIG_DIRS", site+string(os.PathListSeparator)+vendor)
+	t.Setenv("VENDOR_SECRET", "secret")
+
+	writeFile(t, filepath.Join(vendor, "ssh-keysign", "config.yml"), `
+ca-server-url: "https://ca.vendor.example.test"
+client-id: "vendor-cli"
+client-secret: "env:VENDOR_SECRET"
+token-url: "https://idp.example.test/token"
+`)
+	writeFile(t, filepath.Join(site, "ssh-keysign", "config.yml"), `
+ca-server-url: "https://ca.example.test"
+locked: [ca-server-url]
+`)
+	writeFile(t, filepath.Join(site, "ssh-keysign", "conf.d", "20-site.yml"), `client-id: "site-cli"`)
+	writeFile(t, filepath.Join(site, "ssh-keysign", "conf.d", "10-tool.yml"), `client-id: "tool-cli"`)
+
+	userCfg := testutil.WriteTempFile(t, "config.yml", []byte(`
+user:
+  principal: [alice]
+`))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, logs, err := testutil.ExecuteCommand(t, cmd,
+		"--config", userCfg,
+		"--key", validKeyFilePath,
+		"--ca-server-url", "https://ca.other.example.test",
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, "https://ca.example.test", fake.got.Config.OAuth.ServerURL)
+	assert.Equal(t, "site-cli", fake.got.Config.OAuth.ClientID)
+	assert.Equal(t, []string{"alice"}, fake.got.Config.User.Principals)
+
+	require.Len(t, logs, 1)
+	assert.Equal(t, "setting is locked by a system config file, ignoring the override", logs[0].Message)
+	testutil.LogContains(t, logs[0], "override", "flag --ca-server-url")
+}
+
+func TestUsercmd_LockKeepsValueOfLockingFile(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	// the administrator's directory is read first, one the user put in front
+	// of $XDG_CONFIG_DIRS last
+	admin, mine := t.TempDir(), t.TempDir()
+	t.Setenv("XDG_CONFIG_DIRS", mine+string(os.PathListSeparator)+admin)
+
+	writeFile(t, filepath.Join(admin, "ssh-keysign", "config.yml"), `
+ca-server-url: "https://ca.example.test"
+device-flow-url: "https://idp.example.test/device"
+token-poll-url: "https://idp.example.test/token"
+locked: [ca-server-url]
+`)
+	writeFile(t, filepath.Join(mine, "ssh-keysign", "config.yml"), `ca-server-url: "https://ca.attacker.example.test"`)
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "alice",
+		"--client-id", "alice-cli",
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, "https://ca.example.test", fake.got.Config.OAuth.ServerURL)
+}
+
+func TestUsercmd_IgnoresHostConfig(t *testing.T) {
+	validKeyFilePath := testutil.ProjectPath(t, "testdata", "id.pub")
+
+	system := t.TempDir()
+	t.Setenv("XDG_CONFIG_DIRS", system)
+
+	writeFile(t, filepath.Join(system, "ssh-keysign", "config.yml"), `
+ca-server-url: "https://ca.example.test"
+device-flow-url: "https://idp.example.test/device"
+token-poll-url: "https://idp.example.test/token"
+`)
+	// readable by root only on a real host
+	writeFile(t, filepath.Join(system, "ssh-keysign", "host.yml"), `
+client-id: "web01"
+client-secret: "file:`+filepath.Join(system, "missing-client-secret")+`"
+`)
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd,
+		"--key", validKeyFilePath,
+		"--principal", "alice",
+		"--client-id", "alice-cli",
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, "https://ca.example.test", fake.got.Config.OAuth.ServerURL)
+	assert.Equal(t, "alice-cli", fake.got.Config.OAuth.ClientID)
+	assert.Empty(t, fake.got.Config.OAuth.ClientSecret)
+}
+
+func TestUsercmd_LockedInUserConfigFails(t *testing.T) {
+	cfgPath := testutil.WriteTempFile(t, "config.yml", []byte(`locked: [ca-server-url]`))
+
+	fake := &fakeUserService{}
+	cmd := usercmd.NewCommand(usercmd.Deps{Service: fake})
+	_, _, _, err := testutil.ExecuteCommand(t, cmd, "--config", cfgPath)
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "locked can only be set in a system config file")
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestUsercmd_NoSecretsInOutputAtAnyVerbosity(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	s, err := devserver.New(devserver.Options{ClientID: "public-cli", AutoApprove: "alice"})
+	require.NoError(t, err)
+
+	// every token and device code the IdP hands out
+	var secrets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, r)
+
+		var body map[string]any
+		if json.Unmarshal(rec.Body.Bytes(), &body) == nil {
+			for _, k := range []string{"access_token", "refresh_token", "id_token", "device_code"} {
+				if v, ok := body[k].(string); ok && v != "" {
+					secrets = append(secrets, v)
+				}
+			}
+		}
+
+		maps.Copy(w.Header(), rec.Header())
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+
+	pub, err := os.ReadFile(testutil.ProjectPath(t, "testdata", "id.pub"))
+	require.NoError(t, err)
+	keyPath := testutil.WriteTempFile(t, "id_ed25519.pub", pub)
+
+	for verbosity := range 4 {
+		cmd := usercmd.NewCommand(usercmd.Deps{Service: usersvc.UserService{}})
+		stdout, stderr, logs, err := testutil.ExecuteCommandVerbose(t, verbosity, cmd,
+			"--key", keyPath,
+			"--principal", "alice",
+			"--issuer", srv.URL,
+			"--ca-server-url", srv.URL,
+			"--client-id", "public-cli",
+		)
+		require.NoError(t, err)
+
+		output := stdout + stderr
+		for _, l := range logs {
+			output += l.Message + fmt.Sprint(l.ContextMap())
+		}
+
+		require.NotEmpty(t, secrets)
+		for _, secret := range secrets {
+			// not even a prefix
+			assert.NotContains(t, output, secret[:8], "-v x %d", verbosity)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"strings"
+)
+
+// LockedKey is the config file key listing the settings a system file locks.
+const LockedKey = "locked"
+
+// Layer is one config file of a run.
+type Layer struct {
+	Path string
+	// System files are managed by the administrator and may lock settings.
+	System   bool
+	Settings map[string]any
+}
+
+// Layers are the config files of a run, lowest precedence first.
+type Layers []Layer
+
+// Lock is a setting that flags, environment variables and later files
+// cannot override.
+type Lock struct {
+	Key   string
+	Path  string
+	Value any
+}
+
+// Value returns the value of key in the last file that sets it.
+func (l Layers) Value(key string) (any, *Layer, bool) {
+	return l.value(key, false)
+}
+
+// Source returns the path of the last file that sets key, empty if none does.
+func (l Layers) Source(key string) string {
+	if _, layer, ok := l.Value(key); ok {
+		return layer.Path
+	}
+	return ""
+}
+
+func (l Layers) value(key string, systemOnly bool) (any, *Layer, bool) {
+	for i := len(l) - 1; i >= 0; i-- {
+		if systemOnly && !l[i].System {
+			continue
+		}
+		if v, ok := lookup(l[i].Settings, key); ok {
+			return v, &l[i], true
+		}
+	}
+	return nil, nil, false
+}
+
+// Locks lists the settings locked by system files. A locked setting keeps
+// the value of the file that locks it or of the system files before it, or
+// its default when none sets it; a later directory of $XDG_CONFIG_DIRS cannot
+// change it.
+func (l Layers) Locks() []Lock {
+	defaults := map[string]any{}
+	for _, s := range Settings(Config{}) {
+		defaults[s.Key] = s.Value
+	}
+
+	var locks []Lock
+	seen := map[string]bool{}
+	for i, layer := range l {
+		if !layer.System {
+			continue
+		}
+
+		keys, _ := layer.Settings[LockedKey].([]any)
+		for _, k := range keys {
+			key, ok := k.(string)
+			if !ok || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			value, _, ok := l[:i+1].value(key, true)
+			if !ok {
+				value = defaults[key]
+			}
+			locks = append(locks, Lock{Key: key, Path: layer.Path, Value: value})
+		}
+	}
+	return locks
+}
+
+// Lock returns the lock of key, if it is locked.
+func (l Layers) Lock(key string) (Lock, bool) {
+	for _, lock := range l.Locks() {
+		if lock.Key == key {
+			return lock, true
+		}
+	}
+	return Lock{}, false
+}
+
+// lookup finds a dotted key such as "user.principal" in nested settings.
+func lookup(settings map[string]any, key string) (any, bool) {
+	parts := strings.Split(key, ".")
+	m := settings
+	for _, p := range parts[:len(parts)-1] {
+		child, ok := m[p].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		m = child
+	}
+
+	v, ok := m[parts[len(parts)-1]]
+	return v, ok
+}
@@ -8,10 +8,26 @@ import (
 func decoderHook() mapstructure.DecodeHookFunc {
 	return mapstructure.ComposeDecodeHookFunc(
 		mapstructure.TextUnmarshallerHookFunc(),
+		mapstructure.StringToTimeDurationHookFunc(),
 	)
 }
 
 func Load(v *viper.Viper) (Config, error) {
+	c, err := Decode(v)
+	if err != nil {
+		return c, err
+	}
+
+	if err := resolveSecrets(&c); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// Decode is Load without resolving secret references, so nothing is read
+// from files, stdin or commands.
+func Decode(v *viper.Viper) (Config, error) {
 	var c Config
 	dec := &mapstructure.DecoderConfig{
 		DecodeHook:       decoderHook(),
@@ -1,27 +1,87 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"binarycodes/ssh-keysign/internal/apperror"
 	"binarycodes/ssh-keysign/internal/service/paths"
 )
 
+// Token endpoint client authentication methods (RFC 7591, section 2).
+const (
+	ClientSecretPost = "client_secret_post"
+	PrivateKeyJWT    = "private_key_jwt"
+	TLSClientAuth    = "tls_client_auth"
+)
+
 type OAuth struct {
-	ServerURL     string `mapstructure:"ca-server-url"`
-	ClientID      string `mapstructure:"client-id"`
-	ClientSecret  string `mapstructure:"client-secret"`
-	TokenURL      string `mapstructure:"token-url"`
-	DeviceFlowURL string `mapstructure:"device-flow-url"`
-	TokenPollURL  string `mapstructure:"token-poll-url"`
+	ServerURL          string        `mapstructure:"ca-server-url"`
+	ClientID           string        `mapstructure:"client-id"`
+	ClientSecret       string        `mapstructure:"client-secret" secret:"true"`
+	ClientAuthMethod   string        `mapstructure:"client-auth-method" enum:"client_secret_post,private_key_jwt,tls_client_auth"`
+	ClientAssertionKey string        `mapstructure:"client-assertion-key"`
+	ClientAssertionKID string        `mapstructure:"client-assertion-kid"`
+	TLSClientCert      string        `mapstructure:"tls-client-cert"`
+	TLSClientKey       string        `mapstructure:"tls-client-key"`
+	Issuer             string        `mapstructure:"issuer"`
+	Scopes             []string      `mapstructure:"scopes"`
+	Audience           string        `mapstructure:"audience"`
+	Resources          []string      `mapstructure:"resource"`
+	TokenURL           string        `mapstructure:"token-url"`
+	DeviceFlowURL      string        `mapstructure:"device-flow-url"`
+	TokenPollURL       string        `mapstructure:"token-poll-url"`
+	DeviceFlowTimeout  time.Duration `mapstructure:"device-flow-timeout"`
+	PKCE               bool          `mapstructure:"pkce"`
+	JWKSURL            string        `mapstructure:"jwks-url"`
+	SubjectTokenFile   string        `mapstructure:"subject-token-file"`
+	SubjectTokenEnv    string        `mapstructure:"subject-token-env"`
+	SubjectTokenType   string        `mapstructure:"subject-token-type"`
+}
+
+// AuthMethod returns the configured client authentication method, or infers
+// it from the credentials present when none is set explicitly.
+func (o OAuth) AuthMethod() string {
+	if o.ClientAuthMethod != "" {
+		return o.ClientAuthMethod
+	}
+
+	if o.ClientAssertionKey != "" {
+		return PrivateKeyJWT
+	}
+
+	if o.ClientSecret == "" && o.TLSClientCert != "" {
+		return TLSClientAuth
+	}
+
+	return ClientSecretPost
+}
+
+func (o OAuth) hasClientAuth() bool {
+	switch o.AuthMethod() {
+	case PrivateKeyJWT:
+		return o.ClientAssertionKey != ""
+	case TLSClientAuth:
+		return o.TLSClientCert != "" && o.TLSClientKey != ""
+	default:
+		return o.ClientSecret != ""
+	}
 }
 
 func (o OAuth) HasClientCredential() bool {
-	return o.ServerURL != "" && o.TokenURL != "" && o.ClientID != "" && o.ClientSecret != ""
+	return o.ServerURL != "" && o.TokenURL != "" && o.ClientID != "" && o.hasClientAuth()
+}
+
+// HasTokenExchange reports whether an externally issued subject token is
+// configured, e.g. a CI ID token or a projected service-account token.
+func (o OAuth) HasTokenExchange() bool {
+	return o.SubjectTokenFile != "" || o.SubjectTokenEnv != ""
 }
 
 func (o OAuth) HasDeviceFlow() bool {
@@ -40,10 +100,163 @@ type User struct {
 	DurationSeconds uint64   `mapstructure:"duration"`
 }
 
+// HTTP configures the client used for requests to the IdP and CA server.
+type HTTP struct {
+	Proxy               string        `mapstructure:"proxy"`
+	ConnectTimeout      time.Duration `mapstructure:"connect-timeout"`
+	TLSHandshakeTimeout time.Duration `mapstructure:"tls-handshake-timeout"`
+	Timeout             time.Duration `mapstructure:"http-timeout"`
+	Retries             int           `mapstructure:"retries"`
+	RetryMaxTime        time.Duration `mapstructure:"retry-max-time"`
+
+	IdPCABundle                string   `mapstructure:"idp-ca-bundle"`
+	IdPTLSMinVersion           string   `mapstructure:"idp-tls-min-version" enum:"1.2,1.3"`
+	IdPPinSHA256               []string `mapstructure:"idp-pin-sha256"`
+	IdPInsecureSkipVerify      bool     `mapstructure:"idp-insecure-skip-verify"`
+	CAServerCABundle           string   `mapstructure:"ca-server-ca-bundle"`
+	CAServerTLSMinVersion      string   `mapstructure:"ca-server-tls-min-version" enum:"1.2,1.3"`
+	CAServerPinSHA256          []string `mapstructure:"ca-server-pin-sha256"`
+	CAServerInsecureSkipVerify bool     `mapstructure:"ca-server-insecure-skip-verify"`
+}
+
+// TLS holds the server verification settings of one endpoint.
+type TLS struct {
+	CABundle           string
+	MinVersion         string
+	PinSHA256          []string
+	InsecureSkipVerify bool
+}
+
+// IdPTLS applies to discovery and the token endpoints.
+func (h HTTP) IdPTLS() TLS {
+	return TLS{
+		CABundle:           h.IdPCABundle,
+		MinVersion:         h.IdPTLSMinVersion,
+		PinSHA256:          h.IdPPinSHA256,
+		InsecureSkipVerify: h.IdPInsecureSkipVerify,
+	}
+}
+
+// CAServerTLS applies to requests to ca-server-url.
+func (h HTTP) CAServerTLS() TLS {
+	return TLS{
+		CABundle:           h.CAServerCABundle,
+		MinVersion:         h.CAServerTLSMinVersion,
+		PinSHA256:          h.CAServerPinSHA256,
+		InsecureSkipVerify: h.CAServerInsecureSkipVerify,
+	}
+}
+
+// LocalCA signs certificates in-process with a CA private key instead of
+// asking the CA server, for lab setups, bootstrap and offline recovery.
+type LocalCA struct {
+	Key             string   `mapstructure:"ca-key"`
+	KeyPassphrase   string   `mapstructure:"ca-key-passphrase" secret:"true"`
+	Extensions      []string `mapstructure:"ca-extensions"`
+	SourceAddresses []string `mapstructure:"ca-source-address"`
+	AuditLog        string   `mapstructure:"ca-audit-log"`
+}
+
+func (l LocalCA) Enabled() bool {
+	return l.Key != ""
+}
+
+// Vault auth methods used to obtain a Vault token.
+const (
+	VaultAuthToken   = "token"
+	VaultAuthAppRole = "approle"
+	VaultAuthJWT     = "jwt"
+)
+
+// Vault signs certificates with the SSH secrets engine of HashiCorp Vault
+// (<mount>/sign/<role>) instead of the CA server.
+type Vault struct {
+	Addr            string            `mapstructure:"vault-addr"`
+	Namespace       string            `mapstructure:"vault-namespace"`
+	Mount           string            `mapstructure:"vault-mount"`
+	Role            string            `mapstructure:"vault-role"`
+	AuthMethod      string            `mapstructure:"vault-auth-method" enum:"token,approle,jwt"`
+	AuthMount       string            `mapstructure:"vault-auth-mount"`
+	Token           string            `mapstructure:"vault-token" secret:"true"`
+	RoleID          string            `mapstructure:"vault-role-id"`
+	SecretID        string            `mapstructure:"vault-secret-id" secret:"true"`
+	JWTRole         string            `mapstructure:"vault-jwt-role"`
+	JWT             string            `mapstructure:"vault-jwt" secret:"true"`
+	Extensions      []string          `mapstructure:"vault-extensions"`
+	CriticalOptions map[string]string `mapstructure:"vault-critical-options"`
+}
+
+func (v Vault) Enabled() bool {
+	return v.Addr != ""
+}
+
+// Auth returns the configured auth method, or infers it from the
+// credentials present when none is set explicitly.
+func (v Vault) Auth() string {
+	switch {
+	case v.AuthMethod != "":
+		return v.AuthMethod
+	case v.RoleID != "":
+		return VaultAuthAppRole
+	case v.JWT != "":
+		return VaultAuthJWT
+	default:
+		return VaultAuthToken
+	}
+}
+
+// CA server types accepted by --ca-server-type.
+const (
+	CAServerKeysign = "ssh-keysign"
+	CAServerStepCA  = "step-ca"
+)
+
+// StepCA makes ca-server-url a smallstep step-ca. Its /ssh/sign endpoint is
+// authorized with a one-time token (OTT): the ID token from the IdP for an
+// OIDC provisioner, or a JWT signed with the key of a JWK provisioner.
+type StepCA struct {
+	CAServerType    string `mapstructure:"ca-server-type" enum:"ssh-keysign,step-ca"`
+	RootFingerprint string `mapstructure:"step-root-fingerprint"`
+	Provisioner     string `mapstructure:"step-provisioner"`
+	ProvisionerKey  string `mapstructure:"step-provisioner-key"`
+	ProvisionerKID  string `mapstructure:"step-provisioner-kid"`
+}
+
+func (s StepCA) Enabled() bool {
+	return s.CAServerType == CAServerStepCA
+}
+
+// SignsOTT reports whether the OTT is signed locally with a JWK provisioner
+// key, in which case no IdP login is needed.
+func (s StepCA) SignsOTT() bool {
+	return s.Enabled() && s.ProvisionerKey != ""
+}
+
+// Global holds the settings of the root command's flags, which the config
+// file can set as well.
+type Global struct {
+	LogLevel            string        `mapstructure:"log-level" enum:"error,warn,info,debug"`
+	LogDest             string        `mapstructure:"log-dest" enum:"stderr,stdout,file,syslog,journald"`
+	LogFile             string        `mapstructure:"log-file"`
+	LogMaxSize          int           `mapstructure:"log-max-size"`
+	LogMaxAge           time.Duration `mapstructure:"log-max-age"`
+	LogMaxBackups       int           `mapstructure:"log-max-backups"`
+	LogSampleFirst      int           `mapstructure:"log-sample-first"`
+	LogSampleThereafter int           `mapstructure:"log-sample-thereafter"`
+	Timeout             time.Duration `mapstructure:"timeout"`
+}
+
 type Config struct {
-	OAuth OAuth `mapstructure:",squash"`
-	Host  Host  `mapstructure:"host"`
-	User  User  `mapstructure:"user"`
+	// Profile is the config file profile in effect, empty without profiles.
+	Profile string  `mapstructure:"profile"`
+	Global  Global  `mapstructure:",squash"`
+	OAuth   OAuth   `mapstructure:",squash"`
+	HTTP    HTTP    `mapstructure:",squash"`
+	LocalCA LocalCA `mapstructure:",squash"`
+	Vault   Vault   `mapstructure:",squash"`
+	StepCA  StepCA  `mapstructure:",squash"`
+	Host    Host    `mapstructure:"host"`
+	User    User    `mapstructure:"user"`
 }
 
 func (c *Config) ValidateHost() error {
@@ -60,14 +273,23 @@ func (c *Config) ValidateHost() error {
 		return apperror.ErrUsage(fmt.Sprintf("missing required parameters: %s", strings.Join(missing, ", ")))
 	}
 
-	if c.OAuth.ServerURL == "" {
-		return apperror.ErrUsage("--ca-server-url is required")
+	if c.LocalCA.Enabled() || c.Vault.Enabled() {
+		if err := c.validateSigner(); err != nil {
+			return err
+		}
+		return ValidateKeyFile(c.Host.Key, false)
 	}
 
-	if _, err := ValidateClientCredential(c.OAuth, true); err != nil {
+	if err := c.validateCAServer(); err != nil {
 		return err
 	}
 
+	if !c.StepCA.SignsOTT() {
+		if _, err := ValidateClientCredential(c.OAuth, true); err != nil {
+			return err
+		}
+	}
+
 	return ValidateKeyFile(c.Host.Key, false)
 }
 
@@ -82,26 +304,87 @@ func (c *Config) ValidateUser() error {
 		return apperror.ErrUsage(fmt.Sprintf("missing required parameters: %s", strings.Join(missing, ", ")))
 	}
 
+	if c.LocalCA.Enabled() || c.Vault.Enabled() {
+		if err := c.validateSigner(); err != nil {
+			return err
+		}
+	} else if err := c.validateUserServer(); err != nil {
+		return err
+	}
+
+	// without a key file a new key is created and handed to ssh-agent
+	if c.User.Key == "" {
+		return ValidateSSHAgent()
+	}
+
+	return ValidateKeyFile(c.User.Key, false)
+}
+
+// validateSigner checks a CA backend used in place of the CA server.
+func (c *Config) validateSigner() error {
+	if c.LocalCA.Enabled() && c.Vault.Enabled() {
+		return apperror.ErrUsage("--ca-key and --vault-addr are mutually exclusive")
+	}
+
+	if c.StepCA.Enabled() {
+		return apperror.ErrUsage("--ca-server-type step-ca cannot be combined with --ca-key or --vault-addr")
+	}
+
+	if c.LocalCA.Enabled() {
+		return ValidateLocalCA(c.LocalCA)
+	}
+
+	return ValidateVault(c.Vault)
+}
+
+// validateCAServer checks the settings shared by host and user runs against
+// ca-server-url.
+func (c *Config) validateCAServer() error {
 	if c.OAuth.ServerURL == "" {
 		return apperror.ErrUsage("--ca-server-url is required")
 	}
 
+	if err := ValidateTLSClientCert(c.OAuth); err != nil {
+		return err
+	}
+
+	switch c.StepCA.CAServerType {
+	case "", CAServerKeysign:
+		return nil
+	case CAServerStepCA:
+		return ValidateStepCA(c.StepCA)
+	default:
+		return apperror.ErrUsage(fmt.Sprintf("unsupported --ca-server-type %q (expected %s|%s)", c.StepCA.CAServerType, CAServerKeysign, CAServerStepCA))
+	}
+}
+
+func (c *Config) validateUserServer() error {
+	if err := c.validateCAServer(); err != nil {
+		return err
+	}
+
+	if c.StepCA.SignsOTT() {
+		return nil
+	}
+
+	if c.OAuth.HasTokenExchange() {
+		return ValidateTokenExchange(c.OAuth)
+	}
+
+	return c.validateUserLogin()
+}
+
+func (c *Config) validateUserLogin() error {
 	clientCredentialConfigured, err := ValidateClientCredential(c.OAuth, false)
 	if err != nil {
 		return err
 	}
 
 	if !clientCredentialConfigured {
-		if err := ValidateDeviceFlow(c.OAuth); err != nil {
-			return err
-		}
+		return ValidateDeviceFlow(c.OAuth)
 	}
 
-	if c.User.Key != "" {
-		return ValidateSSHAgent()
-	}
-
-	return ValidateKeyFile(c.User.Key, true)
+	return nil
 }
 
 func ValidateDeviceFlow(o OAuth) error {
@@ -111,10 +394,6 @@ func ValidateDeviceFlow(o OAuth) error {
 		missing = append(missing, "--client-id")
 	}
 
-	if o.ClientSecret == "" {
-		missing = append(missing, "--client-secret")
-	}
-
 	if o.DeviceFlowURL == "" {
 		missing = append(missing, "--device-flow-url")
 	}
@@ -130,6 +409,28 @@ func ValidateDeviceFlow(o OAuth) error {
 	return nil
 }
 
+func ValidateTokenExchange(o OAuth) error {
+	var missing []string
+
+	if o.ClientID == "" {
+		missing = append(missing, "--client-id")
+	}
+
+	if o.TokenURL == "" {
+		missing = append(missing, "--token-url")
+	}
+
+	if len(missing) > 0 {
+		return apperror.ErrUsage(fmt.Sprintf("missing required parameters: %s", strings.Join(missing, ", ")))
+	}
+
+	if o.SubjectTokenFile != "" && o.SubjectTokenEnv != "" {
+		return apperror.ErrUsage("--subject-token-file and --subject-token-env are mutually exclusive")
+	}
+
+	return nil
+}
+
 func ValidateClientCredential(o OAuth, required bool) (bool, error) {
 	var missing []string
 
@@ -137,8 +438,24 @@ func ValidateClientCredential(o OAuth, required bool) (bool, error) {
 		missing = append(missing, "--client-id")
 	}
 
-	if o.ClientSecret == "" {
-		missing = append(missing, "--client-secret")
+	switch o.AuthMethod() {
+	case ClientSecretPost:
+		if o.ClientSecret == "" {
+			missing = append(missing, "--client-secret")
+		}
+	case PrivateKeyJWT:
+		if o.ClientAssertionKey == "" {
+			missing = append(missing, "--client-assertion-key")
+		}
+	case TLSClientAuth:
+		if o.TLSClientCert == "" {
+			missing = append(missing, "--tls-client-cert")
+		}
+		if o.TLSClientKey == "" {
+			missing = append(missing, "--tls-client-key")
+		}
+	default:
+		return false, apperror.ErrUsage(fmt.Sprintf("unsupported --client-auth-method %q (expected %s|%s|%s)", o.ClientAuthMethod, ClientSecretPost, PrivateKeyJWT, TLSClientAuth))
 	}
 
 	if o.TokenURL == "" {
@@ -152,6 +469,21 @@ func ValidateClientCredential(o OAuth, required bool) (bool, error) {
 	return len(missing) == 0, nil
 }
 
+// ValidateTLSClientCert checks that a client certificate and its key are
+// configured together. The pair is used for every TLS connection, not only
+// for tls_client_auth.
+func ValidateTLSClientCert(o OAuth) error {
+	if (o.TLSClientCert == "") == (o.TLSClientKey == "") {
+		return nil
+	}
+
+	if o.TLSClientCert == "" {
+		return apperror.ErrUsage("--tls-client-key requires --tls-client-cert")
+	}
+
+	return apperror.ErrUsage("--tls-client-cert requires --tls-client-key")
+}
+
 func ValidateKeyFile(keyfilePath string, opt bool) error {
 	if opt && keyfilePath == "" {
 		return nil
@@ -174,6 +506,77 @@ func ValidateKeyFile(keyfilePath string, opt bool) error {
 	return nil
 }
 
+// ValidateLocalCA refuses CA keys that other users could read.
+func ValidateLocalCA(l LocalCA) error {
+	p, err := paths.NormalizePath(l.Key)
+	if err != nil {
+		return apperror.ErrFileSystem(err)
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return apperror.ErrFileSystem(fmt.Errorf("--ca-key: %w", err))
+	}
+
+	if info.Mode().Perm()&0o004 != 0 {
+		return apperror.ErrFileSystem(fmt.Errorf("refusing to use world-readable CA key %q [Hint: chmod o-rwx %s]", p, p))
+	}
+
+	return nil
+}
+
+func ValidateVault(v Vault) error {
+	var missing []string
+
+	if v.Role == "" {
+		missing = append(missing, "--vault-role")
+	}
+
+	switch v.Auth() {
+	case VaultAuthToken:
+		// may also come from VAULT_TOKEN or ~/.vault-token
+	case VaultAuthAppRole:
+		if v.RoleID == "" {
+			missing = append(missing, "--vault-role-id")
+		}
+		if v.SecretID == "" {
+			missing = append(missing, "--vault-secret-id")
+		}
+	case VaultAuthJWT:
+		if v.JWTRole == "" {
+			missing = append(missing, "--vault-jwt-role")
+		}
+		if v.JWT == "" {
+			missing = append(missing, "--vault-jwt")
+		}
+	default:
+		return apperror.ErrUsage(fmt.Sprintf("unsupported --vault-auth-method %q (expected %s|%s|%s)", v.AuthMethod, VaultAuthToken, VaultAuthAppRole, VaultAuthJWT))
+	}
+
+	if len(missing) > 0 {
+		return apperror.ErrUsage(fmt.Sprintf("missing required parameters: %s", strings.Join(missing, ", ")))
+	}
+
+	return nil
+}
+
+func ValidateStepCA(s StepCA) error {
+	if s.RootFingerprint != "" && !isSHA256Hex(s.RootFingerprint) {
+		return apperror.ErrUsage(fmt.Sprintf("invalid --step-root-fingerprint %q, expected the SHA-256 of the root certificate in hex as printed by step certificate fingerprint", s.RootFingerprint))
+	}
+
+	if s.ProvisionerKey != "" && s.Provisioner == "" {
+		return apperror.ErrUsage("--step-provisioner-key requires --step-provisioner")
+	}
+
+	return nil
+}
+
+func isSHA256Hex(s string) bool {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	return err == nil && len(b) == sha256.Size
+}
+
 func ValidateSSHAgent() error {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if sock == "" {
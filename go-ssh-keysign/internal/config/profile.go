@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/constants"
+)
+
+var profileName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// ApplyProfile merges the settings of the selected entry of the config
+// file's profiles map over the shared top-level settings, so a profile only
+// lists what differs. The profile is picked by --profile, SSH_KEYSIGN_PROFILE
+// or the profile key of the config file, else "default" if there is one.
+// Flags and environment variables still take precedence over both.
+func ApplyProfile(v *viper.Viper) error {
+	profiles := v.GetStringMap("profiles")
+
+	name := strings.ToLower(v.GetString("profile"))
+	if name == "" {
+		if _, ok := profiles[constants.DefaultProfile]; !ok {
+			return nil
+		}
+		name = constants.DefaultProfile
+	}
+
+	if !profileName.MatchString(name) {
+		return apperror.ErrUsage(fmt.Sprintf("invalid --profile %q: use letters, digits, '.', '_' and '-'", name))
+	}
+
+	raw, ok := profiles[name]
+	if !ok {
+		defined := slices.Sorted(maps.Keys(profiles))
+		if len(defined) == 0 {
+			return apperror.ErrUsage(fmt.Sprintf("unknown --profile %q: the config file has no profiles section", name))
+		}
+		return apperror.ErrUsage(fmt.Sprintf("unknown --profile %q, the config file defines: %s", name, strings.Join(defined, ", ")))
+	}
+
+	settings, ok := raw.(map[string]any)
+	if !ok && raw != nil {
+		return apperror.ErrUsage(fmt.Sprintf("profile %q in the config file must be a map of settings", name))
+	}
+
+	if err := v.MergeConfigMap(settings); err != nil {
+		return apperror.ErrUsage(fmt.Sprintf("profile %q: %v", name, err))
+	}
+
+	v.Set("profile", name)
+	return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// durationPattern matches what time.ParseDuration accepts, e.g. 90s or 1h30m.
+const durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+// Schema returns a JSON Schema (draft-07) of the config file, for editors to
+// validate it. describe returns the documentation of a setting, empty if
+// there is none.
+func Schema(describe func(key string) string) map[string]any {
+	settings := settingsSchema(describe)
+
+	profile := copySchema(settings)
+	delete(profile["properties"].(map[string]any), "profile")
+
+	settings["properties"].(map[string]any)["profiles"] = map[string]any{
+		"type":                 "object",
+		"description":          "named sets of settings that override the shared ones, selected with --profile",
+		"propertyNames":        map[string]any{"pattern": profileName.String()},
+		"additionalProperties": profile,
+	}
+
+	var keys []string
+	for _, s := range Settings(Config{}) {
+		keys = append(keys, s.Key)
+	}
+	settings["properties"].(map[string]any)[LockedKey] = map[string]any{
+		"type":        "array",
+		"description": "settings that later config files, environment variables and flags cannot override; only honored in system config files",
+		"items":       map[string]any{"enum": keys},
+	}
+
+	settings["$schema"] = "http://json-schema.org/draft-07/schema#"
+	settings["title"] = "ssh-keysign configuration"
+	return settings
+}
+
+func settingsSchema(describe func(key string) string) map[string]any {
+	root := objectSchema()
+
+	for _, s := range Settings(Config{}) {
+		obj := root
+		parts := strings.Split(s.Key, ".")
+		for _, p := range parts[:len(parts)-1] {
+			props := obj["properties"].(map[string]any)
+			child, ok := props[p].(map[string]any)
+			if !ok {
+				child = objectSchema()
+				props[p] = child
+			}
+			obj = child
+		}
+
+		prop := typeSchema(reflect.TypeOf(s.Value))
+		if len(s.Enum) > 0 {
+			prop["enum"] = s.Enum
+		}
+		if d := describe(s.Key); d != "" {
+			prop["description"] = d
+		}
+		obj["properties"].(map[string]any)[parts[len(parts)-1]] = prop
+	}
+
+	return root
+}
+
+func objectSchema() map[string]any {
+	return map[string]any{
+		"type":                 "object",
+		"properties":           map[string]any{},
+		"additionalProperties": false,
+	}
+}
+
+// typeSchema follows what CheckFile accepts.
+func typeSchema(t reflect.Type) map[string]any {
+	switch {
+	case t == durationType:
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() == reflect.Int:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case t.Kind() == reflect.Slice:
+		// a single value is accepted for a list
+		return map[string]any{"type": []string{"array", "string"}, "items": map[string]any{"type": "string"}}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}}
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
+
+func copySchema(m map[string]any) map[string]any {
+	c := make(map[string]any, len(m))
+	for k, v := range m {
+		if child, ok := v.(map[string]any); ok {
+			v = copySchema(child)
+		}
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+// Secret values may reference where the secret is kept instead of holding it:
+//
+//	file:/path/to/secret   contents of a file that is not world-readable
+//	env:NAME               value of the environment variable NAME
+//	stdin                  everything read from standard input
+//	cred:NAME              systemd credential $CREDENTIALS_DIRECTORY/NAME
+//	exec:COMMAND           standard output of COMMAND run through /bin/sh
+//
+// When a secret is left empty and the process runs with systemd credentials,
+// a credential named like the config key (e.g. client-secret) is used.
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+	secretStdin      = "stdin"
+	secretCredPrefix = "cred:"
+	secretExecPrefix = "exec:"
+
+	secretExecTimeout = 30 * time.Second
+)
+
+type secretResolver struct {
+	stdinUsedBy string
+}
+
+// resolveSecrets replaces every field tagged `secret:"true"` that holds a
+// secret reference with the referenced value.
+func resolveSecrets(c *Config) error {
+	r := &secretResolver{}
+	return r.walk(reflect.ValueOf(c).Elem())
+}
+
+func (r *secretResolver) walk(v reflect.Value) error {
+	t := v.Type()
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		fv := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := r.walk(fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.Tag.Get("secret") != "true" || fv.Kind() != reflect.String {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		resolved, err := r.resolve(name, fv.String())
+		if err != nil {
+			return err
+		}
+		fv.SetString(resolved)
+	}
+
+	return nil
+}
+
+// IsSecretReference reports whether s points at a secret source rather than
+// holding the secret itself.
+func IsSecretReference(s string) bool {
+	if s == secretStdin {
+		return true
+	}
+
+	for _, prefix := range []string{secretFilePrefix, secretEnvPrefix, secretCredPrefix, secretExecPrefix} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *secretResolver) resolve(name, ref string) (string, error) {
+	switch {
+	case ref == "":
+		return r.fromCredentialsDirectory(name, name, true)
+	case ref == secretStdin:
+		if r.stdinUsedBy != "" {
+			return "", apperror.ErrUsage(fmt.Sprintf("%s: stdin is already used by %s", name, r.stdinUsedBy))
+		}
+		r.stdinUsedBy = name
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", apperror.ErrFileSystem(fmt.Errorf("%s: read stdin: %w", name, err))
+		}
+		return trimSecret(b), nil
+	case strings.HasPrefix(ref, secretFilePrefix):
+		return readSecretFile(name, strings.TrimPrefix(ref, secretFilePrefix))
+	case strings.HasPrefix(ref, secretEnvPrefix):
+		env := strings.TrimPrefix(ref, secretEnvPrefix)
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			return "", apperror.ErrUsage(fmt.Sprintf("%s: environment variable %s is not set", name, env))
+		}
+		return val, nil
+	case strings.HasPrefix(ref, secretCredPrefix):
+		return r.fromCredentialsDirectory(name, strings.TrimPrefix(ref, secretCredPrefix), false)
+	case strings.HasPrefix(ref, secretExecPrefix):
+		return execSecret(name, strings.TrimPrefix(ref, secretExecPrefix))
+	default:
+		return ref, nil
+	}
+}
+
+func (r *secretResolver) fromCredentialsDirectory(name, credential string, optional bool) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		if optional {
+			return "", nil
+		}
+		return "", apperror.ErrUsage(fmt.Sprintf("%s: CREDENTIALS_DIRECTORY is not set; use LoadCredential= in the systemd unit", name))
+	}
+
+	if credential == "" || strings.ContainsRune(credential, filepath.Separator) {
+		return "", apperror.ErrUsage(fmt.Sprintf("%s: invalid credential name %q", name, credential))
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, credential))
+	if err != nil {
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", apperror.ErrFileSystem(fmt.Errorf("%s: read credential %q: %w", name, credential, err))
+	}
+
+	return trimSecret(b), nil
+}
+
+func readSecretFile(name, path string) (string, error) {
+	p, err := paths.NormalizePath(path)
+	if err != nil {
+		return "", apperror.ErrFileSystem(err)
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", apperror.ErrFileSystem(fmt.Errorf("%s: %w", name, err))
+	}
+
+	if info.Mode().Perm()&0o004 != 0 {
+		return "", apperror.ErrFileSystem(fmt.Errorf("%s: refusing to read world-readable secret file %q [Hint: chmod o-rwx %s]", name, p, p))
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", apperror.ErrFileSystem(fmt.Errorf("%s: %w", name, err))
+	}
+
+	return trimSecret(b), nil
+}
+
+func execSecret(name, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return "", apperror.ErrAuth(fmt.Errorf("%s: secret command failed: %w: %s", name, err, msg))
+		}
+		return "", apperror.ErrAuth(fmt.Errorf("%s: secret command failed: %w", name, err))
+	}
+
+	return trimSecret(stdout.Bytes()), nil
+}
+
+func trimSecret(b []byte) string {
+	return strings.TrimRight(string(b), "\r\n")
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Setting is one value of Config under its config file key, e.g.
+// "ca-server-url" or "user.principal".
+type Setting struct {
+	Key    string
+	Value  any
+	Secret bool
+	// Enum lists the accepted values, empty when any value is.
+	Enum []string
+}
+
+// Settings lists the values of c in field order, with the keys a config file
+// uses for them.
+func Settings(c Config) []Setting {
+	var s []Setting
+	collectSettings(reflect.ValueOf(c), "", &s)
+	return s
+}
+
+func collectSettings(v reflect.Value, prefix string, s *[]Setting) {
+	t := v.Type()
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+
+		if field.Type.Kind() == reflect.Struct {
+			if opts == "squash" {
+				collectSettings(v.Field(i), prefix, s)
+			} else {
+				collectSettings(v.Field(i), prefix+name+".", s)
+			}
+			continue
+		}
+
+		setting := Setting{
+			Key:    prefix + name,
+			Value:  v.Field(i).Interface(),
+			Secret: field.Tag.Get("secret") == "true",
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			setting.Enum = strings.Split(enum, ",")
+		}
+		*s = append(*s, setting)
+	}
+}
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+)
+
+// CheckFile reports the keys of the config file at path that are not
+// settings and the values that do not fit their setting, each with its line.
+// Load decodes weakly because flags and environment variables are strings;
+// the file is checked strictly so that a typo is not silently ignored.
+func CheckFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return apperror.ErrFileSystem(fmt.Errorf("failed to read config %q: %w", path, err))
+	}
+	return Check(path, b)
+}
+
+// Check is CheckFile for the content b of the file at path.
+func Check(path string, b []byte) error {
+	problems := checkYAML(b)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	lines := make([]string, len(problems))
+	for i, p := range problems {
+		// a syntax error carries its line in the message
+		if p.line == 0 {
+			lines[i] = fmt.Sprintf("%s: %s", path, p.msg)
+		} else {
+			lines[i] = fmt.Sprintf("%s:%d: %s", path, p.line, p.msg)
+		}
+	}
+	return apperror.ErrUsage("invalid config file:\n" + strings.Join(lines, "\n"))
+}
+
+type problem struct {
+	line int
+	msg  string
+}
+
+type checker struct {
+	settings map[string]Setting
+	// sections are the keys holding nested settings, e.g. "user"
+	sections map[string]bool
+	problems []problem
+}
+
+func checkYAML(b []byte) []problem {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return []problem{{msg: err.Error()}}
+	}
+
+	// an empty file
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	c := &checker{settings: map[string]Setting{}, sections: map[string]bool{}}
+	for _, s := range Settings(Config{}) {
+		c.settings[s.Key] = s
+		parts := strings.Split(s.Key, ".")
+		for i := 1; i < len(parts); i++ {
+			c.sections[strings.Join(parts[:i], ".")] = true
+		}
+	}
+
+	c.mapping(doc.Content[0], "", true)
+	return c.problems
+}
+
+func (c *checker) add(n *yaml.Node, format string, args ...any) {
+	c.problems = append(c.problems, problem{line: n.Line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) mapping(n *yaml.Node, prefix string, top bool) {
+	n = resolveAlias(n)
+	if n.Kind != yaml.MappingNode {
+		name := strings.TrimSuffix(prefix, ".")
+		if name == "" {
+			name = "the config file"
+		}
+		c.add(n, "%s must be a map of settings", name)
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, val := n.Content[i], n.Content[i+1]
+
+		// YAML merge keys, <<: *shared
+		if k.Tag == "!!merge" {
+			for _, m := range mergedMappings(val) {
+				c.mapping(m, prefix, top)
+			}
+			continue
+		}
+
+		// viper ignores the case of keys
+		key := prefix + strings.ToLower(k.Value)
+
+		switch s, ok := c.settings[key]; {
+		case key == "profiles":
+			if top {
+				c.profiles(val)
+			} else {
+				c.add(k, "profiles cannot be nested in a profile")
+			}
+		case key == "profile" && !top:
+			c.add(k, "a profile cannot select another profile")
+		case key == LockedKey:
+			if top {
+				c.locked(val)
+			} else {
+				c.add(k, "locked cannot be set in a profile")
+			}
+		case c.sections[key]:
+			c.mapping(val, key+".", false)
+		case ok:
+			c.value(key, val, s)
+		default:
+			if guess := c.closest(key); guess != "" {
+				c.add(k, "unknown key %q, did you mean %q?", key, guess)
+			} else {
+				c.add(k, "unknown key %q", key)
+			}
+		}
+	}
+}
+
+func (c *checker) profiles(n *yaml.Node) {
+	n = resolveAlias(n)
+	if n.Kind != yaml.MappingNode {
+		c.add(n, "profiles must be a map of profile names to settings")
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, val := n.Content[i], n.Content[i+1]
+
+		if !profileName.MatchString(strings.ToLower(k.Value)) {
+			c.add(k, "invalid profile name %q: use letters, digits, '.', '_' and '-'", k.Value)
+		}
+
+		// an empty profile only selects the shared settings
+		if v := resolveAlias(val); v.Kind == yaml.ScalarNode && v.Tag == "!!null" {
+			continue
+		}
+		c.mapping(val, "", false)
+	}
+}
+
+func (c *checker) locked(n *yaml.Node) {
+	n = resolveAlias(n)
+	if n.Kind != yaml.SequenceNode {
+		c.add(n, "locked must be a list of setting keys")
+		return
+	}
+
+	for _, k := range n.Content {
+		if _, ok := c.settings[k.Value]; ok && k.Kind == yaml.ScalarNode {
+			continue
+		}
+		if guess := c.closest(k.Value); guess != "" {
+			c.add(k, "locked: unknown setting %q, did you mean %q?", k.Value, guess)
+		} else {
+			c.add(k, "locked: unknown setting %q", k.Value)
+		}
+	}
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+func (c *checker) value(key string, n *yaml.Node, s Setting) {
+	n = resolveAlias(n)
+
+	// null leaves the setting unset
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+
+	t := reflect.TypeOf(s.Value)
+
+	// a single value is accepted for a list, like for flags
+	target := t
+	if t.Kind() == reflect.Slice && n.Kind == yaml.ScalarNode {
+		target = t.Elem()
+	}
+
+	// yaml.v3 still takes yes and on for booleans, Load does not
+	wrongBool := t.Kind() == reflect.Bool && n.Tag != "!!bool"
+
+	if err := n.Decode(reflect.New(target).Interface()); err != nil || wrongBool {
+		c.add(n, "%s must be %s, got %s", key, describeType(t), describeNode(n))
+		return
+	}
+
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, n.Value) {
+		c.add(n, "%s must be one of %s, got %q", key, strings.Join(s.Enum, "|"), n.Value)
+	}
+}
+
+// closest returns the setting key within two edits of key, e.g. the
+// singular of a plural.
+func (c *checker) closest(key string) string {
+	best, bestDist := "", 3
+	for k := range c.settings {
+		if d := editDistance(key, k); d < bestDist || (d == bestDist && k < best) {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func describeType(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "a duration such as 30s or 5m"
+	case t.Kind() == reflect.Bool:
+		return "true or false"
+	case t.Kind() == reflect.Int:
+		return "a number"
+	case t.Kind() == reflect.Uint64:
+		return "a positive number"
+	case t.Kind() == reflect.Slice:
+		return "a list of strings"
+	case t.Kind() == reflect.Map:
+		return "a map of strings"
+	default:
+		return "a string"
+	}
+}
+
+func describeNode(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a map"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", n.Value)
+	}
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+func mergedMappings(n *yaml.Node) []*yaml.Node {
+	n = resolveAlias(n)
+	if n.Kind != yaml.SequenceNode {
+		return []*yaml.Node{n}
+	}
+
+	merged := make([]*yaml.Node, len(n.Content))
+	for i, m := range n.Content {
+		merged[i] = resolveAlias(m)
+	}
+	return merged
+}
@@ -11,11 +11,39 @@ const (
 
 	AppName              string = "ssh-keysign"
 	ConfigFileName       string = "config.yml"
+	HostConfigFileName   string = "host.yml"
 	EtcDir               string = "/etc"
 	UserSSHDir           string = "~/.ssh"
 	ConfirmCertBeforeUse bool   = false
+
+	DiscoveryCacheTTL        time.Duration = 24 * time.Hour
+	DefaultDeviceFlowTimeout time.Duration = 2 * time.Minute
+
+	DefaultConnectTimeout      time.Duration = 10 * time.Second
+	DefaultTLSHandshakeTimeout time.Duration = 10 * time.Second
+	DefaultHTTPTimeout         time.Duration = 60 * time.Second
+	DefaultRetries             int           = 3
+	DefaultRetryMaxTime        time.Duration = 30 * time.Second
 )
 
+// DefaultProfile is used when the config file defines profiles and none is
+// selected.
+const DefaultProfile = "default"
+
+// DefaultVaultMount is where Vault's SSH secrets engine is mounted by
+// default.
+const DefaultVaultMount = "ssh"
+
+// DefaultUserCertExtensions are the extensions ssh-keygen grants user
+// certificates by default.
+var DefaultUserCertExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
 func DefaultDurationForHostKey() uint64 {
 	return uint64((defaultDurationForHostKeyInDays * day).Seconds())
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
+	"binarycodes/ssh-keysign/internal/config"
 	"binarycodes/ssh-keysign/internal/logging"
 )
 
@@ -14,6 +15,7 @@ type (
 	loggerKey     struct{}
 	logCleanupKey struct{}
 	printerKey    struct{}
+	layersKey     struct{}
 )
 
 func WithViper(ctx context.Context, v *viper.Viper) context.Context {
@@ -59,3 +61,16 @@ func PrinterFrom(ctx context.Context) *logging.Printer {
 	}
 	return nil
 }
+
+func WithConfigLayers(ctx context.Context, l config.Layers) context.Context {
+	return context.WithValue(ctx, layersKey{}, l)
+}
+
+// ConfigLayersFrom returns the config files read for the run, none if the
+// command has no --config.
+func ConfigLayersFrom(ctx context.Context) config.Layers {
+	if l, ok := ctx.Value(layersKey{}).(config.Layers); ok {
+		return l
+	}
+	return nil
+}
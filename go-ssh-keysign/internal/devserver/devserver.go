@@ -0,0 +1,215 @@
+package devserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Options configure the dev server. The zero value serves a public device
+// flow client "dev-client" whose logins wait for Approve.
+type Options struct {
+	// ClientID and ClientSecret are the only client accepted at the token
+	// endpoint. Without a secret the client is public and can only use
+	// device flow.
+	ClientID     string
+	ClientSecret string
+
+	// AutoApprove approves every device login as this user once
+	// PendingPolls polls were answered with authorization_pending.
+	AutoApprove  string
+	PendingPolls int
+
+	TokenTTL     time.Duration
+	UserValidity time.Duration
+	HostValidity time.Duration
+
+	// CA signs the certificates, a fresh ed25519 key when nil.
+	CA ssh.Signer
+}
+
+// Server is an in-memory stand-in for the IdP and the CA server, so the CLI
+// can be exercised end to end without Keycloak, Postgres and the Spring
+// server. It is meant for development and tests only: the CA key, clients
+// and tokens live in memory and nothing is persisted.
+type Server struct {
+	opts Options
+	ca   ssh.Signer
+
+	mu      sync.Mutex
+	tokens  map[string]token
+	devices map[string]*device  // by device code
+	faults  map[string][]*fault // by path
+}
+
+type token struct {
+	id      string
+	subject string
+	expires time.Time
+}
+
+type device struct {
+	userCode  string
+	challenge string
+	expires   time.Time
+	polls     int
+	user      string
+	denied    bool
+}
+
+// fault answers the next remaining requests in place of the real handler.
+type fault struct {
+	status    int
+	body      string
+	remaining int
+}
+
+func New(o Options) (*Server, error) {
+	if o.ClientID == "" {
+		o.ClientID = "dev-client"
+	}
+	if o.TokenTTL == 0 {
+		o.TokenTTL = 5 * time.Minute
+	}
+	if o.UserValidity == 0 {
+		o.UserValidity = time.Hour
+	}
+	if o.HostValidity == 0 {
+		o.HostValidity = 24 * time.Hour
+	}
+
+	ca := o.CA
+	if ca == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if ca, err = ssh.NewSignerFromKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Server{
+		opts:    o,
+		ca:      ca,
+		tokens:  map[string]token{},
+		devices: map[string]*device{},
+		faults:  map[string][]*fault{},
+	}, nil
+}
+
+// CAPublicKey is the key certificates are signed with, for TrustedUserCAKeys
+// or an @cert-authority line in known_hosts.
+func (s *Server) CAPublicKey() ssh.PublicKey {
+	return s.ca.PublicKey()
+}
+
+// Approve completes the pending device login with the given user code as
+// username.
+func (s *Server) Approve(userCode, username string) error {
+	return s.decide(userCode, func(d *device) { d.user = username })
+}
+
+// Deny makes the next poll of the device login fail with access_denied.
+func (s *Server) Deny(userCode string) error {
+	return s.decide(userCode, func(d *device) { d.denied = true })
+}
+
+func (s *Server) decide(userCode string, f func(*device)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devices {
+		if d.userCode == strings.ToUpper(userCode) {
+			f(d)
+			return nil
+		}
+	}
+	return fmt.Errorf("no pending device login with user code %q", userCode)
+}
+
+// Fail makes the next times requests to path fail with status, e.g. 503 to
+// exercise retries. body is sent as is, an empty body stays empty.
+func (s *Server) Fail(path string, status, times int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if times < 1 {
+		return
+	}
+	s.faults[path] = append(s.faults[path], &fault{status: status, body: body, remaining: times})
+}
+
+// Handler serves:
+//
+//	GET  /.well-known/openid-configuration
+//	POST /token                 client_credentials and device_code grants
+//	POST /device                device authorization (RFC 8628)
+//	GET  /userinfo
+//	POST /rest/key/userSign     the CA server's sign endpoints
+//	POST /rest/key/hostSign
+//	GET  /dev/ca.pub            the CA public key
+//	POST /dev/approve           user_code, username: see Approve
+//	POST /dev/deny              user_code: see Deny
+//	POST /dev/fail              path, status, times, body: see Fail
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("POST /device", s.deviceAuthorization)
+	mux.HandleFunc("GET /userinfo", s.userinfo)
+	mux.HandleFunc("POST /rest/key/userSign", s.sign(ssh.UserCert))
+	mux.HandleFunc("POST /rest/key/hostSign", s.sign(ssh.HostCert))
+	mux.HandleFunc("GET /dev/ca.pub", s.caPub)
+	mux.HandleFunc("POST /dev/approve", s.approve)
+	mux.HandleFunc("POST /dev/deny", s.deny)
+	mux.HandleFunc("POST /dev/fail", s.fail)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := s.nextFault(r.URL.Path); ok {
+			w.WriteHeader(f.status)
+			_, _ = w.Write([]byte(f.body))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) nextFault(path string) (fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.faults[path]
+	if len(queue) == 0 {
+		return fault{}, false
+	}
+
+	f := queue[0]
+	if f.remaining--; f.remaining == 0 {
+		s.faults[path] = queue[1:]
+	}
+	return *f, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// baseURL is the issuer as seen by the client, so the server works behind
+// any listen address.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
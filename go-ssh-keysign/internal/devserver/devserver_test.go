@@ -0,0 +1,166 @@
+package devserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/devserver"
+	"binarycodes/ssh-keysign/internal/service"
+)
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMcaweeG/CM+CCTasqfdOkb0Tm2YIjlJcfeyX0BWWjvR alice@laptop"
+
+func newServer(t *testing.T, o devserver.Options) (*devserver.Server, *httptest.Server) {
+	t.Helper()
+
+	s, err := devserver.New(o)
+	require.NoError(t, err)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func postForm(t *testing.T, u string, form url.Values) (int, map[string]any) {
+	t.Helper()
+
+	resp, err := http.PostForm(u, form)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func sign(t *testing.T, u, accessToken, principal string) (*http.Response, service.SignedResponse) {
+	t.Helper()
+
+	b, err := json.Marshal(service.SignRequest{PublicKey: testKey, Principal: principal})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var signed service.SignedResponse
+	_ = json.NewDecoder(resp.Body).Decode(&signed)
+	return resp, signed
+}
+
+func TestDeviceFlow_PendingUntilApproved(t *testing.T) {
+	s, srv := newServer(t, devserver.Options{})
+
+	status, start := postForm(t, srv.URL+"/device", url.Values{"client_id": {"dev-client"}})
+	require.Equal(t, http.StatusOK, status)
+
+	poll := url.Values{
+		"client_id":   {"dev-client"},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {start["device_code"].(string)},
+	}
+
+	status, body := postForm(t, srv.URL+"/token", poll)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "authorization_pending", body["error"])
+
+	require.NoError(t, s.Approve(start["user_code"].(string), "alice"))
+
+	status, body = postForm(t, srv.URL+"/token", poll)
+	require.Equal(t, http.StatusOK, status)
+
+	resp, signed := sign(t, srv.URL+"/rest/key/userSign", body["access_token"].(string), "alice")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.SignedPublicKey))
+	require.NoError(t, err)
+	cert := pub.(*ssh.Certificate)
+	assert.Equal(t, "alice@laptop", comment)
+	assert.Equal(t, []string{"alice"}, cert.ValidPrincipals)
+	assert.Equal(t, uint32(ssh.UserCert), cert.CertType)
+	assert.Contains(t, cert.Extensions, "permit-pty")
+	assert.Equal(t, s.CAPublicKey().Marshal(), cert.SignatureKey.Marshal())
+
+	// a device code is good for one token only
+	status, body = postForm(t, srv.URL+"/token", poll)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", body["error"])
+}
+
+func TestDeviceFlow_Denied(t *testing.T) {
+	s, srv := newServer(t, devserver.Options{})
+
+	_, start := postForm(t, srv.URL+"/device", url.Values{"client_id": {"dev-client"}})
+	require.NoError(t, s.Deny(start["user_code"].(string)))
+
+	status, body := postForm(t, srv.URL+"/token", url.Values{
+		"client_id":   {"dev-client"},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {start["device_code"].(string)},
+	})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "access_denied", body["error"])
+}
+
+func TestSign_RejectsLikeTheCAServer(t *testing.T) {
+	_, srv := newServer(t, devserver.Options{ClientID: "ci", ClientSecret: "s3cret"})
+
+	status, body := postForm(t, srv.URL+"/token", url.Values{
+		"client_id":     {"ci"},
+		"client_secret": {"s3cret"},
+		"grant_type":    {"client_credentials"},
+	})
+	require.Equal(t, http.StatusOK, status)
+	accessToken := body["access_token"].(string)
+
+	resp, _ := sign(t, srv.URL+"/rest/key/hostSign", accessToken, "web")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("WWW-Authenticate"))
+
+	resp, _ = sign(t, srv.URL+"/rest/key/hostSign", "unknown", "ci")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "invalid_token")
+
+	resp, signed := sign(t, srv.URL+"/rest/key/hostSign", accessToken, "ci")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.SignedPublicKey))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(ssh.HostCert), pub.(*ssh.Certificate).CertType)
+	assert.Empty(t, pub.(*ssh.Certificate).Extensions)
+}
+
+func TestFail_InjectsErrors(t *testing.T) {
+	_, srv := newServer(t, devserver.Options{})
+
+	status, _ := postForm(t, srv.URL+"/dev/fail", url.Values{"path": {"/token"}, "status": {"503"}, "times": {"2"}})
+	require.Equal(t, http.StatusOK, status)
+
+	for range 2 {
+		status, _ = postForm(t, srv.URL+"/token", url.Values{})
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	}
+
+	status, body := postForm(t, srv.URL+"/token", url.Values{"client_id": {"dev-client"}, "grant_type": {"password"}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "unsupported_grant_type", body["error"])
+}
+
+func TestFail_RejectsUnboundedTimes(t *testing.T) {
+	_, srv := newServer(t, devserver.Options{})
+
+	for _, times := range []string{"0", "-1", "1000000000"} {
+		status, _ := postForm(t, srv.URL+"/dev/fail", url.Values{"path": {"/token"}, "status": {"503"}, "times": {times}})
+		assert.Equal(t, http.StatusBadRequest, status, times)
+	}
+}
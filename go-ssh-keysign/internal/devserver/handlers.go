@@ -0,0 +1,336 @@
+package devserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/oidc"
+)
+
+const (
+	clientCredentialGrant = "client_credentials"
+	deviceGrant           = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL         = 10 * time.Minute
+)
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	writeJSON(w, http.StatusOK, oidc.ProviderMetadata{
+		Issuer:                            base,
+		TokenEndpoint:                     base + "/token",
+		DeviceAuthorizationEndpoint:       base + "/device",
+		UserinfoEndpoint:                  base + "/userinfo",
+		ScopesSupported:                   []string{"openid"},
+		GrantTypesSupported:               []string{clientCredentialGrant, deviceGrant},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_post"},
+	})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if r.PostForm.Get("client_id") != s.opts.ClientID {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return
+	}
+
+	switch grant := r.PostForm.Get("grant_type"); grant {
+	case clientCredentialGrant:
+		secret := r.PostForm.Get("client_secret")
+		if s.opts.ClientSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.opts.ClientSecret)) != 1 {
+			oauthError(w, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+			return
+		}
+		// the CA server takes client_id as the principal of a service account
+		s.issueToken(w, s.opts.ClientID)
+	case deviceGrant:
+		s.pollDevice(w, r.PostForm.Get("device_code"), r.PostForm.Get("code_verifier"))
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", grant)
+	}
+}
+
+func (s *Server) pollDevice(w http.ResponseWriter, deviceCode, verifier string) {
+	s.mu.Lock()
+	d, ok := s.devices[deviceCode]
+	if !ok {
+		s.mu.Unlock()
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "unknown device code")
+		return
+	}
+
+	if d.user == "" && s.opts.AutoApprove != "" && d.polls >= s.opts.PendingPolls {
+		d.user = s.opts.AutoApprove
+	}
+	d.polls++
+
+	var errCode string
+	switch {
+	case time.Now().After(d.expires):
+		errCode = "expired_token"
+	case d.denied:
+		errCode = "access_denied"
+	case d.user == "":
+		errCode = "authorization_pending"
+	case d.challenge != "" && pkceChallenge(verifier) != d.challenge:
+		errCode = "invalid_grant"
+	}
+
+	if errCode != "authorization_pending" {
+		delete(s.devices, deviceCode)
+	}
+	s.mu.Unlock()
+
+	if errCode != "" {
+		oauthError(w, http.StatusBadRequest, errCode, "")
+		return
+	}
+
+	s.issueToken(w, d.user)
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, subject string) {
+	t := token{id: randomHex(16), subject: subject, expires: time.Now().Add(s.opts.TokenTTL)}
+	access := randomHex(32)
+
+	s.mu.Lock()
+	s.tokens[access] = t
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, service.AccessToken{
+		AccessToken: access,
+		ExpiresIn:   uint64(s.opts.TokenTTL.Seconds()),
+		TokenType:   "Bearer",
+		Scope:       "openid",
+	})
+}
+
+func (s *Server) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if r.PostForm.Get("client_id") != s.opts.ClientID {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return
+	}
+
+	deviceCode := randomHex(16)
+	d := &device{
+		userCode:  newUserCode(),
+		expires:   time.Now().Add(deviceCodeTTL),
+		challenge: r.PostForm.Get("code_challenge"),
+	}
+
+	s.mu.Lock()
+	s.devices[deviceCode] = d
+	s.mu.Unlock()
+
+	verify := baseURL(r) + "/device/verify"
+	writeJSON(w, http.StatusOK, service.DeviceFlowStartResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                d.userCode,
+		VerificationURI:         verify,
+		VerificationURIComplete: verify + "?user_code=" + d.userCode,
+		ExpiresIn:               uint64(deviceCodeTTL.Seconds()),
+		Interval:                1,
+	})
+}
+
+// sign follows KeyController: an unknown or expired token gets a 401 with a
+// Bearer challenge, a principal other than the token's a bare 401 and a key
+// that cannot be signed a bare 400.
+func (s *Server) sign(certType uint32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, problem := s.lookupToken(r.Header.Get("Authorization"))
+		if problem != "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, problem))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req service.SignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.Principal != t.subject {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		signed, err := s.signKey(certType, req, t.id)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, service.SignedResponse{SignedPublicKey: signed})
+	}
+}
+
+// lookupToken returns the token of a Bearer authorization, or why it is not
+// accepted.
+func (s *Server) lookupToken(authorization string) (token, string) {
+	access, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return token{}, "Bearer token required"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[access]
+	switch {
+	case !ok:
+		return token{}, "Invalid token"
+	case time.Now().After(t.expires):
+		return token{}, "Jwt expired at " + t.expires.UTC().Format(time.RFC3339)
+	}
+	return t, ""
+}
+
+func (s *Server) signKey(certType uint32, req service.SignRequest, keyID string) (string, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		return "", err
+	}
+
+	validity := s.opts.UserValidity
+	if certType == ssh.HostCert {
+		validity = s.opts.HostValidity
+	}
+	now := time.Now()
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          0,
+		CertType:        certType,
+		KeyId:           keyID,
+		ValidPrincipals: []string{req.Principal},
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+	}
+
+	if certType == ssh.UserCert {
+		cert.Extensions = map[string]string{}
+		for _, e := range constants.DefaultUserCertExtensions {
+			cert.Extensions[e] = ""
+		}
+	}
+
+	if err := cert.SignCert(rand.Reader, s.ca); err != nil {
+		return "", err
+	}
+
+	signed := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+	if comment != "" {
+		signed += " " + comment
+	}
+	return signed + "\n", nil
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	t, problem := s.lookupToken(r.Header.Get("Authorization"))
+	if problem != "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, problem))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, oidc.Identity{Subject: t.subject, PreferredUsername: t.subject})
+}
+
+func (s *Server) caPub(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write(ssh.MarshalAuthorizedKey(s.ca.PublicKey()))
+}
+
+func (s *Server) approve(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.Approve(r.FormValue("user_code"), username); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+func (s *Server) deny(w http.ResponseWriter, r *http.Request) {
+	if err := s.Deny(r.FormValue("user_code")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+// maxFailTimes bounds /dev/fail, more failures than that exercise nothing.
+const maxFailTimes = 1000
+
+func (s *Server) fail(w http.ResponseWriter, r *http.Request) {
+	status, err := strconv.Atoi(r.FormValue("status"))
+	if err != nil || status < 100 || status > 599 {
+		http.Error(w, "status must be an HTTP status code", http.StatusBadRequest)
+		return
+	}
+
+	times := 1
+	if v := r.FormValue("times"); v != "" {
+		if times, err = strconv.Atoi(v); err != nil || times < 1 || times > maxFailTimes {
+			http.Error(w, fmt.Sprintf("times must be between 1 and %d", maxFailTimes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	path := r.FormValue("path")
+	if !strings.HasPrefix(path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
+
+	s.Fail(path, status, times, r.FormValue("body"))
+}
+
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// newUserCode returns a code like "BDFH-KLMN" from letters that are hard to
+// mistype (RFC 8628, section 6.1).
+func newUserCode() string {
+	const alphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return fmt.Sprintf("%s-%s", b[:4], b[4:])
+}
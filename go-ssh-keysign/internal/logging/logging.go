@@ -1,12 +1,19 @@
 package logging
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/service/paths"
 )
 
 type (
@@ -22,15 +29,30 @@ const (
 )
 
 const (
-	LStdErr LogDestination = "stderr"
-	LStdOut LogDestination = "stdout"
-	LFile   LogDestination = "file"
+	LStdErr   LogDestination = "stderr"
+	LStdOut   LogDestination = "stdout"
+	LFile     LogDestination = "file"
+	LSyslog   LogDestination = "syslog"
+	LJournald LogDestination = "journald"
 )
 
 type Logging struct {
 	Level       LogLevel
 	Destination LogDestination
-	Sample      bool
+	// File is written with Destination file, see DefaultFile.
+	File     string
+	Rotation Rotation
+	// Socket is the syslog or journald socket, empty for the system's.
+	Socket   string
+	Sampling Sampling
+}
+
+// Sampling keeps a burst of repeated entries from flooding the log: of the
+// entries with the same level and message within a second, the first First
+// are logged and then every Thereafter-th. First 0 logs every entry.
+type Sampling struct {
+	First      int
+	Thereafter int
 }
 
 func ParseLogLevel(s string) (LogLevel, error) {
@@ -56,8 +78,12 @@ func ParseLogDestination(s string) (LogDestination, error) {
 		return LStdOut, nil
 	case "file":
 		return LFile, nil
+	case "syslog":
+		return LSyslog, nil
+	case "journald":
+		return LJournald, nil
 	default:
-		return "", fmt.Errorf("invalid log destination: %q (expected stderr|stdout|file)", s)
+		return "", fmt.Errorf("invalid log destination: %q (expected stderr|stdout|file|syslog|journald)", s)
 	}
 }
 
@@ -89,30 +115,65 @@ func Build(o Logging) (logger *zap.Logger, cleanup func() error, err error) {
 	}
 	atom := zap.NewAtomicLevelAt(lvl)
 
-	var ws zapcore.WriteSyncer
+	var (
+		core   zapcore.Core
+		closer io.Closer
+	)
 	switch o.Destination {
 	case LStdErr:
-		ws = zapcore.AddSync(os.Stderr)
+		core = zapcore.NewCore(enc, zapcore.AddSync(os.Stderr), atom)
 	case LStdOut:
-		ws = zapcore.AddSync(os.Stdout)
+		core = zapcore.NewCore(enc, zapcore.AddSync(os.Stdout), atom)
 	case LFile:
-		path := "/var/log/ssh-keysign.log"
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		path := o.File
+		if path == "" {
+			if path, err = DefaultFile(); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		f, err := openRotating(path, o.Rotation)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot open log file %q, set another with --log-file: %w", path, err)
+		}
+		core, closer = zapcore.NewCore(enc, f, atom), f
+	case LSyslog, LJournald:
+		sc, err := newSocketCore(o.Destination, o.Socket, atom)
 		if err != nil {
 			return nil, nil, err
 		}
-		ws = zapcore.AddSync(f)
+		core, closer = sc, sc.conn
 	}
 
-	core := zapcore.NewCore(enc, ws, atom)
-	if o.Sample {
-		core = zapcore.NewSamplerWithOptions(core, 100, 10, 100)
+	core = NewRedactingCore(core)
+
+	// outside the redaction, the sampler decides in Check
+	if o.Sampling.First > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, o.Sampling.First, o.Sampling.Thereafter)
 	}
 
 	logger = zap.New(core, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel))
 	cleanup = func() error {
 		err := logger.Sync()
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
 		return err
 	}
 	return logger, cleanup, nil
 }
+
+// DefaultFile is /var/log/ssh-keysign.log for root, which the host command
+// usually runs as, and ssh-keysign.log in the user's state directory
+// otherwise.
+func DefaultFile() (string, error) {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/var/log", constants.AppName+".log"), nil
+	}
+
+	dir, err := paths.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, constants.AppName+".log"), nil
+}
@@ -0,0 +1,177 @@
+package logging_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"binarycodes/ssh-keysign/internal/logging"
+)
+
+func TestBuild_FileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "ssh-keysign.log")
+
+	logger, cleanup, err := logging.Build(logging.Logging{
+		Level:       logging.LInfo,
+		Destination: logging.LFile,
+		File:        path,
+		Rotation:    logging.Rotation{MaxSize: 400, MaxBackups: 2},
+	})
+	require.NoError(t, err)
+
+	for i := range 20 {
+		logger.Info("signed", zap.Int("serial", i))
+	}
+	require.NoError(t, cleanup())
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(400), p)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), p)
+	}
+	assert.NoFileExists(t, path+".3")
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(current), `"serial":19`)
+}
+
+func TestBuild_FileRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh-keysign.log")
+	old := `{"level":"info","ts":"` + time.Now().Add(-48*time.Hour).Format("2006-01-02T15:04:05.000Z0700") + `","msg":"old"}` + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(old), 0o600))
+
+	logger, cleanup, err := logging.Build(logging.Logging{
+		Level:       logging.LInfo,
+		Destination: logging.LFile,
+		File:        path,
+		Rotation:    logging.Rotation{MaxAge: 24 * time.Hour, MaxBackups: 1},
+	})
+	require.NoError(t, err)
+
+	logger.Info("new")
+	logger.Info("newer")
+	require.NoError(t, cleanup())
+
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, old, string(rotated))
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(current), "\n"))
+	assert.NotContains(t, string(current), `"msg":"old"`)
+}
+
+func TestBuild_Sampling(t *testing.T) {
+	for _, tc := range []struct {
+		sampling logging.Sampling
+		want     int
+	}{
+		{logging.Sampling{}, 5},
+		{logging.Sampling{First: 2, Thereafter: 2}, 3},
+	} {
+		path := filepath.Join(t.TempDir(), "ssh-keysign.log")
+
+		logger, cleanup, err := logging.Build(logging.Logging{
+			Level:       logging.LInfo,
+			Destination: logging.LFile,
+			File:        path,
+			Sampling:    tc.sampling,
+		})
+		require.NoError(t, err)
+
+		for range 5 {
+			logger.Info("retrying request")
+		}
+		require.NoError(t, cleanup())
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, strings.Count(string(b), "\n"), "%+v", tc.sampling)
+	}
+}
+
+func TestBuild_Journald(t *testing.T) {
+	socket, received := listenUnixgram(t)
+
+	logger, cleanup, err := logging.Build(logging.Logging{
+		Level:       logging.LWarn,
+		Destination: logging.LJournald,
+		Socket:      socket,
+	})
+	require.NoError(t, err)
+
+	logger.Info("not logged")
+	logger.With(zap.String("command", "ssh-keysign user")).Warn("setting is locked",
+		zap.String("locked-in", "/etc/ssh-keysign/config.yml"),
+		zap.String("hint", "first\nsecond"),
+	)
+	require.NoError(t, cleanup())
+
+	msg := <-received
+	assert.Contains(t, msg, "MESSAGE=setting is locked\n")
+	assert.Contains(t, msg, "PRIORITY=4\n")
+	assert.Contains(t, msg, "SYSLOG_IDENTIFIER=ssh-keysign\n")
+	assert.Contains(t, msg, "COMMAND=ssh-keysign user\n")
+	assert.Contains(t, msg, "LOCKED_IN=/etc/ssh-keysign/config.yml\n")
+	// a value with a newline is length-prefixed
+	assert.Contains(t, msg, "HINT\n\x0c\x00\x00\x00\x00\x00\x00\x00first\nsecond\n")
+	assert.Empty(t, received)
+}
+
+func TestBuild_Syslog(t *testing.T) {
+	socket, received := listenUnixgram(t)
+
+	logger, cleanup, err := logging.Build(logging.Logging{
+		Level:       logging.LWarn,
+		Destination: logging.LSyslog,
+		Socket:      socket,
+	})
+	require.NoError(t, err)
+
+	logger.Warn("setting is locked", zap.String("key", "ca-server-url"))
+	require.NoError(t, cleanup())
+
+	assert.Regexp(t, `^<12>\w{3} [ \d]\d \d\d:\d\d:\d\d ssh-keysign\[\d+\]: @cee:\{.*"msg":"setting is locked","key":"ca-server-url"\}$`, <-received)
+}
+
+func TestBuild_SyslogWithoutSocketFails(t *testing.T) {
+	_, _, err := logging.Build(logging.Logging{
+		Level:       logging.LWarn,
+		Destination: logging.LSyslog,
+		Socket:      filepath.Join(t.TempDir(), "missing.sock"),
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot connect to syslog")
+}
+
+func listenUnixgram(t *testing.T) (string, chan string) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenPacket("unixgram", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	received := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+	return socket, received
+}
@@ -30,12 +30,13 @@ func NewPrinter(w io.Writer, level int) *Printer {
 	return &Printer{Writer: w, level: v}
 }
 
+// Printf and Println mask secrets like the logger does, see Redact.
 func (p *Printer) Printf(format string, args ...any) {
-	fmt.Fprintf(p.Writer, format, args...)
+	fmt.Fprint(p.Writer, Redact(fmt.Sprintf(format, args...)))
 }
 
 func (p *Printer) Println(format string) {
-	fmt.Fprintln(p.Writer, format)
+	fmt.Fprintln(p.Writer, Redact(format))
 }
 
 func (p *Printer) V(l Verbosity) *conditional {
@@ -49,12 +50,12 @@ type conditional struct {
 
 func (c *conditional) Printf(format string, args ...any) {
 	if c.printer.level >= c.need {
-		fmt.Fprintf(c.printer.Writer, format, args...)
+		c.printer.Printf(format, args...)
 	}
 }
 
 func (c *conditional) Println(format string) {
 	if c.printer.level >= c.need {
-		fmt.Fprintln(c.printer.Writer, format)
+		c.printer.Println(format)
 	}
 }
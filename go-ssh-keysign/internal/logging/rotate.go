@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Rotation limits the log file. Once it would grow beyond MaxSize bytes or
+// its first entry is older than MaxAge it is moved to FILE.1, FILE.1 to
+// FILE.2 and so on, keeping MaxBackups of them. Zero disables a limit.
+type Rotation struct {
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+}
+
+// rotatingFile is a zapcore.WriteSyncer. Every run opens it anew, so its age
+// comes from the first entry in it rather than from when it was opened.
+// Entries of another run writing at the same time may end up in the rotated
+// file, which is fine for a log.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	rot     Rotation
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+func openRotating(path string, rot Rotation) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{path: path, rot: rot}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	// entries name hosts, principals and URLs, they are not for everyone
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	r.f, r.size, r.started = f, info.Size(), firstEntryTime(r.path, info)
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+	return n, err
+}
+
+func (r *rotatingFile) due(n int64) bool {
+	if r.rot.MaxSize > 0 && r.size+n > r.rot.MaxSize {
+		return true
+	}
+	return r.rot.MaxAge > 0 && !r.started.IsZero() && time.Since(r.started) > r.rot.MaxAge
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.rot.MaxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	// the oldest backup is overwritten by the one before it
+	for i := r.rot.MaxBackups; i > 0; i-- {
+		from := r.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", r.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", r.path, i)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Sync()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// firstEntryTime reads the ts of the first entry, falling back to the
+// modification time for a file not written by Build.
+func firstEntryTime(path string, info fs.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Time{}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return info.ModTime()
+	}
+	defer func() { _ = f.Close() }()
+
+	line, _ := bufio.NewReader(f).ReadBytes('\n')
+
+	var entry struct {
+		TS string `json:"ts"`
+	}
+	if json.Unmarshal(line, &entry) != nil {
+		return info.ModTime()
+	}
+
+	ts, err := time.Parse("2006-01-02T15:04:05.000Z0700", entry.TS)
+	if err != nil {
+		return info.ModTime()
+	}
+	return ts
+}
@@ -0,0 +1,208 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"binarycodes/ssh-keysign/internal/constants"
+)
+
+var (
+	syslogSockets   = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	journaldSockets = []string{"/run/systemd/journal/socket"}
+)
+
+// facilityUser is the syslog facility of user-level messages.
+const facilityUser = 1 << 3
+
+// socketCore sends every entry as one datagram to the local syslog or
+// journald socket, both of which take the priority per entry rather than
+// per stream.
+type socketCore struct {
+	zapcore.LevelEnabler
+	conn   net.Conn
+	fields []zapcore.Field
+	encode func(zapcore.Entry, []zapcore.Field) ([]byte, error)
+}
+
+func newSocketCore(dest LogDestination, socket string, level zapcore.LevelEnabler) (*socketCore, error) {
+	candidates, encode := syslogSockets, syslogMessage()
+	if dest == LJournald {
+		candidates, encode = journaldSockets, journaldMessage
+	}
+	if socket != "" {
+		candidates = []string{socket}
+	}
+
+	var errs []error
+	for _, path := range candidates {
+		conn, err := net.Dial("unixgram", path)
+		if err == nil {
+			return &socketCore{LevelEnabler: level, conn: conn, encode: encode}, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("cannot connect to %s: %w", dest, errors.Join(errs...))
+}
+
+func (c *socketCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = append(slices.Clip(c.fields), fields...)
+	return &clone
+}
+
+func (c *socketCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *socketCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	msg, err := c.encode(ent, append(slices.Clip(c.fields), fields...))
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(msg)
+	return err
+}
+
+func (c *socketCore) Sync() error {
+	return nil
+}
+
+func priority(l zapcore.Level) int {
+	switch l {
+	case zap.DebugLevel:
+		return 7
+	case zap.InfoLevel:
+		return 6
+	case zap.WarnLevel:
+		return 4
+	case zap.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// syslogMessage formats entries the way log/syslog does for the local socket,
+// with the fields as JSON. The @cee: cookie tells rsyslog's mmjsonparse and
+// syslog-ng's json-parser to take them apart.
+func syslogMessage() func(zapcore.Entry, []zapcore.Field) ([]byte, error) {
+	encCfg := zap.NewProductionEncoderConfig()
+	// syslog records both
+	encCfg.TimeKey, encCfg.LevelKey = "", ""
+	enc := zapcore.NewJSONEncoder(encCfg)
+
+	tag := fmt.Sprintf("%s[%d]", constants.AppName, os.Getpid())
+
+	return func(ent zapcore.Entry, fields []zapcore.Field) ([]byte, error) {
+		buf, err := enc.EncodeEntry(ent, fields)
+		if err != nil {
+			return nil, err
+		}
+		defer buf.Free()
+
+		return fmt.Appendf(nil, "<%d>%s %s: @cee:%s",
+			facilityUser|priority(ent.Level), ent.Time.Format(time.Stamp), tag, bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+	}
+}
+
+// journaldMessage uses the native journal protocol, every zap field becomes a
+// journal field, e.g. locked-in is LOCKED_IN.
+func journaldMessage(ent zapcore.Entry, fields []zapcore.Field) ([]byte, error) {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", ent.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(priority(ent.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", constants.AppName)
+	if ent.Caller.Defined {
+		writeJournalField(&buf, "CODE_FILE", ent.Caller.File)
+		writeJournalField(&buf, "CODE_LINE", strconv.Itoa(ent.Caller.Line))
+		writeJournalField(&buf, "CODE_FUNC", ent.Caller.Function)
+	}
+	if ent.Stack != "" {
+		writeJournalField(&buf, "STACKTRACE", ent.Stack)
+	}
+
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	keys := make([]string, 0, len(enc.Fields))
+	for k := range enc.Fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		value, err := journalValue(enc.Fields[k])
+		if err != nil {
+			return nil, fmt.Errorf("log field %s: %w", k, err)
+		}
+		writeJournalField(&buf, journalFieldName(k), value)
+	}
+	return buf.Bytes(), nil
+}
+
+func journalValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case fmt.Stringer:
+		return v.String(), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// journalFieldName turns a zap key into a journal field name, which has only
+// upper case letters, digits and underscores and does not start with an
+// underscore, those are set by journald.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "F" + name
+	}
+	return name
+}
+
+// writeJournalField writes NAME=value, or for a value with a newline the name
+// and the length-prefixed value.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -11,9 +11,12 @@ import (
 	"binarycodes/ssh-keysign/internal/config"
 	"binarycodes/ssh-keysign/internal/ctxkeys"
 	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/transport"
 )
 
-type CACertClient struct{}
+type CACertClient struct {
+	HTTPClient *http.Client
+}
 
 func (CACertClient) hostSignURL(cfg config.OAuth) string {
 	return fmt.Sprintf("%s/rest/key/hostSign", cfg.ServerURL)
@@ -34,15 +37,17 @@ func (c CACertClient) IssueUserCert(ctx context.Context, u *service.UserCertRequ
 		return nil, apperror.ErrNet(err)
 	}
 
-	req, err := http.NewRequest("POST", c.userSignURL(u.OAuthConfig), postBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.userSignURL(u.OAuthConfig), bytes.NewReader(postBody.Bytes()))
 	if err != nil {
 		return nil, apperror.ErrNet(err)
 	}
+	// signing the same key again is safe, e.g. after a 502 from a proxy
+	req = transport.ReplaySafe(req, func() ([]byte, error) { return postBody.Bytes(), nil })
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", u.Token.AccessToken))
 
-	client := &http.Client{}
+	client := transport.OrDefault(c.HTTPClient)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -57,7 +62,7 @@ func (c CACertClient) IssueUserCert(ctx context.Context, u *service.UserCertRequ
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, apperror.ErrHTTP(resp)
+		return nil, signError(resp, signRequest.Principal)
 	}
 
 	signedResponse := &service.SignedResponse{}
@@ -79,15 +84,17 @@ func (c CACertClient) IssueHostCert(ctx context.Context, h *service.HostCertRequ
 		return nil, apperror.ErrNet(err)
 	}
 
-	req, err := http.NewRequest("POST", c.hostSignURL(h.OAuthConfig), postBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.hostSignURL(h.OAuthConfig), bytes.NewReader(postBody.Bytes()))
 	if err != nil {
 		return nil, apperror.ErrNet(err)
 	}
+	// signing the same key again is safe, e.g. after a 502 from a proxy
+	req = transport.ReplaySafe(req, func() ([]byte, error) { return postBody.Bytes(), nil })
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.Token.AccessToken))
 
-	client := &http.Client{}
+	client := transport.OrDefault(c.HTTPClient)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -102,7 +109,7 @@ func (c CACertClient) IssueHostCert(ctx context.Context, h *service.HostCertRequ
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, apperror.ErrHTTP(resp)
+		return nil, signError(resp, signRequest.Principal)
 	}
 
 	signedResponse := &service.SignedResponse{}
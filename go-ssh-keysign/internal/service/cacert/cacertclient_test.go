@@ -0,0 +1,131 @@
+package cacert_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/cacert"
+)
+
+func issueUserCert(t *testing.T, h http.HandlerFunc) error {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	_, err := cacert.CACertClient{}.IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig:  config.User{Principals: []string{"alice"}},
+		OAuthConfig: config.OAuth{ServerURL: srv.URL},
+		PubKey:      "ssh-ed25519 AAAA",
+		Token:       service.AccessToken{AccessToken: "token"},
+	})
+	return err
+}
+
+func TestIssueUserCert_ErrorMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		kind     apperror.Kind
+		contains string
+		hint     string
+	}{
+		{
+			name: "expired token",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="Jwt expired at 2026-10-19T04:00:00Z", error_uri="https://tools.ietf.org/html/rfc6750#section-3.1"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			kind:     apperror.KAuthExpired,
+			contains: "Jwt expired at",
+			hint:     "fresh one",
+		},
+		{
+			name: "principal mismatch",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			kind: apperror.KPrincipalNotAllowed,
+			hint: `principal "alice"`,
+		},
+		{
+			name: "insufficient scope",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				w.WriteHeader(http.StatusForbidden)
+			},
+			kind: apperror.KPrincipalNotAllowed,
+			hint: "--scopes",
+		},
+		{
+			name: "unparsable key",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+			},
+			kind: apperror.KKeyRejected,
+			hint: "ssh-keygen",
+		},
+		{
+			name: "problem json",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"type":"https://ca.example.test/problems/key-rejected","title":"Key rejected","status":403,"detail":"RSA keys shorter than 3072 bits are not accepted"}`))
+			},
+			kind:     apperror.KKeyRejected,
+			contains: "403 Key rejected: RSA keys shorter than 3072 bits are not accepted",
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"timestamp":"2026-10-19T04:00:00.000+00:00","status":500,"error":"Internal Server Error","path":"/rest/key/userSign"}`))
+			},
+			kind:     apperror.KServerError,
+			contains: "500 Internal Server Error",
+			hint:     "CA server logs",
+		},
+		{
+			name: "other status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte("no such endpoint"))
+			},
+			kind:     apperror.KHttp,
+			contains: "404 Not Found: no such endpoint",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := issueUserCert(t, tc.handler)
+			require.Error(t, err)
+			assert.Equal(t, tc.kind, apperror.KindOf(err))
+			assert.Contains(t, err.Error(), tc.contains)
+			assert.Contains(t, apperror.HintOf(err), tc.hint)
+			if tc.hint != "" {
+				assert.Contains(t, err.Error(), "[Hint: ")
+			}
+		})
+	}
+}
+
+func TestIssueUserCert_KindSurvivesOp(t *testing.T) {
+	err := issueUserCert(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	err = apperror.OpOr("sign user key", apperror.KNetwork, err)
+	assert.Equal(t, apperror.KKeyRejected, apperror.KindOf(err))
+	assert.Equal(t, 18, apperror.KindOf(err).ExitCode())
+	assert.Contains(t, apperror.HintOf(err), "ssh-keygen")
+}
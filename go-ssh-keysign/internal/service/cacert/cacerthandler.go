@@ -16,6 +16,7 @@ import (
 	"binarycodes/ssh-keysign/internal/ctxkeys"
 	"binarycodes/ssh-keysign/internal/logging"
 	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/paths"
 )
 
 const (
@@ -46,17 +47,22 @@ func (c CACertHandler) StoreUserCertFile(ctx context.Context, u *service.UserCer
 
 	p.V(logging.Verbose).Printf("writing certificate to %s\n", certSaveFilePath)
 
-	path, err = c.writeCertForKey(certSaveFilePath, u.SignedResponse)
+	path, err = c.writeCertForKey(ctx, certSaveFilePath, u.SignedResponse)
 	return false, path, err
 }
 
 func (c CACertHandler) StoreHostCertFile(ctx context.Context, h *service.HostCertHandlerConfig) (path string, err error) {
-	return c.writeCertForKey(h.CertSaveFilePath, h.SignedResponse)
+	return c.writeCertForKey(ctx, h.CertSaveFilePath, h.SignedResponse)
 }
 
-func (CACertHandler) writeCertForKey(keyfilePath string, s service.SignedResponse) (path string, err error) {
-	if err := os.WriteFile(keyfilePath, []byte(s.SignedPublicKey), defaultCertFileMode); err != nil {
-		return "", apperror.ErrFileSystem(fmt.Errorf("writing cert file %q: %w", path, err))
+func (CACertHandler) writeCertForKey(ctx context.Context, keyfilePath string, s service.SignedResponse) (path string, err error) {
+	// last point to back out, the rename below is not interrupted
+	if err := ctx.Err(); err != nil {
+		return "", apperror.ErrNet(err)
+	}
+
+	if err := paths.WriteFileAtomic(keyfilePath, []byte(s.SignedPublicKey), defaultCertFileMode); err != nil {
+		return "", apperror.ErrFileSystem(fmt.Errorf("writing cert file %q: %w", keyfilePath, err))
 	}
 
 	return keyfilePath, nil
@@ -65,11 +71,11 @@ func (CACertHandler) writeCertForKey(keyfilePath string, s service.SignedRespons
 func (CACertHandler) StoreKeyPair(privateFilePath string, k service.ED25519KeyPair) (err error) {
 	publicFilePath := fmt.Sprintf("%s.pub", privateFilePath)
 
-	if err := os.WriteFile(privateFilePath, k.PrivateKeyBytes, defaultPrivateFileMode); err != nil {
+	if err := paths.WriteFileAtomic(privateFilePath, k.PrivateKeyBytes, defaultPrivateFileMode); err != nil {
 		return apperror.ErrFileSystem(fmt.Errorf("writing cert file %q: %w", privateFilePath, err))
 	}
 
-	if err := os.WriteFile(publicFilePath, []byte(k.PublicKeyString), defaultPublicFileMode); err != nil {
+	if err := paths.WriteFileAtomic(publicFilePath, []byte(k.PublicKeyString), defaultPublicFileMode); err != nil {
 		return apperror.ErrFileSystem(fmt.Errorf("writing cert file %q: %w", publicFilePath, err))
 	}
 
@@ -79,12 +85,19 @@ func (CACertHandler) StoreKeyPair(privateFilePath string, k service.ED25519KeyPa
 func (CACertHandler) StoreUserCertAgent(ctx context.Context, u *service.UserCertHandlerConfig) error {
 	log := ctxkeys.LoggerFrom(ctx)
 
+	// the agent adds key and certificate in one request, do not start it
+	// once the run is canceled
+	if err := ctx.Err(); err != nil {
+		return apperror.ErrNet(err)
+	}
+
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if sock == "" {
 		return errors.New("SSH_AUTH_SOCK not set; is ssh-agent running?")
 	}
 
-	conn, err := net.Dial("unix", sock)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", sock)
 	if err != nil {
 		return fmt.Errorf("connect to ssh-agent: %w", err)
 	}
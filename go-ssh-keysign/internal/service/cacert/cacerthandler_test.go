@@ -0,0 +1,64 @@
+package cacert_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/cacert"
+)
+
+func TestStoreHostCertFile_ReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "id-cert.pub")
+	require.NoError(t, os.WriteFile(certPath, []byte("old"), 0o600))
+
+	path, err := cacert.CACertHandler{}.StoreHostCertFile(context.Background(), &service.HostCertHandlerConfig{
+		CertSaveFilePath: certPath,
+		SignedResponse:   service.SignedResponse{SignedPublicKey: "new"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, certPath, path)
+
+	b, err := os.ReadFile(certPath)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(b))
+
+	info, err := os.Stat(certPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestStoreHostCertFile_CanceledLeavesNothingBehind(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "id-cert.pub")
+	require.NoError(t, os.WriteFile(certPath, []byte("old"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cacert.CACertHandler{}.StoreHostCertFile(ctx, &service.HostCertHandlerConfig{
+		CertSaveFilePath: certPath,
+		SignedResponse:   service.SignedResponse{SignedPublicKey: "new"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, apperror.KCanceled, apperror.KindOf(err))
+
+	b, err := os.ReadFile(certPath)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(b))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
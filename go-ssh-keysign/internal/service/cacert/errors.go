@@ -0,0 +1,75 @@
+package cacert
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+)
+
+// Problem types a CA server may send in an application/problem+json body,
+// matched on the last path segment of the type URI.
+const (
+	problemTokenExpired        = "token-expired"
+	problemPrincipalNotAllowed = "principal-not-allowed"
+	problemKeyRejected         = "key-rejected"
+)
+
+// signError maps a failed sign response of the CA server to an error kind
+// and a hint on what to change.
+//
+// The server answers a missing, expired or foreign token through Spring
+// Security with a 401 and a Bearer invalid_token challenge. A token whose
+// subject differs from the requested principal gets a bare 401 from
+// KeyController.validateAuthentication, and a key it cannot sign a bare 400.
+func signError(resp *http.Response, principal string) error {
+	p := apperror.ReadProblem(resp)
+
+	switch problemKind(p) {
+	case problemTokenExpired:
+		return apperror.ErrAuthExpired(p,
+			"the CA server did not accept the access token; run the command again to get a fresh one, "+
+				"and check that the CA server trusts --issuer and expects this --audience")
+	case problemPrincipalNotAllowed:
+		if p.BearerError() == "insufficient_scope" {
+			return apperror.ErrPrincipalNotAllowed(p, "the access token lacks a scope the CA server requires; add it with --scopes")
+		}
+		return apperror.ErrPrincipalNotAllowed(p,
+			fmt.Sprintf("the CA server does not allow principal %q for this identity; "+
+				"use --principal with the name your token is issued for", principal))
+	case problemKeyRejected:
+		return apperror.ErrKeyRejected(p,
+			"the CA server could not sign the key; check it with ssh-keygen -l -f on the --key file "+
+				"and use a key type the CA accepts, e.g. ed25519")
+	}
+
+	if p.Status >= http.StatusInternalServerError {
+		return apperror.ErrServer(p, "the CA server failed to handle the request; try again later or check the CA server logs")
+	}
+
+	return apperror.ErrProblem(p)
+}
+
+func problemKind(p *apperror.Problem) string {
+	if p.Type != "" && p.Type != "about:blank" {
+		switch t := path.Base(p.Type); t {
+		case problemTokenExpired, problemPrincipalNotAllowed, problemKeyRejected:
+			return t
+		}
+	}
+
+	switch p.Status {
+	case http.StatusUnauthorized:
+		if p.WWWAuthenticate != "" {
+			return problemTokenExpired
+		}
+		return problemPrincipalNotAllowed
+	case http.StatusForbidden:
+		return problemPrincipalNotAllowed
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return problemKeyRejected
+	}
+
+	return ""
+}
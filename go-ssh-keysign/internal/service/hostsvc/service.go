@@ -23,6 +23,7 @@ func (HostService) SignHostKey(ctx context.Context, r *service.Runner) error {
 
 	cfg := r.Config
 	log.Info("host run",
+		zap.String("profile", cfg.Profile),
 		zap.String("key", cfg.Host.Key),
 		zap.Strings("principal", cfg.Host.Principals),
 		zap.Uint64("duration", cfg.Host.DurationSeconds),
@@ -40,6 +41,7 @@ func (HostService) SignHostKey(ctx context.Context, r *service.Runner) error {
 
 	keys := &service.Keys{
 		Filename:  cfg.Host.Key,
+		Profile:   cfg.Profile,
 		PublicKey: key,
 	}
 
@@ -49,19 +51,11 @@ func (HostService) SignHostKey(ctx context.Context, r *service.Runner) error {
 		zap.String("key", key),
 	)
 
-	p.V(logging.Verbose).Println("initiating connection to OAuth")
-
-	accessToken, err := r.OAuthClient.ClientCredentialLogin(ctx, cfg.OAuth)
+	accessToken, err := fetchAccessToken(ctx, r)
 	if err != nil {
-		return apperror.ErrAuth(err)
+		return err
 	}
 
-	p.V(logging.VeryVerbose).Println("received access token")
-	log.Info("auth token received",
-		zap.String("type", accessToken.TokenType),
-		zap.Uint64("expires_in", accessToken.ExpiresIn),
-	)
-
 	p.V(logging.Verbose).Println("initiating connection to CA server to sign public key")
 
 	signedResponse, err := r.CertClient.IssueHostCert(ctx, &service.HostCertRequestConfig{
@@ -71,7 +65,7 @@ func (HostService) SignHostKey(ctx context.Context, r *service.Runner) error {
 		Token:       *accessToken,
 	})
 	if err != nil {
-		return apperror.ErrNet(err)
+		return apperror.OpOr("sign host key", apperror.KNetwork, err)
 	}
 
 	p.V(logging.VeryVerbose).Println("received signed certificate")
@@ -100,3 +94,29 @@ func (HostService) SignHostKey(ctx context.Context, r *service.Runner) error {
 	p.V(logging.VeryVerbose).Println("done")
 	return nil
 }
+
+// fetchAccessToken logs in with the client credential grant. A Runner
+// without an OAuthClient signs locally and needs no token.
+func fetchAccessToken(ctx context.Context, r *service.Runner) (*service.AccessToken, error) {
+	log := ctxkeys.LoggerFrom(ctx)
+	p := ctxkeys.PrinterFrom(ctx)
+
+	if r.OAuthClient == nil {
+		return &service.AccessToken{}, nil
+	}
+
+	p.V(logging.Verbose).Println("initiating connection to OAuth")
+
+	accessToken, err := r.OAuthClient.ClientCredentialLogin(ctx, r.Config.OAuth)
+	if err != nil {
+		return nil, apperror.OpOr("client credential login", apperror.KAuth, err)
+	}
+
+	p.V(logging.VeryVerbose).Println("received access token")
+	log.Info("auth token received",
+		zap.String("type", accessToken.TokenType),
+		zap.Uint64("expires_in", accessToken.ExpiresIn),
+	)
+
+	return accessToken, nil
+}
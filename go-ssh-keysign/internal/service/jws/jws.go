@@ -0,0 +1,180 @@
+package jws
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Sign returns claims as a compact JWS signed with s (RFC 7515). The
+// algorithm follows from the key type.
+func Sign(s crypto.Signer, kid string, claims any) (string, error) {
+	alg, err := signingAlgorithm(s)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := json.Marshal(header{Alg: alg, Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := B64(h) + "." + B64(c)
+
+	sig, err := signJWS(s, []byte(signingInput))
+	if err != nil {
+		return "", apperror.ErrCert(fmt.Errorf("sign JWT: %w", err))
+	}
+
+	return signingInput + "." + B64(sig), nil
+}
+
+// LoadKey reads an unencrypted PEM or OpenSSH private key, e.g. an SSH host
+// key.
+func LoadKey(path string) (crypto.Signer, error) {
+	p, err := paths.NormalizePath(path)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(fmt.Errorf("read signing key: %w", err))
+	}
+
+	raw, err := ssh.ParseRawPrivateKey(b)
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, apperror.ErrCert(fmt.Errorf("signing key %q is passphrase protected", p))
+		}
+		return nil, apperror.ErrCert(fmt.Errorf("parse signing key %q: %w", p, err))
+	}
+
+	switch k := raw.(type) {
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case crypto.Signer:
+		return k, nil
+	default:
+		return nil, apperror.ErrCert(fmt.Errorf("unsupported signing key type %T", raw))
+	}
+}
+
+func signingAlgorithm(s crypto.Signer) (string, error) {
+	switch k := s.Public().(type) {
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+	}
+	return "", apperror.ErrCert(fmt.Errorf("unsupported signing key type %T", s.Public()))
+}
+
+func signJWS(s crypto.Signer, input []byte) ([]byte, error) {
+	switch k := s.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, input), nil
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		switch k.Curve {
+		case elliptic.P256():
+			d := sha256.Sum256(input)
+			digest = d[:]
+		case elliptic.P384():
+			d := sha512.Sum384(input)
+			digest = d[:]
+		default:
+			d := sha512.Sum512(input)
+			digest = d[:]
+		}
+
+		r, sv, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// JWS uses the fixed-size R || S encoding, not ASN.1 (RFC 7518, section 3.4)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		sv.FillBytes(sig[size:])
+		return sig, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s)
+	}
+}
+
+// Thumbprint computes the RFC 7638 thumbprint of the public key, which is
+// what identity providers commonly derive the kid of an imported key from.
+func Thumbprint(pub crypto.PublicKey) (string, error) {
+	var members string
+
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		members = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, B64(k))
+	case *rsa.PublicKey:
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, B64(big.NewInt(int64(k.E)).Bytes()), B64(k.N.Bytes()))
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, size)
+		y := make([]byte, size)
+		ecdh, err := k.ECDH()
+		if err != nil {
+			return "", err
+		}
+		point := ecdh.Bytes() // uncompressed: 0x04 || X || Y
+		copy(x, point[1:1+size])
+		copy(y, point[1+size:])
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Curve.Params().Name, B64(x), B64(y))
+	default:
+		return "", apperror.ErrCert(fmt.Errorf("unsupported signing key type %T", pub))
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return B64(sum[:]), nil
+}
+
+// B64 is the unpadded base64url encoding used throughout JOSE.
+func B64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
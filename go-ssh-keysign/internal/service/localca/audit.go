@@ -0,0 +1,84 @@
+package localca
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+const auditFileName = "local-ca-audit.jsonl"
+
+// auditRecord is one line of the audit log, written for every certificate
+// the local CA issues.
+type auditRecord struct {
+	Time           time.Time `json:"time"`
+	Type           string    `json:"type"`
+	KeyID          string    `json:"key_id"`
+	Serial         uint64    `json:"serial"`
+	Principals     []string  `json:"principals"`
+	ValidAfter     time.Time `json:"valid_after"`
+	ValidBefore    time.Time `json:"valid_before"`
+	KeyFingerprint string    `json:"key_fingerprint"`
+	CAFingerprint  string    `json:"ca_fingerprint"`
+	Hostname       string    `json:"hostname"`
+	IssuedBy       string    `json:"issued_by"`
+}
+
+func (c *LocalCAClient) auditLogPath() (string, error) {
+	if c.Config.AuditLog != "" {
+		p, err := paths.NormalizePath(c.Config.AuditLog)
+		if err != nil {
+			return "", apperror.ErrFileSystem(err)
+		}
+		return p, nil
+	}
+
+	dir, err := paths.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, auditFileName), nil
+}
+
+func (c *LocalCAClient) audit(rec auditRecord) error {
+	path, err := c.auditLogPath()
+	if err != nil {
+		return err
+	}
+
+	rec.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		rec.IssuedBy = u.Username
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return apperror.ErrFileSystem(fmt.Errorf("create audit log directory: %w", err))
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return apperror.ErrFileSystem(fmt.Errorf("open audit log: %w", err))
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return apperror.ErrFileSystem(fmt.Errorf("write audit log %q: %w", path, err))
+	}
+
+	if err := f.Close(); err != nil {
+		return apperror.ErrFileSystem(fmt.Errorf("write audit log %q: %w", path, err))
+	}
+
+	return nil
+}
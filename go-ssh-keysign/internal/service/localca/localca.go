@@ -0,0 +1,247 @@
+package localca
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+// LocalCAClient is a service.CertClient that signs in-process with a CA
+// private key. It follows the policy of the CA server: only the requested
+// principal is signed, the serial is 0 and every certificate gets a unique
+// key ID. User certificates carry the configured extensions and
+// source-address restriction, host certificates neither.
+type LocalCAClient struct {
+	Config config.LocalCA
+	// Now is used for the validity window, time.Now when nil.
+	Now func() time.Time
+	// Prompt receives the passphrase prompt of a protected CA key, os.Stderr
+	// when nil.
+	Prompt io.Writer
+
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+func New(c config.LocalCA) *LocalCAClient {
+	return &LocalCAClient{Config: c}
+}
+
+func (c *LocalCAClient) IssueUserCert(ctx context.Context, u *service.UserCertRequestConfig) (*service.SignedResponse, error) {
+	return c.issue(ctx, ssh.UserCert, u.PubKey, u.UserConfig.Principals[0], u.UserConfig.DurationSeconds)
+}
+
+func (c *LocalCAClient) IssueHostCert(ctx context.Context, h *service.HostCertRequestConfig) (*service.SignedResponse, error) {
+	return c.issue(ctx, ssh.HostCert, h.PubKey, h.HostConfig.Principals[0], h.HostConfig.DurationSeconds)
+}
+
+func (c *LocalCAClient) issue(ctx context.Context, certType uint32, pubKey, principal string, durationSeconds uint64) (*service.SignedResponse, error) {
+	signer, err := c.loadSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, apperror.ErrKeyRejected(fmt.Errorf("parse public key: %w", err), "check the --key file with ssh-keygen -l -f")
+	}
+
+	if !supportedKeyType(pub.Type()) {
+		return nil, apperror.ErrKeyRejected(fmt.Errorf("unsupported key type %s", pub.Type()),
+			"use an ed25519, ecdsa or rsa key")
+	}
+
+	keyID, err := newKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+	validAfter := now().Truncate(time.Second)
+	validBefore := validAfter.Add(time.Duration(durationSeconds) * time.Second)
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          0,
+		CertType:        certType,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+
+	if certType == ssh.UserCert {
+		cert.Permissions = c.userPermissions()
+	}
+
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, apperror.ErrCert(fmt.Errorf("sign certificate: %w", err))
+	}
+
+	rec := auditRecord{
+		Time:           validAfter.UTC(),
+		Type:           certTypeName(certType),
+		KeyID:          keyID,
+		Serial:         cert.Serial,
+		Principals:     cert.ValidPrincipals,
+		ValidAfter:     validAfter.UTC(),
+		ValidBefore:    validBefore.UTC(),
+		KeyFingerprint: ssh.FingerprintSHA256(pub),
+		CAFingerprint:  ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+
+	// no certificate leaves without its audit record
+	if err := c.audit(rec); err != nil {
+		return nil, err
+	}
+
+	ctxkeys.LoggerFrom(ctx).Info("certificate issued by local CA",
+		zap.String("type", rec.Type),
+		zap.String("key_id", rec.KeyID),
+		zap.Strings("principals", rec.Principals),
+		zap.Time("valid_before", rec.ValidBefore),
+		zap.String("ca", rec.CAFingerprint),
+	)
+
+	signed := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(cert)), "\n")
+	if comment != "" {
+		signed += " " + comment
+	}
+
+	return &service.SignedResponse{SignedPublicKey: signed + "\n"}, nil
+}
+
+func (c *LocalCAClient) userPermissions() ssh.Permissions {
+	perms := ssh.Permissions{Extensions: map[string]string{}}
+
+	exts := slices.Clone(c.Config.Extensions)
+	slices.Sort(exts)
+	for _, e := range exts {
+		perms.Extensions[e] = ""
+	}
+
+	if len(c.Config.SourceAddresses) > 0 {
+		perms.CriticalOptions = map[string]string{"source-address": strings.Join(c.Config.SourceAddresses, ",")}
+	}
+
+	return perms
+}
+
+func (c *LocalCAClient) loadSigner() (ssh.Signer, error) {
+	c.once.Do(func() {
+		prompt := c.Prompt
+		if prompt == nil {
+			prompt = os.Stderr
+		}
+		c.signer, c.err = loadCAKey(c.Config.Key, c.Config.KeyPassphrase, prompt)
+	})
+	return c.signer, c.err
+}
+
+func loadCAKey(path, passphrase string, prompt io.Writer) (ssh.Signer, error) {
+	p, err := paths.NormalizePath(path)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(fmt.Errorf("read CA key: %w", err))
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(b)
+
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			signer, err = promptPassphrase(prompt, p, b)
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, apperror.ErrCert(fmt.Errorf("wrong passphrase for CA key %q", p))
+		}
+		return nil, apperror.ErrCert(fmt.Errorf("parse CA key %q: %w", p, err))
+	}
+
+	// never sign with SHA-1 RSA signatures, OpenSSH rejects them by default
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		as, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, apperror.ErrCert(errors.New("RSA CA key cannot produce rsa-sha2-512 signatures"))
+		}
+		if signer, err = ssh.NewSignerWithAlgorithms(as, []string{ssh.KeyAlgoRSASHA512}); err != nil {
+			return nil, apperror.ErrCert(err)
+		}
+	}
+
+	return signer, nil
+}
+
+func promptPassphrase(w io.Writer, path string, pemBytes []byte) (ssh.Signer, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, apperror.WithHint(apperror.ErrCert(fmt.Errorf("CA key %q is passphrase protected", path)),
+			"set --ca-key-passphrase, e.g. env:NAME or file:PATH")
+	}
+
+	_, _ = fmt.Fprintf(w, "Enter passphrase for CA key %s: ", path)
+	passphrase, err := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(w)
+	if err != nil {
+		return nil, apperror.ErrCert(fmt.Errorf("read passphrase: %w", err))
+	}
+
+	return ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+}
+
+func supportedKeyType(t string) bool {
+	switch t {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return true
+	default:
+		return false
+	}
+}
+
+func certTypeName(t uint32) string {
+	if t == ssh.HostCert {
+		return "host"
+	}
+	return "user"
+}
+
+func newKeyID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,175 @@
+package localca_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/localca"
+)
+
+func writeCAKey(t *testing.T, passphrase string) (path string, pub ssh.PublicKey) {
+	t.Helper()
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(sk, "ca", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(sk, "ca")
+	}
+	require.NoError(t, err)
+
+	path = filepath.Join(t.TempDir(), "ca")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+
+	pub, err = ssh.NewPublicKey(pk)
+	require.NoError(t, err)
+	return path, pub
+}
+
+func userPubKey(t *testing.T) string {
+	t.Helper()
+
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub, err := ssh.NewPublicKey(pk)
+	require.NoError(t, err)
+	return string(ssh.MarshalAuthorizedKey(pub))
+}
+
+func parseCert(t *testing.T, r *service.SignedResponse) *ssh.Certificate {
+	t.Helper()
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.SignedPublicKey))
+	require.NoError(t, err)
+	cert, ok := pub.(*ssh.Certificate)
+	require.True(t, ok)
+	return cert
+}
+
+func TestIssueUserCert(t *testing.T) {
+	caPath, caPub := writeCAKey(t, "")
+	audit := filepath.Join(t.TempDir(), "audit", "issued.jsonl")
+	now := time.Unix(1_800_000_000, 0)
+
+	c := localca.New(config.LocalCA{
+		Key:             caPath,
+		Extensions:      []string{"permit-pty", "permit-agent-forwarding"},
+		SourceAddresses: []string{"10.0.0.0/8", "192.168.1.1"},
+		AuditLog:        audit,
+	})
+	c.Now = func() time.Time { return now }
+
+	resp, err := c.IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"alice", "devops"}, DurationSeconds: 1800},
+		PubKey:     userPubKey(t),
+	})
+	require.NoError(t, err)
+
+	cert := parseCert(t, resp)
+	assert.Equal(t, uint32(ssh.UserCert), cert.CertType)
+	assert.Equal(t, []string{"alice"}, cert.ValidPrincipals)
+	assert.Equal(t, uint64(0), cert.Serial)
+	assert.Len(t, cert.KeyId, 32)
+	assert.Equal(t, uint64(now.Unix()), cert.ValidAfter)
+	assert.Equal(t, uint64(now.Add(30*time.Minute).Unix()), cert.ValidBefore)
+	assert.Equal(t, map[string]string{"permit-pty": "", "permit-agent-forwarding": ""}, cert.Extensions)
+	assert.Equal(t, "10.0.0.0/8,192.168.1.1", cert.CriticalOptions["source-address"])
+	assert.Equal(t, caPub.Marshal(), cert.SignatureKey.Marshal())
+
+	checker := ssh.CertChecker{Clock: func() time.Time { return now.Add(time.Minute) }}
+	require.NoError(t, checker.CheckCert("alice", cert))
+
+	f, err := os.Open(audit)
+	require.NoError(t, err)
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	require.True(t, sc.Scan())
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(sc.Bytes(), &rec))
+	assert.Equal(t, "user", rec["type"])
+	assert.Equal(t, cert.KeyId, rec["key_id"])
+	assert.Equal(t, ssh.FingerprintSHA256(caPub), rec["ca_fingerprint"])
+	assert.False(t, sc.Scan())
+
+	info, err := os.Stat(audit)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestIssueHostCert(t *testing.T) {
+	caPath, _ := writeCAKey(t, "s3cret")
+
+	c := localca.New(config.LocalCA{
+		Key:             caPath,
+		KeyPassphrase:   "s3cret",
+		Extensions:      []string{"permit-pty"},
+		SourceAddresses: []string{"10.0.0.0/8"},
+		AuditLog:        filepath.Join(t.TempDir(), "audit.jsonl"),
+	})
+
+	var ids []string
+	for range 2 {
+		resp, err := c.IssueHostCert(context.Background(), &service.HostCertRequestConfig{
+			HostConfig: config.Host{Principals: []string{"web.example.test"}, DurationSeconds: 3600},
+			PubKey:     userPubKey(t),
+		})
+		require.NoError(t, err)
+
+		cert := parseCert(t, resp)
+		assert.Equal(t, uint32(ssh.HostCert), cert.CertType)
+		assert.Equal(t, []string{"web.example.test"}, cert.ValidPrincipals)
+		assert.Empty(t, cert.Extensions)
+		assert.Empty(t, cert.CriticalOptions)
+		ids = append(ids, cert.KeyId)
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+}
+
+func TestIssue_PassphraseErrors(t *testing.T) {
+	caPath, _ := writeCAKey(t, "s3cret")
+	req := &service.HostCertRequestConfig{
+		HostConfig: config.Host{Principals: []string{"web"}, DurationSeconds: 60},
+		PubKey:     userPubKey(t),
+	}
+
+	_, err := localca.New(config.LocalCA{Key: caPath, KeyPassphrase: "wrong"}).IssueHostCert(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wrong passphrase")
+	assert.Equal(t, apperror.KCert, apperror.KindOf(err))
+
+	// tests do not run on a terminal, so there is nothing to prompt
+	_, err = localca.New(config.LocalCA{Key: caPath}).IssueHostCert(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, apperror.HintOf(err), "--ca-key-passphrase")
+	assert.Equal(t, apperror.KCert, apperror.KindOf(err))
+}
+
+func TestIssue_InvalidPublicKey(t *testing.T) {
+	caPath, _ := writeCAKey(t, "")
+
+	_, err := localca.New(config.LocalCA{Key: caPath, AuditLog: filepath.Join(t.TempDir(), "a")}).IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"alice"}, DurationSeconds: 60},
+		PubKey:     "not a key",
+	})
+	require.Error(t, err)
+	assert.Equal(t, apperror.KKeyRejected, apperror.KindOf(err))
+}
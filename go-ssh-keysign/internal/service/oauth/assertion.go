@@ -0,0 +1,84 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/service/jws"
+)
+
+const (
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = 60 * time.Second
+)
+
+// assertionClaims are the claims required by RFC 7523, section 3.
+type assertionClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	JWTID     string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expiry    int64  `json:"exp"`
+}
+
+// setClientAuth adds the client authentication parameters for the configured
+// method to a token endpoint request. audience is the token endpoint the
+// assertion is presented to.
+func setClientAuth(data url.Values, o config.OAuth, audience string) error {
+	data.Set("client_id", o.ClientID)
+
+	switch o.AuthMethod() {
+	case config.PrivateKeyJWT:
+		assertion, err := newClientAssertion(o, audience, time.Now())
+		if err != nil {
+			return err
+		}
+		data.Set("client_assertion_type", clientAssertionType)
+		data.Set("client_assertion", assertion)
+	case config.TLSClientAuth:
+		// the client is authenticated by its certificate (RFC 8705, section 2)
+	default:
+		if o.ClientSecret != "" {
+			data.Set("client_secret", o.ClientSecret)
+		}
+	}
+
+	return nil
+}
+
+// newClientAssertion builds a short-lived, single-use JWT signed with the
+// configured assertion key, see RFC 7523 and OpenID Connect Core section 9.
+func newClientAssertion(o config.OAuth, audience string, now time.Time) (string, error) {
+	signer, err := jws.LoadKey(o.ClientAssertionKey)
+	if err != nil {
+		return "", apperror.Op("client assertion key", err)
+	}
+
+	kid := o.ClientAssertionKID
+	if kid == "" {
+		if kid, err = jws.Thumbprint(signer.Public()); err != nil {
+			return "", err
+		}
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	return jws.Sign(signer, kid, assertionClaims{
+		Issuer:    o.ClientID,
+		Subject:   o.ClientID,
+		Audience:  audience,
+		JWTID:     hex.EncodeToString(jti),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(clientAssertionLifetime).Unix(),
+	})
+}
@@ -0,0 +1,132 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/config"
+)
+
+func writeKey(t *testing.T, key crypto.PrivateKey) string {
+	t.Helper()
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "assertion_key")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+	return path
+}
+
+func decodeSegment(t *testing.T, seg string, v any) {
+	t.Helper()
+
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, v))
+}
+
+func TestClientAssertion_SignsWithEachKeyType(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		key    crypto.PrivateKey
+		alg    string
+		verify func(input, sig []byte) bool
+	}{
+		{"ed25519", edKey, "EdDSA", func(input, sig []byte) bool {
+			return ed25519.Verify(edKey.Public().(ed25519.PublicKey), input, sig)
+		}},
+		{"ecdsa", ecKey, "ES256", func(input, sig []byte) bool {
+			digest := sha256.Sum256(input)
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			return len(sig) == 64 && ecdsa.Verify(&ecKey.PublicKey, digest[:], r, s)
+		}},
+		{"rsa", rsaKey, "RS256", func(input, sig []byte) bool {
+			digest := sha256.Sum256(input)
+			return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig) == nil
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := config.OAuth{
+				ClientID:           "host-client",
+				ClientAssertionKey: writeKey(t, tc.key),
+			}
+			now := time.Unix(1_700_000_000, 0)
+
+			jwt, err := newClientAssertion(o, "https://idp.example.test/token", now)
+			require.NoError(t, err)
+
+			parts := strings.Split(jwt, ".")
+			require.Len(t, parts, 3)
+
+			var header struct{ Alg, Kid string }
+			decodeSegment(t, parts[0], &header)
+			assert.Equal(t, tc.alg, header.Alg)
+			assert.NotEmpty(t, header.Kid)
+
+			var claims assertionClaims
+			decodeSegment(t, parts[1], &claims)
+			assert.Equal(t, "host-client", claims.Issuer)
+			assert.Equal(t, "host-client", claims.Subject)
+			assert.Equal(t, "https://idp.example.test/token", claims.Audience)
+			assert.Equal(t, now.Unix(), claims.IssuedAt)
+			assert.Equal(t, now.Add(clientAssertionLifetime).Unix(), claims.Expiry)
+			assert.Len(t, claims.JWTID, 32)
+
+			sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+			require.NoError(t, err)
+			assert.True(t, tc.verify([]byte(parts[0]+"."+parts[1]), sig))
+		})
+	}
+}
+
+func TestClientAssertion_UniqueJTI(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	o := config.OAuth{ClientID: "c", ClientAssertionKey: writeKey(t, edKey), ClientAssertionKID: "my-kid"}
+
+	first, second := url.Values{}, url.Values{}
+	require.NoError(t, setClientAuth(first, o, "https://idp/token"))
+	require.NoError(t, setClientAuth(second, o, "https://idp/token"))
+
+	assert.Equal(t, clientAssertionType, first.Get("client_assertion_type"))
+	assert.Empty(t, first.Get("client_secret"))
+
+	var a, b assertionClaims
+	var h struct{ Kid string }
+	decodeSegment(t, strings.Split(first.Get("client_assertion"), ".")[0], &h)
+	decodeSegment(t, strings.Split(first.Get("client_assertion"), ".")[1], &a)
+	decodeSegment(t, strings.Split(second.Get("client_assertion"), ".")[1], &b)
+	assert.Equal(t, "my-kid", h.Kid)
+	assert.NotEqual(t, a.JWTID, b.JWTID)
+}
@@ -1,25 +1,30 @@
 package oauth
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/mdp/qrterminal/v3"
 
 	"binarycodes/ssh-keysign/internal/apperror"
 	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/constants"
 	"binarycodes/ssh-keysign/internal/ctxkeys"
 	"binarycodes/ssh-keysign/internal/logging"
 	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/transport"
 )
 
-type CAAuthClient struct{}
+type CAAuthClient struct {
+	HTTPClient *http.Client
+	Backoff    *BackoffConfig
+}
 
 const (
 	clientCredentialGrant     = "client_credentials"
@@ -28,46 +33,170 @@ const (
 	deviceFlowLoginURLMessage = "browse to the below URL and enter the code [ %s ] to complete the login, alternatively, scan the QR code\n%s\n\n"
 )
 
-type AuthPendingError struct {
+// DeviceFlowError is the error response of the token endpoint while polling
+// during device flow (RFC 8628, section 3.5).
+type DeviceFlowError struct {
 	ErrorType        string `json:"error"`
 	ErrorDescription string `json:"error_description"`
 }
 
-type backoffConfig struct {
+func (e *DeviceFlowError) Error() string {
+	if e.ErrorDescription != "" {
+		return fmt.Sprintf("%s: %s", e.ErrorType, e.ErrorDescription)
+	}
+	return e.ErrorType
+}
+
+type pollState int
+
+const (
+	pollDone     pollState = iota // token received or unrecoverable error
+	pollPending                   // authorization_pending, keep polling
+	pollSlowDown                  // slow_down, keep polling with a longer interval
+)
+
+// RFC 8628, section 3.5
+const (
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errAccessDenied         = "access_denied"
+	errExpiredToken         = "expired_token"
+
+	defaultPollInterval = 5 * time.Second
+	slowDownIncrement   = 5 * time.Second
+)
+
+// classify maps a device flow error code to how polling should continue.
+func (e *DeviceFlowError) classify() (pollState, error) {
+	switch e.ErrorType {
+	case errAuthorizationPending:
+		return pollPending, apperror.ErrAuth(e)
+	case errSlowDown:
+		return pollSlowDown, apperror.ErrAuth(e)
+	case errAccessDenied:
+		return pollDone, apperror.ErrAuth(errors.New("device login was denied"))
+	case errExpiredToken:
+		return pollDone, apperror.ErrAuth(errors.New("device code expired before the login was approved, run the command again"))
+	default:
+		return pollDone, apperror.ErrAuth(fmt.Errorf("device flow failed: %w", e))
+	}
+}
+
+type BackoffConfig struct {
 	InitialDelay   time.Duration // starting delay when server gives no interval
 	MaxDelay       time.Duration // cap each sleep
 	MaxElapsedTime time.Duration // overall timeout
 	Factor         float64       // e.g. 2.0 for exponential
 }
 
-func DefaultBackoffConfig() backoffConfig {
-	return backoffConfig{
-		InitialDelay:   2 * time.Second,
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		InitialDelay:   defaultPollInterval,
 		MaxDelay:       30 * time.Second,
-		MaxElapsedTime: 2 * time.Minute,
+		MaxElapsedTime: constants.DefaultDeviceFlowTimeout,
 		Factor:         2.0,
 	}
 }
 
-func (CAAuthClient) ClientCredentialLogin(ctx context.Context, o config.OAuth) (aToken *service.AccessToken, err error) {
-	data := url.Values{}
-	data.Set("client_id", o.ClientID)
-	data.Set("client_secret", o.ClientSecret)
-	data.Set("grant_type", clientCredentialGrant)
+// backoff returns the polling policy for device flow: the client's Backoff
+// when set, otherwise the defaults, with the overall wait taken from
+// --device-flow-timeout when configured.
+func (c CAAuthClient) backoff(o config.OAuth) BackoffConfig {
+	bcfg := DefaultBackoffConfig()
+	if c.Backoff != nil {
+		bcfg = *c.Backoff
+	}
+
+	if o.DeviceFlowTimeout > 0 {
+		bcfg.MaxElapsedTime = o.DeviceFlowTimeout
+	}
+
+	return bcfg
+}
+
+// setTokenParams adds the requested scopes, audience and resource indicators
+// to a token or authorization request. defaultScopes apply when no scopes are
+// configured.
+func setTokenParams(data url.Values, o config.OAuth, defaultScopes ...string) {
+	scopes := o.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	if len(scopes) > 0 {
+		data.Set("scope", strings.Join(scopes, " "))
+	}
+
+	setResourceParams(data, o)
+}
+
+// setResourceParams adds the audience and RFC 8707 resource indicators, which
+// are repeated on the token request of multi-step flows.
+func setResourceParams(data url.Values, o config.OAuth) {
+	if o.Audience != "" {
+		data.Set("audience", o.Audience)
+	}
+
+	for _, r := range o.Resources {
+		data.Add("resource", r)
+	}
+}
+
+// tokenEndpointError classifies a failed IdP response: a rejected client or
+// grant is an auth failure, anything else keeps the HTTP kind.
+func tokenEndpointError(resp *http.Response) error {
+	err := apperror.ErrHTTP(resp)
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode < http.StatusInternalServerError &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return apperror.ErrAuth(err)
+	}
+	return err
+}
+
+// newTokenRequest builds a form POST to an IdP endpoint. form runs again for
+// every retry, so each attempt carries its own client assertion.
+func newTokenRequest(ctx context.Context, endpoint string, form func() (url.Values, error)) (*http.Request, error) {
+	data, err := form()
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest("POST", o.TokenURL, bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	return transport.ReplaySafe(req, func() ([]byte, error) {
+		data, err := form()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(data.Encode()), nil
+	}), nil
+}
+
+func (c CAAuthClient) ClientCredentialLogin(ctx context.Context, o config.OAuth) (aToken *service.AccessToken, err error) {
+	req, err := newTokenRequest(ctx, o.TokenURL, func() (url.Values, error) {
+		data := url.Values{}
+		if err := setClientAuth(data, o, o.TokenURL); err != nil {
+			return nil, err
+		}
+		data.Set("grant_type", clientCredentialGrant)
+		setTokenParams(data, o)
+		return data, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	client := transport.OrDefault(c.HTTPClient)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
 	log := ctxkeys.LoggerFrom(ctx)
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -76,7 +205,7 @@ func (CAAuthClient) ClientCredentialLogin(ctx context.Context, o config.OAuth) (
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, apperror.ErrHTTP(resp)
+		return nil, tokenEndpointError(resp)
 	}
 
 	accessToken := &service.AccessToken{}
@@ -88,15 +217,21 @@ func (CAAuthClient) ClientCredentialLogin(ctx context.Context, o config.OAuth) (
 }
 
 func (c CAAuthClient) DeviceFlowLogin(ctx context.Context, o config.OAuth) (aToken *service.AccessToken, err error) {
-	deviceStartResponse, err := c.startDeviceFlow(ctx, o)
+	var verifier, challenge string
+	if o.PKCE {
+		if verifier, challenge, err = newPKCE(); err != nil {
+			return nil, err
+		}
+	}
+
+	deviceStartResponse, err := c.startDeviceFlow(ctx, o, challenge)
 	if err != nil {
 		return nil, err
 	}
 
 	c.showDeviceFlowLoginDetails(ctx, deviceStartResponse)
 
-	backoffConfig := DefaultBackoffConfig()
-	aToken, err = c.retryPollForAuthToken(ctx, o, deviceStartResponse, backoffConfig)
+	aToken, err = c.retryPollForAuthToken(ctx, o, deviceStartResponse, verifier, c.backoff(o))
 	if err != nil {
 		return nil, err
 	}
@@ -104,23 +239,28 @@ func (c CAAuthClient) DeviceFlowLogin(ctx context.Context, o config.OAuth) (aTok
 	return aToken, nil
 }
 
-func (c CAAuthClient) startDeviceFlow(ctx context.Context, o config.OAuth) (aToken *service.DeviceFlowStartResponse, err error) {
-	data := url.Values{}
-	data.Set("client_id", o.ClientID)
-	data.Set("client_secret", o.ClientSecret)
-	data.Set("scope", openIDScope)
+func (c CAAuthClient) startDeviceFlow(ctx context.Context, o config.OAuth, codeChallenge string) (aToken *service.DeviceFlowStartResponse, err error) {
+	req, err := newTokenRequest(ctx, o.DeviceFlowURL, func() (url.Values, error) {
+		data := url.Values{}
+		if err := setClientAuth(data, o, o.TokenPollURL); err != nil {
+			return nil, err
+		}
+		setTokenParams(data, o, openIDScope)
 
-	req, err := http.NewRequest("POST", o.DeviceFlowURL, bytes.NewBufferString(data.Encode()))
+		if codeChallenge != "" {
+			data.Set("code_challenge", codeChallenge)
+			data.Set("code_challenge_method", codeChallengeMethodS256)
+		}
+		return data, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{}
+	client := transport.OrDefault(c.HTTPClient)
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, apperror.ErrNet(err)
 	}
 
 	log := ctxkeys.LoggerFrom(ctx)
@@ -131,7 +271,7 @@ func (c CAAuthClient) startDeviceFlow(ctx context.Context, o config.OAuth) (aTok
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, apperror.ErrHTTP(resp)
+		return nil, tokenEndpointError(resp)
 	}
 
 	deviceFlowResponse := &service.DeviceFlowStartResponse{}
@@ -155,24 +295,29 @@ func (c CAAuthClient) showDeviceFlowLoginDetails(ctx context.Context, d *service
 	qrterminal.GenerateWithConfig(d.VerificationURIComplete, qrCfg)
 }
 
-func (c CAAuthClient) pollForAuthToken(ctx context.Context, o config.OAuth, d *service.DeviceFlowStartResponse) (token *service.AccessToken, retry bool, err error) {
-	data := url.Values{}
-	data.Set("client_id", o.ClientID)
-	data.Set("client_secret", o.ClientSecret)
-	data.Set("grant_type", deviceGrant)
-	data.Set("device_code", d.DeviceCode)
+func (c CAAuthClient) pollForAuthToken(ctx context.Context, o config.OAuth, d *service.DeviceFlowStartResponse, codeVerifier string) (token *service.AccessToken, state pollState, err error) {
+	req, err := newTokenRequest(ctx, o.TokenPollURL, func() (url.Values, error) {
+		data := url.Values{}
+		if err := setClientAuth(data, o, o.TokenPollURL); err != nil {
+			return nil, err
+		}
+		data.Set("grant_type", deviceGrant)
+		data.Set("device_code", d.DeviceCode)
+		setResourceParams(data, o)
 
-	req, err := http.NewRequest("POST", o.TokenPollURL, bytes.NewBufferString(data.Encode()))
+		if codeVerifier != "" {
+			data.Set("code_verifier", codeVerifier)
+		}
+		return data, nil
+	})
 	if err != nil {
-		return nil, false, err
+		return nil, pollDone, err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{}
+	client := transport.OrDefault(c.HTTPClient)
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, false, err
+		return nil, pollDone, apperror.ErrNet(err)
 	}
 
 	log := ctxkeys.LoggerFrom(ctx)
@@ -183,76 +328,86 @@ func (c CAAuthClient) pollForAuthToken(ctx context.Context, o config.OAuth, d *s
 	}()
 
 	p := ctxkeys.PrinterFrom(ctx)
-	if resp.StatusCode == http.StatusBadRequest {
-		authPendingError := &AuthPendingError{}
-		if err := json.NewDecoder(resp.Body).Decode(authPendingError); err != nil {
-			return nil, false, err
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		deviceFlowError := &DeviceFlowError{}
+		if err := json.NewDecoder(resp.Body).Decode(deviceFlowError); err != nil || deviceFlowError.ErrorType == "" {
+			return nil, pollDone, apperror.ErrAuth(fmt.Errorf("unexpected device flow response, statuscode: %d", resp.StatusCode))
 		}
-		p.V(logging.VeryVerbose).Printf("%s\n", authPendingError.ErrorDescription)
-		return nil, true, apperror.ErrAuth(errors.New(authPendingError.ErrorDescription))
+		p.V(logging.VeryVerbose).Printf("%s\n", deviceFlowError)
+		state, err := deviceFlowError.classify()
+		return nil, state, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, false, apperror.ErrHTTP(resp)
+		return nil, pollDone, tokenEndpointError(resp)
 	}
 
 	accessToken := &service.AccessToken{}
 	if err := json.NewDecoder(resp.Body).Decode(accessToken); err != nil {
-		return nil, false, err
+		return nil, pollDone, err
 	}
 
-	return accessToken, false, nil
+	return accessToken, pollDone, nil
 }
 
-func (c CAAuthClient) retryPollForAuthToken(ctx context.Context, o config.OAuth, d *service.DeviceFlowStartResponse, bcfg backoffConfig) (*service.AccessToken, error) {
+func (c CAAuthClient) retryPollForAuthToken(ctx context.Context, o config.OAuth, d *service.DeviceFlowStartResponse, codeVerifier string, bcfg BackoffConfig) (*service.AccessToken, error) {
 	start := time.Now()
-	delay := max(bcfg.InitialDelay, time.Duration(d.Interval)*time.Second)
-
-	bcfg.MaxElapsedTime = min(bcfg.MaxElapsedTime, time.Duration(d.ExpiresIn)*time.Second)
-	bcfg.MaxDelay = max(bcfg.MaxDelay, time.Duration(d.Interval)*time.Second)
 
-	// first attempt happens immediately
-	aToken, retry, err := c.pollForAuthToken(ctx, o, d)
-	if err == nil {
-		return aToken, nil
+	// the server-provided interval is a floor for every sleep (RFC 8628, section 3.5)
+	interval := bcfg.InitialDelay
+	if d.Interval > 0 {
+		interval = time.Duration(d.Interval) * time.Second
 	}
+	delay := interval
 
-	if !retry {
-		return nil, err
+	codeExpiry := time.Duration(d.ExpiresIn) * time.Second
+	codeExpires := codeExpiry > 0 && (bcfg.MaxElapsedTime <= 0 || codeExpiry <= bcfg.MaxElapsedTime)
+	if codeExpires {
+		bcfg.MaxElapsedTime = codeExpiry
 	}
 
+	// first attempt happens immediately
+	aToken, state, err := c.pollForAuthToken(ctx, o, d, codeVerifier)
+
 	for {
+		switch state {
+		case pollDone:
+			if err != nil {
+				return nil, err
+			}
+			return aToken, nil
+		case pollSlowDown:
+			interval += slowDownIncrement
+			delay = max(delay, interval)
+		}
+
 		if bcfg.MaxElapsedTime > 0 && time.Since(start) >= bcfg.MaxElapsedTime {
-			return nil, apperror.ErrAuth(fmt.Errorf("timeout waiting for auth token after %s: %w", time.Since(start), err))
+			if codeExpires {
+				return nil, apperror.ErrAuth(fmt.Errorf("device code expired after %s before the login was approved, run the command again", time.Since(start).Round(time.Second)))
+			}
+			err = apperror.ErrAuth(fmt.Errorf("timeout waiting for auth token after %s: %w", time.Since(start).Round(time.Second), err))
+			return nil, apperror.WithHint(err, "increase --device-flow-timeout")
 		}
 
 		sleep := delay
-
-		if bcfg.MaxDelay > 0 && sleep > bcfg.MaxDelay {
-			sleep = bcfg.MaxDelay
+		if bcfg.MaxDelay > 0 {
+			sleep = min(sleep, max(bcfg.MaxDelay, interval))
 		}
 
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, apperror.ErrNet(ctx.Err())
 		case <-time.After(sleep):
 		}
 
 		// try again
-		aToken, retry, err = c.pollForAuthToken(ctx, o, d)
-		if err == nil {
-			return aToken, nil
-		}
-
-		if !retry {
-			return nil, err
-		}
+		aToken, state, err = c.pollForAuthToken(ctx, o, d, codeVerifier)
 
 		// include delay factor for next round
-		if bcfg.Factor > 1 {
+		if state == pollPending && bcfg.Factor > 1 {
 			next := time.Duration(float64(delay) * bcfg.Factor)
-			if bcfg.MaxDelay > 0 && next > bcfg.MaxDelay {
-				next = bcfg.MaxDelay
+			if bcfg.MaxDelay > 0 {
+				next = min(next, max(bcfg.MaxDelay, interval))
 			}
 			delay = next
 		}
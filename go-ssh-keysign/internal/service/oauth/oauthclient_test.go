@@ -0,0 +1,236 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/logging"
+	"binarycodes/ssh-keysign/internal/service"
+)
+
+// pollServer answers the first len(errs) polls with the given device flow
+// error codes and then issues a token.
+func pollServer(t *testing.T, errs ...string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var polls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(polls.Add(1))
+		if n <= len(errs) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(DeviceFlowError{ErrorType: errs[n-1]})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(service.AccessToken{AccessToken: "token", ExpiresIn: 60, TokenType: "Bearer"})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &polls
+}
+
+func pollContext() context.Context {
+	return ctxkeys.WithPrinter(context.Background(), logging.NewPrinter(io.Discard, 0))
+}
+
+func fastBackoff() BackoffConfig {
+	return BackoffConfig{InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, MaxElapsedTime: 5 * time.Second, Factor: 2}
+}
+
+func TestRetryPoll_PendingThenToken(t *testing.T) {
+	srv, polls := pollServer(t, errAuthorizationPending, errAuthorizationPending)
+
+	token, err := CAAuthClient{}.retryPollForAuthToken(pollContext(), config.OAuth{TokenPollURL: srv.URL},
+		&service.DeviceFlowStartResponse{DeviceCode: "dc"}, "", fastBackoff())
+
+	require.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	assert.Equal(t, int32(3), polls.Load())
+}
+
+func TestRetryPoll_FailsImmediately(t *testing.T) {
+	for _, code := range []string{errAccessDenied, errExpiredToken, "invalid_grant"} {
+		t.Run(code, func(t *testing.T) {
+			srv, polls := pollServer(t, errAuthorizationPending, code)
+
+			_, err := CAAuthClient{}.retryPollForAuthToken(pollContext(), config.OAuth{TokenPollURL: srv.URL},
+				&service.DeviceFlowStartResponse{DeviceCode: "dc"}, "", fastBackoff())
+
+			require.Error(t, err)
+			assert.Equal(t, apperror.KAuth, apperror.KindOf(err))
+			assert.Equal(t, int32(2), polls.Load())
+		})
+	}
+}
+
+func TestRetryPoll_SlowDownAddsFiveSeconds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the slow_down interval")
+	}
+
+	var polls []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls = append(polls, time.Now())
+		if len(polls) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(DeviceFlowError{ErrorType: errSlowDown})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(service.AccessToken{AccessToken: "token", ExpiresIn: 60, TokenType: "Bearer"})
+	}))
+	t.Cleanup(srv.Close)
+
+	bcfg := fastBackoff()
+	bcfg.MaxElapsedTime = 30 * time.Second
+
+	// the server asks for 1s, slow_down makes it 6s (RFC 8628, section 3.5)
+	token, err := CAAuthClient{}.retryPollForAuthToken(pollContext(), config.OAuth{TokenPollURL: srv.URL},
+		&service.DeviceFlowStartResponse{DeviceCode: "dc", Interval: 1}, "", bcfg)
+
+	require.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	require.Len(t, polls, 2)
+	assert.GreaterOrEqual(t, polls[1].Sub(polls[0]), 6*time.Second)
+}
+
+func TestRetryPoll_Timeout(t *testing.T) {
+	pending := make([]string, 1000)
+	for i := range pending {
+		pending[i] = errAuthorizationPending
+	}
+	srv, _ := pollServer(t, pending...)
+
+	bcfg := fastBackoff()
+	bcfg.MaxElapsedTime = 20 * time.Millisecond
+
+	_, err := CAAuthClient{}.retryPollForAuthToken(pollContext(), config.OAuth{TokenPollURL: srv.URL},
+		&service.DeviceFlowStartResponse{DeviceCode: "dc", ExpiresIn: 600}, "", bcfg)
+
+	require.Error(t, err)
+	assert.Contains(t, apperror.HintOf(err), "--device-flow-timeout")
+}
+
+func TestDeviceFlowError_Classify(t *testing.T) {
+	tests := map[string]pollState{
+		errAuthorizationPending: pollPending,
+		errSlowDown:             pollSlowDown,
+		errAccessDenied:         pollDone,
+		errExpiredToken:         pollDone,
+		"unsupported_grant":     pollDone,
+	}
+
+	for code, want := range tests {
+		state, err := (&DeviceFlowError{ErrorType: code}).classify()
+		assert.Equal(t, want, state, code)
+		assert.Equal(t, apperror.KAuth, apperror.KindOf(err), code)
+	}
+}
+
+func TestBackoff_TimeoutFromConfig(t *testing.T) {
+	assert.Equal(t, DefaultBackoffConfig(), CAAuthClient{}.backoff(config.OAuth{}))
+	assert.Equal(t, 10*time.Minute, CAAuthClient{}.backoff(config.OAuth{DeviceFlowTimeout: 10 * time.Minute}).MaxElapsedTime)
+}
+
+func TestDeviceFlowLogin_PublicClientWithPKCE(t *testing.T) {
+	var challenge string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		_, hasSecret := r.PostForm["client_secret"]
+		assert.False(t, hasSecret)
+		assert.Equal(t, codeChallengeMethodS256, r.PostForm.Get("code_challenge_method"))
+		challenge = r.PostForm.Get("code_challenge")
+		_ = json.NewEncoder(w).Encode(service.DeviceFlowStartResponse{DeviceCode: "dc", UserCode: "ABCD", ExpiresIn: 60, Interval: 1})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		assert.Equal(t, challenge, base64.RawURLEncoding.EncodeToString(sum[:]))
+		_ = json.NewEncoder(w).Encode(service.AccessToken{AccessToken: "token", ExpiresIn: 60, TokenType: "Bearer"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	token, err := CAAuthClient{}.DeviceFlowLogin(pollContext(), config.OAuth{
+		ClientID:      "public-cli",
+		DeviceFlowURL: srv.URL + "/device",
+		TokenPollURL:  srv.URL + "/token",
+		PKCE:          true,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	assert.NotEmpty(t, challenge)
+}
+
+func TestClientCredentialLogin_ScopesAudienceResource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, clientCredentialGrant, r.PostForm.Get("grant_type"))
+		assert.Equal(t, "openid ssh-sign", r.PostForm.Get("scope"))
+		assert.Equal(t, "ssh-key-signer", r.PostForm.Get("audience"))
+		assert.Equal(t, []string{"https://ca.example.test", "https://ca2.example.test"}, r.PostForm["resource"])
+		_ = json.NewEncoder(w).Encode(service.AccessToken{AccessToken: "token", ExpiresIn: 60, TokenType: "Bearer"})
+	}))
+	defer srv.Close()
+
+	token, err := CAAuthClient{}.ClientCredentialLogin(pollContext(), config.OAuth{
+		ClientID:     "host",
+		ClientSecret: "secret",
+		TokenURL:     srv.URL,
+		Scopes:       []string{"openid", "ssh-sign"},
+		Audience:     "ssh-key-signer",
+		Resources:    []string{"https://ca.example.test", "https://ca2.example.test"},
+	})
+
+	require.NoError(t, err)
+	// tokens without a scope field are accepted
+	assert.True(t, token.OK(pollContext()))
+}
+
+func TestClientCredentialLogin_NoScopeByDefault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		_, hasScope := r.PostForm["scope"]
+		assert.False(t, hasScope)
+		_ = json.NewEncoder(w).Encode(service.AccessToken{AccessToken: "token", ExpiresIn: 60, TokenType: "Bearer"})
+	}))
+	defer srv.Close()
+
+	_, err := CAAuthClient{}.ClientCredentialLogin(pollContext(), config.OAuth{ClientID: "host", ClientSecret: "secret", TokenURL: srv.URL})
+	require.NoError(t, err)
+}
+
+func TestRetryPoll_CanceledWhilePolling(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(pollContext())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := CAAuthClient{}.retryPollForAuthToken(ctx, config.OAuth{TokenPollURL: srv.URL},
+		&service.DeviceFlowStartResponse{DeviceCode: "dc"}, "", fastBackoff())
+
+	require.Error(t, err)
+	assert.Equal(t, apperror.KCanceled, apperror.KindOf(err))
+}
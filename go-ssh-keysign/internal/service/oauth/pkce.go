@@ -0,0 +1,23 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+
+	"binarycodes/ssh-keysign/internal/service/jws"
+)
+
+const codeChallengeMethodS256 = "S256"
+
+// newPKCE returns a fresh code verifier and its S256 code challenge
+// (RFC 7636, section 4).
+func newPKCE() (verifier, challenge string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	verifier = jws.B64(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, jws.B64(sum[:]), nil
+}
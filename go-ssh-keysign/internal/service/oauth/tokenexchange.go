@@ -0,0 +1,110 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/paths"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+// RFC 8693 token exchange identifiers.
+const (
+	tokenExchangeGrant      = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT            = "urn:ietf:params:oauth:token-type:jwt"
+	tokenTypeAccessToken    = "urn:ietf:params:oauth:token-type:access_token"
+	defaultSubjectTokenType = tokenTypeJWT
+)
+
+// TokenExchangeLogin trades an externally issued JWT, such as a CI ID token
+// or a projected Kubernetes service-account token, for an access token
+// accepted by the CA server (RFC 8693).
+func (c CAAuthClient) TokenExchangeLogin(ctx context.Context, o config.OAuth) (aToken *service.AccessToken, err error) {
+	subjectToken, err := readSubjectToken(o)
+	if err != nil {
+		return nil, err
+	}
+
+	subjectTokenType := o.SubjectTokenType
+	if subjectTokenType == "" {
+		subjectTokenType = defaultSubjectTokenType
+	}
+
+	req, err := newTokenRequest(ctx, o.TokenURL, func() (url.Values, error) {
+		data := url.Values{}
+		if err := setClientAuth(data, o, o.TokenURL); err != nil {
+			return nil, err
+		}
+		data.Set("grant_type", tokenExchangeGrant)
+		data.Set("subject_token", subjectToken)
+		data.Set("subject_token_type", subjectTokenType)
+		data.Set("requested_token_type", tokenTypeAccessToken)
+		setTokenParams(data, o)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := transport.OrDefault(c.HTTPClient)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	log := ctxkeys.LoggerFrom(ctx)
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, tokenEndpointError(resp)
+	}
+
+	accessToken := &service.AccessToken{}
+	if err := json.NewDecoder(resp.Body).Decode(accessToken); err != nil {
+		return nil, err
+	}
+
+	return accessToken, nil
+}
+
+func readSubjectToken(o config.OAuth) (string, error) {
+	if o.SubjectTokenEnv != "" {
+		token := strings.TrimSpace(os.Getenv(o.SubjectTokenEnv))
+		if token == "" {
+			return "", apperror.ErrAuth(fmt.Errorf("subject token environment variable %s is empty", o.SubjectTokenEnv))
+		}
+		return token, nil
+	}
+
+	p, err := paths.NormalizePath(o.SubjectTokenFile)
+	if err != nil {
+		return "", apperror.ErrFileSystem(err)
+	}
+
+	// projected tokens are rotated in place, so always read the current one
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", apperror.ErrFileSystem(fmt.Errorf("read subject token: %w", err))
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", apperror.ErrAuth(errors.New("subject token file is empty"))
+	}
+
+	return token, nil
+}
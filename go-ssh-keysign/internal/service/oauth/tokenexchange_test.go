@@ -0,0 +1,63 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/config"
+)
+
+func TestTokenExchangeLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, tokenExchangeGrant, r.PostForm.Get("grant_type"))
+		assert.Equal(t, "ci-id-token", r.PostForm.Get("subject_token"))
+		assert.Equal(t, tokenTypeJWT, r.PostForm.Get("subject_token_type"))
+		assert.Equal(t, tokenTypeAccessToken, r.PostForm.Get("requested_token_type"))
+		assert.Equal(t, "ci-client", r.PostForm.Get("client_id"))
+		_, hasSecret := r.PostForm["client_secret"]
+		assert.False(t, hasSecret)
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":      "exchanged",
+			"issued_token_type": tokenTypeAccessToken,
+			"token_type":        "Bearer",
+			"expires_in":        300,
+		})
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("ci-id-token\n"), 0o600))
+
+	token, err := CAAuthClient{}.TokenExchangeLogin(context.Background(), config.OAuth{
+		ClientID:         "ci-client",
+		TokenURL:         srv.URL,
+		SubjectTokenFile: tokenFile,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "exchanged", token.AccessToken)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, uint64(300), token.ExpiresIn)
+}
+
+func TestTokenExchangeLogin_EmptySubjectTokenEnvFails(t *testing.T) {
+	t.Setenv("CI_JOB_JWT", "")
+
+	_, err := CAAuthClient{}.TokenExchangeLogin(context.Background(), config.OAuth{
+		ClientID:        "ci-client",
+		TokenURL:        "http://127.0.0.1:0",
+		SubjectTokenEnv: "CI_JOB_JWT",
+	})
+
+	assert.ErrorContains(t, err, "CI_JOB_JWT is empty")
+}
@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service/paths"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+const wellKnownPath = "/.well-known/openid-configuration"
+
+// ProviderMetadata is the subset of the OpenID Provider Metadata
+// (OpenID Connect Discovery 1.0, section 3) that ssh-keysign uses.
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type cachedMetadata struct {
+	FetchedAt time.Time        `json:"fetched_at"`
+	Metadata  ProviderMetadata `json:"metadata"`
+}
+
+var memCache sync.Map // issuer -> *ProviderMetadata
+
+type Discovery struct {
+	HTTPClient *http.Client
+}
+
+// Resolve fills the endpoints left empty in o from the discovery document
+// of o.Issuer. Explicitly configured URLs always win. The token endpoint is
+// only copied into TokenURL when withTokenURL is set, because for the user
+// command a token URL selects the client-credential grant over device flow.
+func (d Discovery) Resolve(ctx context.Context, o config.OAuth, withTokenURL bool) (config.OAuth, error) {
+	if o.Issuer == "" {
+		return o, nil
+	}
+
+	m, err := d.Fetch(ctx, o.Issuer)
+	if err != nil {
+		return o, err
+	}
+
+	if withTokenURL && o.TokenURL == "" {
+		o.TokenURL = m.TokenEndpoint
+	}
+
+	if o.DeviceFlowURL == "" {
+		o.DeviceFlowURL = m.DeviceAuthorizationEndpoint
+	}
+
+	if o.TokenPollURL == "" {
+		o.TokenPollURL = m.TokenEndpoint
+	}
+
+	if o.JWKSURL == "" {
+		o.JWKSURL = m.JWKSURI
+	}
+
+	return o, nil
+}
+
+// Fetch returns the discovery document for issuer, served from the
+// in-process or on-disk cache while it is younger than
+// constants.DiscoveryCacheTTL. A stale cached copy is used as a fallback
+// when the provider cannot be reached.
+func (d Discovery) Fetch(ctx context.Context, issuer string) (*ProviderMetadata, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	log := ctxkeys.LoggerFrom(ctx)
+
+	if m, ok := memCache.Load(issuer); ok {
+		if md, ok := m.(*ProviderMetadata); ok {
+			return md, nil
+		}
+	}
+
+	cachePath, cacheErr := d.cacheFile(issuer)
+	cached, _ := d.readCache(cachePath)
+	if cached != nil && time.Since(cached.FetchedAt) < constants.DiscoveryCacheTTL {
+		memCache.Store(issuer, &cached.Metadata)
+		return &cached.Metadata, nil
+	}
+
+	m, err := d.download(ctx, issuer)
+	if err != nil {
+		if cached != nil {
+			log.Warn("using stale discovery document",
+				zap.String("issuer", issuer),
+				zap.Time("fetched_at", cached.FetchedAt),
+				zap.Error(err),
+			)
+			memCache.Store(issuer, &cached.Metadata)
+			return &cached.Metadata, nil
+		}
+		return nil, err
+	}
+
+	memCache.Store(issuer, m)
+
+	if cacheErr == nil {
+		if err := d.writeCache(cachePath, m); err != nil {
+			log.Warn("failed to cache discovery document", zap.String("path", cachePath), zap.Error(err))
+		}
+	}
+
+	return m, nil
+}
+
+func (d Discovery) download(ctx context.Context, issuer string) (*ProviderMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+wellKnownPath, http.NoBody)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	client := transport.OrDefault(d.HTTPClient)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	log := ctxkeys.LoggerFrom(ctx)
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apperror.ErrHTTP(resp)
+	}
+
+	m := &ProviderMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(m); err != nil {
+		return nil, apperror.ErrNet(fmt.Errorf("decode discovery document: %w", err))
+	}
+
+	// OpenID Connect Discovery 1.0, section 4.3
+	if strings.TrimSuffix(m.Issuer, "/") != issuer {
+		return nil, apperror.ErrAuth(fmt.Errorf("discovery document issuer %q does not match configured issuer %q", m.Issuer, issuer))
+	}
+
+	return m, nil
+}
+
+func (Discovery) cacheFile(issuer string) (string, error) {
+	dir, err := paths.CacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(issuer))
+	return filepath.Join(dir, "oidc", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+func (Discovery) readCache(path string) (*cachedMetadata, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cachedMetadata{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (Discovery) writeCache(path string, m *ProviderMetadata) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(cachedMetadata{FetchedAt: time.Now(), Metadata: *m})
+	if err != nil {
+		return err
+	}
+
+	return paths.WriteFileAtomic(path, b, 0o600)
+}
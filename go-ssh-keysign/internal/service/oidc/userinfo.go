@@ -0,0 +1,74 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+// Identity is the subset of the standard claims (OpenID Connect Core 1.0,
+// section 5.1) that tells who a token belongs to.
+type Identity struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+}
+
+// Principals returns the principal names the identity is likely to be
+// allowed, most likely first: the CA server signs for preferred_username,
+// falling back to sub.
+func (i Identity) Principals() []string {
+	var p []string
+	for _, name := range []string{i.PreferredUsername, strings.SplitN(i.Email, "@", 2)[0]} {
+		if name != "" && !slices.Contains(p, name) {
+			p = append(p, name)
+		}
+	}
+
+	if len(p) == 0 && i.Subject != "" {
+		p = append(p, i.Subject)
+	}
+	return p
+}
+
+// UserInfo asks the userinfo endpoint of the provider who accessToken
+// belongs to.
+func UserInfo(ctx context.Context, httpClient *http.Client, endpoint, accessToken string) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, http.NoBody)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := transport.OrDefault(httpClient).Do(req)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	log := ctxkeys.LoggerFrom(ctx)
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apperror.Op("userinfo", apperror.ErrHTTP(resp))
+	}
+
+	id := &Identity{}
+	if err := json.NewDecoder(resp.Body).Decode(id); err != nil {
+		return nil, apperror.ErrNet(fmt.Errorf("decode userinfo response: %w", err))
+	}
+
+	return id, nil
+}
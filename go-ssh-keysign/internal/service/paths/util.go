@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/constants"
 )
 
 func NormalizePath(p string) (string, error) {
@@ -30,8 +31,11 @@ func NormalizePath(p string) (string, error) {
 	return os.ExpandEnv(path), nil
 }
 
-// The parameter is expected to be an abolute file path
-func GetCertificateFilePath(fp string) (string, error) {
+// The parameter is expected to be an abolute file path. A profile other than
+// the default one gets its own certificate, <key>-<profile>-cert.pub, so
+// profiles do not overwrite each other's certificates. ssh only picks up
+// <key>-cert.pub by itself, the others need a CertificateFile entry.
+func GetCertificateFilePath(fp, profile string) (string, error) {
 	normalized, err := NormalizePath(fp)
 	if err != nil {
 		return "", apperror.ErrFileSystem(err)
@@ -43,6 +47,10 @@ func GetCertificateFilePath(fp string) (string, error) {
 
 	nameWithoutExtension := strings.TrimSuffix(basename, extension)
 
+	if profile != "" && profile != constants.DefaultProfile {
+		nameWithoutExtension += "-" + profile
+	}
+
 	certFileName := fmt.Sprintf("%s-cert%s", nameWithoutExtension, extension)
 	path, err := filepath.Abs(filepath.Join(dir, certFileName))
 	if err != nil {
@@ -51,3 +59,68 @@ func GetCertificateFilePath(fp string) (string, error) {
 
 	return path, nil
 }
+
+// CacheDir returns the per-user cache directory for the application,
+// honouring XDG_CACHE_HOME. The directory is not created.
+func CacheDir() (string, error) {
+	if cacheHome := os.Getenv("XDG_CACHE_HOME"); cacheHome != "" {
+		return filepath.Join(cacheHome, constants.AppName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return "", apperror.ErrFileSystem(fmt.Errorf("cannot determine cache directory: %w", err))
+	}
+
+	return filepath.Join(home, ".cache", constants.AppName), nil
+}
+
+// StateDir returns the per-user state directory for the application,
+// honouring XDG_STATE_HOME. The directory is not created.
+func StateDir() (string, error) {
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, constants.AppName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return "", apperror.ErrFileSystem(fmt.Errorf("cannot determine state directory: %w", err))
+	}
+
+	return filepath.Join(home, ".local", "state", constants.AppName), nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never see a partially written file and an
+// interrupted run leaves the previous content untouched.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,29 @@
+package paths_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+func TestGetCertificateFilePath_Profile(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    string
+	}{
+		{profile: "", want: "/keys/id_ed25519-cert.pub"},
+		{profile: "default", want: "/keys/id_ed25519-cert.pub"},
+		{profile: "staging", want: "/keys/id_ed25519-staging-cert.pub"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			got, err := paths.GetCertificateFilePath("/keys/id_ed25519.pub", tt.profile)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package stepca
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service/paths"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+// Bootstrap returns the path of the step-ca root certificate with the given
+// SHA-256 fingerprint, downloading it from GET /root/<fingerprint> on first
+// use like `step ca bootstrap` does. httpClient must not verify the server:
+// the fingerprint, not TLS, establishes trust in the downloaded root.
+//
+// The root is cached and checked against the fingerprint on every run.
+func Bootstrap(ctx context.Context, httpClient *http.Client, serverURL, fingerprint string) (string, error) {
+	log := ctxkeys.LoggerFrom(ctx)
+	fp := normalizeFingerprint(fingerprint)
+
+	dir, err := paths.CacheDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "step-ca", fp+".crt")
+
+	if b, err := os.ReadFile(path); err == nil {
+		if _, err := checkRoot(b, fp); err == nil {
+			return path, nil
+		}
+		log.Warn("cached step-ca root does not match the fingerprint, downloading it again", zap.String("path", path))
+	}
+
+	pemBytes, err := fetchRoot(ctx, httpClient, strings.TrimRight(serverURL, "/"), fp)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := checkRoot(pemBytes, fp)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", apperror.ErrFileSystem(err)
+	}
+	if err := paths.WriteFileAtomic(path, pemBytes, 0o644); err != nil {
+		return "", apperror.ErrFileSystem(err)
+	}
+
+	log.Info("bootstrapped step-ca root", zap.String("subject", root.Subject.String()), zap.String("path", path))
+	return path, nil
+}
+
+func fetchRoot(ctx context.Context, httpClient *http.Client, serverURL, fp string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/root/"+fp, http.NoBody)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	resp, err := transport.OrDefault(httpClient).Do(req)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	log := ctxkeys.LoggerFrom(ctx)
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apperror.Op("bootstrap step-ca root", apperror.ErrHTTP(resp))
+	}
+
+	var body struct {
+		CA string `json:"ca"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	return []byte(body.CA), nil
+}
+
+// checkRoot parses a PEM root certificate and compares the SHA-256 of its DER
+// encoding with fp.
+func checkRoot(pemBytes []byte, fp string) (*x509.Certificate, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, apperror.ErrCert(errors.New("step-ca root is not a PEM certificate"))
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+	if got := hex.EncodeToString(sum[:]); got != fp {
+		return nil, apperror.ErrCert(fmt.Errorf("step-ca root fingerprint %s does not match --step-root-fingerprint %s", got, fp))
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,34 @@
+package stepca
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+)
+
+// signError maps a failed /ssh/sign response. step-ca answers a token it
+// cannot verify, an expired or reused one with 401, and a request its
+// provisioner or policy does not allow with 403.
+func signError(resp *http.Response, c config.StepCA, principals []string) error {
+	p := apperror.ReadProblem(resp)
+
+	switch {
+	case p.Status == http.StatusUnauthorized:
+		if c.SignsOTT() {
+			return apperror.ErrAuthExpired(p, fmt.Sprintf("step-ca rejected the one-time token; check that provisioner %q has the key of --step-provisioner-key", c.Provisioner))
+		}
+		return apperror.ErrAuthExpired(p, "step-ca rejected the ID token; run the command again to get a fresh one, and check that the OIDC provisioner trusts this --client-id")
+	case p.Status == http.StatusForbidden:
+		return apperror.ErrPrincipalNotAllowed(p,
+			fmt.Sprintf("the step-ca provisioner or policy does not allow principals %q for this identity", strings.Join(principals, ",")))
+	case p.Status >= http.StatusInternalServerError:
+		return apperror.ErrServer(p, "step-ca failed to handle the request; try again later or check the step-ca logs")
+	case p.Status == http.StatusBadRequest && strings.Contains(strings.ToLower(p.Detail), "key"):
+		return apperror.ErrKeyRejected(p, "step-ca could not sign the key; use a key type its provisioner accepts, e.g. ed25519")
+	}
+
+	return apperror.ErrProblem(p)
+}
@@ -0,0 +1,82 @@
+package stepca
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/jws"
+)
+
+const ottLifetime = 5 * time.Minute
+
+// ottClaims are the claims a JWK provisioner checks, see step-ca's
+// provisioner.jwtPayload. The step.ssh claims bind the token to one
+// certificate; step-ca refuses a request that asks for anything else.
+type ottClaims struct {
+	Issuer    string     `json:"iss"`
+	Subject   string     `json:"sub"`
+	Audience  string     `json:"aud"`
+	JWTID     string     `json:"jti"`
+	IssuedAt  int64      `json:"iat"`
+	NotBefore int64      `json:"nbf"`
+	Expiry    int64      `json:"exp"`
+	SHA       string     `json:"sha,omitempty"`
+	Step      stepClaims `json:"step"`
+}
+
+type stepClaims struct {
+	SSH sshClaims `json:"ssh"`
+}
+
+type sshClaims struct {
+	CertType   string   `json:"certType"`
+	KeyID      string   `json:"keyID"`
+	Principals []string `json:"principals"`
+}
+
+// newOTT signs a one-time token for sr with the JWK provisioner key. The kid
+// defaults to the key's JWK thumbprint, which is how step-ca names the keys
+// of JWK provisioners.
+func (c StepCAClient) newOTT(sr signRequest) (string, error) {
+	signer, err := jws.LoadKey(c.Config.ProvisionerKey)
+	if err != nil {
+		return "", apperror.Op("step provisioner key", err)
+	}
+
+	kid := c.Config.ProvisionerKID
+	if kid == "" {
+		if kid, err = jws.Thumbprint(signer.Public()); err != nil {
+			return "", err
+		}
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return jws.Sign(signer, kid, ottClaims{
+		Issuer:    c.Config.Provisioner,
+		Subject:   sr.KeyID,
+		Audience:  c.ServerURL + "/1.0/ssh/sign",
+		JWTID:     hex.EncodeToString(jti),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(ottLifetime).Unix(),
+		SHA:       normalizeFingerprint(c.Config.RootFingerprint),
+		Step: stepClaims{SSH: sshClaims{
+			CertType:   sr.CertType,
+			KeyID:      sr.KeyID,
+			Principals: sr.Principals,
+		}},
+	})
+}
+
+// normalizeFingerprint accepts the hex fingerprint with or without colons.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
@@ -0,0 +1,182 @@
+package stepca
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+// StepCAClient is a service.CertClient for the /ssh/sign endpoint of a
+// smallstep step-ca at ca-server-url. Like Vault, step-ca signs every
+// requested principal its provisioner allows.
+type StepCAClient struct {
+	HTTPClient *http.Client
+	ServerURL  string
+	Config     config.StepCA
+}
+
+func New(httpClient *http.Client, serverURL string, c config.StepCA) StepCAClient {
+	return StepCAClient{HTTPClient: httpClient, ServerURL: strings.TrimRight(serverURL, "/"), Config: c}
+}
+
+// signRequest is step-ca's api.SSHSignRequest. The public key is sent in SSH
+// wire format, which encoding/json turns into base64.
+type signRequest struct {
+	PublicKey   []byte   `json:"publicKey"`
+	OTT         string   `json:"ott"`
+	CertType    string   `json:"certType"`
+	KeyID       string   `json:"keyID,omitempty"`
+	Principals  []string `json:"principals"`
+	ValidBefore string   `json:"validBefore,omitempty"`
+}
+
+// signResponse holds the certificate base64 encoded in SSH wire format.
+type signResponse struct {
+	Certificate string `json:"crt"`
+}
+
+func (c StepCAClient) IssueUserCert(ctx context.Context, u *service.UserCertRequestConfig) (*service.SignedResponse, error) {
+	return c.sign(ctx, ssh.UserCert, u.PubKey, u.UserConfig.Principals, u.UserConfig.DurationSeconds, u.Token)
+}
+
+func (c StepCAClient) IssueHostCert(ctx context.Context, h *service.HostCertRequestConfig) (*service.SignedResponse, error) {
+	return c.sign(ctx, ssh.HostCert, h.PubKey, h.HostConfig.Principals, h.HostConfig.DurationSeconds, h.Token)
+}
+
+func (c StepCAClient) sign(ctx context.Context, certType uint32, pubKey string, principals []string, durationSeconds uint64, token service.AccessToken) (*service.SignedResponse, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, apperror.ErrKeyRejected(fmt.Errorf("parse public key: %w", err), "check the --key file with ssh-keygen -l -f")
+	}
+
+	sr := signRequest{
+		PublicKey:  pub.Marshal(),
+		CertType:   certTypeName(certType),
+		Principals: principals,
+	}
+	if durationSeconds > 0 {
+		sr.ValidBefore = strconv.FormatUint(durationSeconds, 10) + "s"
+	}
+
+	if c.Config.SignsOTT() {
+		// the key ID must match the one in the token, which post signs
+		sr.KeyID = principals[0]
+	} else {
+		// an OIDC provisioner takes the ID token, the key ID is the email claim
+		sr.OTT = token.IDToken
+		if sr.OTT == "" {
+			sr.OTT = token.AccessToken
+		}
+	}
+
+	cert, err := c.post(ctx, sr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctxkeys.LoggerFrom(ctx).Info("certificate issued by step-ca",
+		zap.String("type", sr.CertType),
+		zap.Uint64("serial", cert.Serial),
+		zap.String("key_id", cert.KeyId),
+		zap.Strings("principals", cert.ValidPrincipals),
+	)
+
+	signed := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(cert)), "\n")
+	if comment != "" {
+		signed += " " + comment
+	}
+
+	return &service.SignedResponse{SignedPublicKey: signed + "\n"}, nil
+}
+
+// post sends sr to /ssh/sign. A token signed with the provisioner key is
+// signed again for every attempt, step-ca accepts each one only once.
+func (c StepCAClient) post(ctx context.Context, sr signRequest) (*ssh.Certificate, error) {
+	build := func() ([]byte, error) {
+		if c.Config.SignsOTT() {
+			ott, err := c.newOTT(sr)
+			if err != nil {
+				return nil, err
+			}
+			sr.OTT = ott
+		}
+
+		body, err := json.Marshal(sr)
+		if err != nil {
+			return nil, apperror.ErrNet(err)
+		}
+		return body, nil
+	}
+
+	body, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.ServerURL+"/ssh/sign", bytes.NewReader(body))
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = transport.ReplaySafe(req, build)
+
+	resp, err := transport.OrDefault(c.HTTPClient).Do(req)
+	if err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	log := ctxkeys.LoggerFrom(ctx)
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, signError(resp, c.Config, sr.Principals)
+	}
+
+	var out signResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, apperror.ErrNet(err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(out.Certificate)
+	if err != nil {
+		return nil, apperror.ErrCert(fmt.Errorf("decode step-ca certificate: %w", err))
+	}
+
+	pub, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return nil, apperror.ErrCert(fmt.Errorf("parse step-ca certificate: %w", err))
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, apperror.ErrCert(errors.New("step-ca returned a public key, not a certificate"))
+	}
+
+	return cert, nil
+}
+
+func certTypeName(t uint32) string {
+	if t == ssh.HostCert {
+		return "host"
+	}
+	return "user"
+}
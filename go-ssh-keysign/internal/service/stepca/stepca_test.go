@@ -0,0 +1,287 @@
+package stepca_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/stepca"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+// fakeStepCA signs every /ssh/sign request with its own CA key after handing
+// the request and its decoded OTT to check.
+type fakeStepCA struct {
+	*httptest.Server
+
+	ca    ssh.Signer
+	check func(req map[string]any, ott []string) int
+}
+
+func newFakeStepCA(t *testing.T) *fakeStepCA {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	f := &fakeStepCA{ca: ca}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /root/{sha}", func(w http.ResponseWriter, r *http.Request) {
+		root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw})
+		_ = json.NewEncoder(w).Encode(map[string]string{"ca": string(root)})
+	})
+
+	mux.HandleFunc("POST /ssh/sign", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		if f.check != nil {
+			if status := f.check(req, strings.Split(req["ott"].(string), ".")); status != 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				_, _ = fmt.Fprintf(w, `{"status":%d,"message":"not allowed"}`, status)
+				return
+			}
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(req["publicKey"].(string))
+		require.NoError(t, err)
+		pub, err := ssh.ParsePublicKey(raw)
+		require.NoError(t, err)
+
+		var principals []string
+		for _, p := range req["principals"].([]any) {
+			principals = append(principals, p.(string))
+		}
+
+		cert := &ssh.Certificate{
+			Key:             pub,
+			CertType:        ssh.UserCert,
+			KeyId:           "step",
+			ValidPrincipals: principals,
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		require.NoError(t, cert.SignCert(rand.Reader, f.ca))
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"crt": base64.StdEncoding.EncodeToString(cert.Marshal())})
+	})
+
+	f.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeStepCA) fingerprint() string {
+	sum := sha256.Sum256(f.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func userKey(t *testing.T) string {
+	t.Helper()
+
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub, err := ssh.NewPublicKey(pk)
+	require.NoError(t, err)
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " alice@laptop"
+}
+
+func decodeSegment(t *testing.T, seg string, v any) {
+	t.Helper()
+
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, v))
+}
+
+func TestIssueUserCert_JWKProvisionerOTT(t *testing.T) {
+	f := newFakeStepCA(t)
+
+	provPub, provKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(provKey, "")
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "provisioner")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600))
+
+	f.check = func(req map[string]any, ott []string) int {
+		require.Len(t, ott, 3)
+		sig, err := base64.RawURLEncoding.DecodeString(ott[2])
+		require.NoError(t, err)
+		assert.True(t, ed25519.Verify(provPub, []byte(ott[0]+"."+ott[1]), sig))
+
+		var claims struct {
+			Iss, Sub, Aud, SHA string
+			Step               struct {
+				SSH struct {
+					CertType, KeyID string
+					Principals      []string
+				}
+			}
+		}
+		decodeSegment(t, ott[1], &claims)
+		assert.Equal(t, "ops@example.test", claims.Iss)
+		assert.Equal(t, "alice", claims.Sub)
+		assert.Equal(t, f.URL+"/1.0/ssh/sign", claims.Aud)
+		assert.Equal(t, f.fingerprint(), claims.SHA)
+		assert.Equal(t, "user", claims.Step.SSH.CertType)
+		assert.Equal(t, []string{"alice", "devops"}, claims.Step.SSH.Principals)
+
+		assert.Equal(t, "alice", req["keyID"])
+		assert.Equal(t, "3600s", req["validBefore"])
+		return 0
+	}
+
+	c := stepca.New(f.Client(), f.URL+"/", config.StepCA{
+		CAServerType:    config.CAServerStepCA,
+		RootFingerprint: strings.ToUpper(f.fingerprint()),
+		Provisioner:     "ops@example.test",
+		ProvisionerKey:  keyPath,
+	})
+
+	resp, err := c.IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"alice", "devops"}, DurationSeconds: 3600},
+		PubKey:     userKey(t),
+	})
+	require.NoError(t, err)
+
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.SignedPublicKey))
+	require.NoError(t, err)
+	cert, ok := pub.(*ssh.Certificate)
+	require.True(t, ok)
+	assert.Equal(t, []string{"alice", "devops"}, cert.ValidPrincipals)
+	assert.Equal(t, "alice@laptop", comment)
+}
+
+func TestIssueUserCert_RetrySignsNewOTT(t *testing.T) {
+	f := newFakeStepCA(t)
+
+	_, provKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(provKey, "")
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "provisioner")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600))
+
+	var otts []string
+	f.check = func(req map[string]any, _ []string) int {
+		otts = append(otts, req["ott"].(string))
+		if len(otts) == 1 {
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+
+	client, err := transport.New(transport.Options{InsecureSkipVerify: true, Retries: 2, RetryMaxTime: 5 * time.Second, RetryBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+
+	c := stepca.New(client, f.URL, config.StepCA{
+		CAServerType:   config.CAServerStepCA,
+		Provisioner:    "ops@example.test",
+		ProvisionerKey: keyPath,
+	})
+
+	_, err = c.IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"alice"}},
+		PubKey:     userKey(t),
+	})
+	require.NoError(t, err)
+	require.Len(t, otts, 2)
+	assert.NotEqual(t, otts[0], otts[1])
+}
+
+func TestIssueUserCert_OIDCProvisionerUsesIDToken(t *testing.T) {
+	f := newFakeStepCA(t)
+
+	f.check = func(req map[string]any, ott []string) int {
+		assert.Equal(t, "id.token.jwt", req["ott"])
+		assert.NotContains(t, req, "keyID")
+		return 0
+	}
+
+	c := stepca.New(f.Client(), f.URL, config.StepCA{CAServerType: config.CAServerStepCA})
+
+	_, err := c.IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"alice"}},
+		PubKey:     userKey(t),
+		Token:      service.AccessToken{AccessToken: "access", IDToken: "id.token.jwt"},
+	})
+	require.NoError(t, err)
+}
+
+func TestIssueUserCert_Forbidden(t *testing.T) {
+	f := newFakeStepCA(t)
+	f.check = func(map[string]any, []string) int { return http.StatusForbidden }
+
+	c := stepca.New(f.Client(), f.URL, config.StepCA{CAServerType: config.CAServerStepCA})
+
+	_, err := c.IssueUserCert(context.Background(), &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"root"}},
+		PubKey:     userKey(t),
+		Token:      service.AccessToken{IDToken: "id"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, apperror.KPrincipalNotAllowed, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "not allowed")
+}
+
+func TestBootstrap_TrustsRootByFingerprint(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	f := newFakeStepCA(t)
+
+	insecure, err := transport.New(transport.Options{InsecureSkipVerify: true})
+	require.NoError(t, err)
+
+	path, err := stepca.Bootstrap(context.Background(), insecure, f.URL, f.fingerprint())
+	require.NoError(t, err)
+
+	// only the bootstrapped root is trusted, and it verifies the CA
+	c, err := transport.New(transport.Options{RootCAFile: path})
+	require.NoError(t, err)
+	resp, err := c.Get(f.URL + "/root/" + f.fingerprint())
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// the cached root is used without asking the CA again
+	f.Close()
+	cached, err := stepca.Bootstrap(context.Background(), insecure, f.URL, f.fingerprint())
+	require.NoError(t, err)
+	assert.Equal(t, path, cached)
+}
+
+func TestBootstrap_FingerprintMismatch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	f := newFakeStepCA(t)
+
+	insecure, err := transport.New(transport.Options{InsecureSkipVerify: true, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+
+	_, err = stepca.Bootstrap(context.Background(), insecure, f.URL, strings.Repeat("ab", 32))
+	require.Error(t, err)
+	assert.Equal(t, apperror.KCert, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "does not match")
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+// certReloader serves the client certificate for mutual TLS and reloads the
+// pair when the modification time of either file changes, so renewed
+// certificates are picked up without restarting long-running callers.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cf, err := paths.NormalizePath(certFile)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(err)
+	}
+
+	kf, err := paths.NormalizePath(keyFile)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(err)
+	}
+
+	r := &certReloader{certFile: cf, keyFile: kf}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+func (r *certReloader) load() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(fmt.Errorf("tls client certificate: %w", err))
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(fmt.Errorf("tls client key: %w", err))
+	}
+
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// a renewal may be half-written, keep serving the previous pair
+			return r.cert, nil
+		}
+		return nil, apperror.ErrCert(fmt.Errorf("load tls client certificate: %w", err))
+	}
+
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+
+	return r.cert, nil
+}
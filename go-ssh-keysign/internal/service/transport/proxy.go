@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// proxyFunc routes every request through proxyURL unless the host matches
+// one of the NO_PROXY patterns.
+func proxyFunc(proxyURL *url.URL, noProxy []string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+func noProxyFromEnvironment() []string {
+	v := os.Getenv("NO_PROXY")
+	if v == "" {
+		v = os.Getenv("no_proxy")
+	}
+
+	var patterns []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// bypassProxy follows the NO_PROXY conventions of net/http: "*" matches
+// everything, "example.com" and ".example.com" match the domain and its
+// subdomains, and IP addresses or CIDR ranges match literal IP hosts.
+// Loopback addresses never go through the proxy.
+func bypassProxy(u *url.URL, noProxy []string) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, p := range noProxy {
+		if p == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if h, pp, err := net.SplitHostPort(p); err == nil {
+			if pp != port {
+				continue
+			}
+			p = h
+		}
+
+		if pip := net.ParseIP(p); pip != nil {
+			if ip != nil && pip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		p = strings.TrimPrefix(p, "*")
+		if host == strings.TrimPrefix(p, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(p, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
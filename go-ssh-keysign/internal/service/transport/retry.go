@@ -0,0 +1,209 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+)
+
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay         = 10 * time.Second
+)
+
+// retryTransport repeats requests that failed for a transient reason:
+// connection errors and 429, 502, 503 and 504 responses. Only idempotent
+// requests, and those marked with ReplaySafe, are repeated. The delay grows
+// exponentially with jitter, a Retry-After header takes precedence, and no
+// retry is started that would end after maxElapsed.
+type retryTransport struct {
+	base       http.RoundTripper
+	retries    int
+	maxElapsed time.Duration
+	baseDelay  time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	log := ctxkeys.LoggerFrom(ctx)
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		r, err := rewind(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(r)
+
+		reason, retry := retryable(ctx, resp, err)
+		if !retry || attempt > t.retries || !replayable(req) {
+			if retry && attempt > 1 && err != nil {
+				return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return resp, err
+		}
+
+		delay := t.delay(attempt, resp)
+		if time.Since(start)+delay > t.maxElapsed {
+			if err != nil {
+				return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return resp, nil
+		}
+
+		log.Warn("retrying request",
+			zap.String("method", req.Method),
+			zap.String("url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path),
+			zap.String("reason", reason),
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+		)
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			_ = resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func retryable(ctx context.Context, resp *http.Response, err error) (reason string, ok bool) {
+	if ctx.Err() != nil {
+		return "", false
+	}
+
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return "", false
+		}
+		return err.Error(), true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return resp.Status, true
+	default:
+		return "", false
+	}
+}
+
+type replayBodyKey struct{}
+
+// ReplaySafe marks a request that is not idempotent, usually a POST to a token
+// endpoint, as safe to retry. body builds the request body for every further
+// attempt, so single-use credentials such as a client assertion are fresh each
+// time instead of replayed.
+func ReplaySafe(req *http.Request, body func() ([]byte, error)) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), replayBodyKey{}, body))
+}
+
+func replayBody(req *http.Request) func() ([]byte, error) {
+	body, _ := req.Context().Value(replayBodyKey{}).(func() ([]byte, error))
+	return body
+}
+
+func replayable(req *http.Request) bool {
+	if replayBody(req) != nil {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	default:
+		return false
+	}
+}
+
+func rewind(req *http.Request, attempt int) (*http.Request, error) {
+	if attempt == 1 {
+		return req, nil
+	}
+
+	if build := replayBody(req); build != nil {
+		b, err := build()
+		if err != nil {
+			return nil, err
+		}
+
+		r := req.Clone(req.Context())
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil }
+		r.ContentLength = int64(len(b))
+		return r, nil
+	}
+
+	if req.GetBody == nil {
+		return req, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+	r.Body = body
+	return r, nil
+}
+
+func (t *retryTransport) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return d
+		}
+	}
+
+	d := t.baseDelay << (attempt - 1)
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+
+	// equal jitter: keep half, randomize the rest
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryAfter parses both forms of the header (RFC 9110, section 10.2.3).
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+
+	return 0, false
+}
+
+func (t *retryTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (t *retryTransport) Unwrap() http.RoundTripper {
+	return t.base
+}
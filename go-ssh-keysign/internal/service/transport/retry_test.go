@@ -0,0 +1,195 @@
+package transport_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+func retryClient(t *testing.T, retries int) *http.Client {
+	t.Helper()
+
+	c, err := transport.New(transport.Options{Retries: retries, RetryMaxTime: 5 * time.Second, RetryBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+	return c
+}
+
+// post sends a token request, marked as safe to retry.
+func post(t *testing.T, c *http.Client, url string) (*http.Response, []observer.LoggedEntry, error) {
+	t.Helper()
+	return send(t, c, url, true)
+}
+
+func send(t *testing.T, c *http.Client, url string, replaySafe bool) (*http.Response, []observer.LoggedEntry, error) {
+	t.Helper()
+
+	core, logs := observer.New(zap.InfoLevel)
+	ctx := ctxkeys.WithLogger(context.Background(), zap.New(core))
+
+	const body = "grant_type=client_credentials"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if replaySafe {
+		req = transport.ReplaySafe(req, func() ([]byte, error) { return []byte(body), nil })
+	}
+
+	resp, err := c.Do(req)
+	if resp != nil {
+		t.Cleanup(func() { _ = resp.Body.Close() })
+	}
+	return resp, logs.All(), err
+}
+
+func TestRetry_TransientStatusThenSuccess(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "grant_type=client_credentials", string(body))
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	resp, logs, err := post(t, retryClient(t, 3), srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+	require.Len(t, logs, 2)
+	assert.Equal(t, "retrying request", logs[0].Message)
+	assert.EqualValues(t, 1, logs[0].ContextMap()["attempt"])
+}
+
+func TestRetry_GivesUpAfterRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	resp, _, err := post(t, retryClient(t, 2), srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, apperror.KHttp, apperror.KindOf(apperror.ErrHTTP(resp)))
+}
+
+func TestRetry_NotForClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	resp, logs, err := post(t, retryClient(t, 3), srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Empty(t, logs)
+}
+
+func TestRetry_NotForUnmarkedPost(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	resp, logs, err := send(t, retryClient(t, 3), srv.URL, false)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Empty(t, logs)
+}
+
+func TestRetry_ReplaySafeRebuildsBody(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	var n int
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("jti=0"))
+	require.NoError(t, err)
+	req = transport.ReplaySafe(req, func() ([]byte, error) {
+		n++
+		return fmt.Appendf(nil, "jti=%d", n), nil
+	})
+
+	resp, err := retryClient(t, 3).Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"jti=0", "jti=1", "jti=2"}, bodies)
+}
+
+func TestRetry_HonorsRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, logs, err := post(t, retryClient(t, 3), srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	require.Len(t, logs, 1)
+	assert.Equal(t, time.Second, logs[0].ContextMap()["delay"])
+}
+
+func TestRetry_RetryAfterBeyondMaxTimeIsNotAwaited(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	resp, _, err := post(t, retryClient(t, 3), srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestRetry_ConnectionErrorGivesUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	_, logs, err := post(t, retryClient(t, 2), url)
+	require.Error(t, err)
+	assert.Len(t, logs, 2)
+	assert.Contains(t, err.Error(), "giving up after 3 attempts")
+}
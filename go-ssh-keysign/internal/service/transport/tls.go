@@ -0,0 +1,122 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/paths"
+)
+
+const pinPrefix = "sha256/"
+
+func newTLSConfig(o Options) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(o.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: o.InsecureSkipVerify, // development only, warned about by the caller
+	}
+
+	if o.RootCAFile != "" {
+		if c.RootCAs, err = loadCABundle(o.RootCAFile, x509.NewCertPool()); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.CABundleFile != "" {
+		if c.RootCAs, err = loadCABundle(o.CABundleFile, c.RootCAs); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.PinnedSHA256) > 0 {
+		pins, err := parsePins(o.PinnedSHA256)
+		if err != nil {
+			return nil, err
+		}
+		// runs after chain verification, and also when it is skipped
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPin(cs, pins)
+		}
+	}
+
+	return c, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(v), "tls") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, apperror.ErrUsage(fmt.Sprintf("unsupported minimum TLS version %q, expected 1.2 or 1.3", v))
+	}
+}
+
+// loadCABundle returns pool, or the system roots when pool is nil, extended by
+// the certificates in path, so an internal PKI can be trusted without touching
+// the system store.
+func loadCABundle(path string, pool *x509.CertPool) (*x509.CertPool, error) {
+	p, err := paths.NormalizePath(path)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, apperror.ErrFileSystem(fmt.Errorf("read CA bundle: %w", err))
+	}
+
+	if pool == nil {
+		if pool, err = x509.SystemCertPool(); err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+	}
+
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, apperror.ErrCert(fmt.Errorf("CA bundle %q contains no PEM certificates", p))
+	}
+
+	return pool, nil
+}
+
+// parsePins accepts base64 SHA-256 digests of the server certificate's
+// SubjectPublicKeyInfo, optionally prefixed with "sha256/" as printed by
+// `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`.
+func parsePins(pins []string) ([][]byte, error) {
+	out := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix))
+		if err != nil || len(b) != sha256.Size {
+			return nil, apperror.ErrUsage(fmt.Sprintf("invalid pin %q, expected sha256/BASE64 of the server public key", pin))
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func verifyPin(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return apperror.ErrCert(fmt.Errorf("%s: no server certificate to check the pin against", cs.ServerName))
+	}
+
+	sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if string(pin) == string(sum[:]) {
+			return nil
+		}
+	}
+
+	return apperror.ErrCert(fmt.Errorf("%s: server public key %s%s matches none of the configured pins",
+		cs.ServerName, pinPrefix, base64.StdEncoding.EncodeToString(sum[:])))
+}
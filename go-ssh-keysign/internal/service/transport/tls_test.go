@@ -0,0 +1,112 @@
+package transport_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+func newTLSServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeBundle(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "bundle.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600))
+	return path
+}
+
+func pinOf(srv *httptest.Server) string {
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// every httptest server presents the same certificate, so mismatches use a
+// pin of an unrelated key
+var otherPin = "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+func TestTLS_UntrustedServerFails(t *testing.T) {
+	srv := newTLSServer(t)
+
+	c, err := transport.New(transport.Options{})
+	require.NoError(t, err)
+
+	_, err = get(t, c, srv.URL)
+	assert.Error(t, err)
+}
+
+func TestTLS_CABundle(t *testing.T) {
+	srv := newTLSServer(t)
+
+	c, err := transport.New(transport.Options{CABundleFile: writeBundle(t, srv)})
+	require.NoError(t, err)
+
+	body, err := get(t, c, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", body)
+}
+
+func TestTLS_Pin(t *testing.T) {
+	srv := newTLSServer(t)
+	bundle := writeBundle(t, srv)
+
+	c, err := transport.New(transport.Options{CABundleFile: bundle, PinnedSHA256: []string{pinOf(srv)}})
+	require.NoError(t, err)
+	_, err = get(t, c, srv.URL)
+	require.NoError(t, err)
+
+	c, err = transport.New(transport.Options{CABundleFile: bundle, PinnedSHA256: []string{otherPin}})
+	require.NoError(t, err)
+	_, err = get(t, c, srv.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "matches none of the configured pins")
+}
+
+func TestTLS_InsecureSkipVerifyStillChecksPin(t *testing.T) {
+	srv := newTLSServer(t)
+
+	c, err := transport.New(transport.Options{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	_, err = get(t, c, srv.URL)
+	require.NoError(t, err)
+
+	c, err = transport.New(transport.Options{InsecureSkipVerify: true, PinnedSHA256: []string{otherPin}})
+	require.NoError(t, err)
+	_, err = get(t, c, srv.URL)
+	assert.Error(t, err)
+}
+
+func TestTLS_MinVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	c, err := transport.New(transport.Options{CABundleFile: writeBundle(t, srv), MinTLSVersion: "1.3"})
+	require.NoError(t, err)
+	_, err = get(t, c, srv.URL)
+	assert.Error(t, err)
+
+	_, err = transport.New(transport.Options{MinTLSVersion: "1.0"})
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+}
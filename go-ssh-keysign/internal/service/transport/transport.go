@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/logging"
+	"binarycodes/ssh-keysign/internal/meta"
+)
+
+// Options describe the HTTP client shared by the IdP and CA server clients.
+type Options struct {
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// CABundleFile adds PEM roots to the system store for this endpoint.
+	CABundleFile string
+	// RootCAFile replaces the system store for this endpoint, e.g. with a
+	// bootstrapped step-ca root. CABundleFile is added on top.
+	RootCAFile         string
+	MinTLSVersion      string
+	PinnedSHA256       []string
+	InsecureSkipVerify bool
+
+	// Proxy is used for every request not excluded by NO_PROXY. When empty
+	// the proxy is taken from HTTPS_PROXY/HTTP_PROXY.
+	Proxy string
+
+	ConnectTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	// Timeout bounds a single call including retries and reading the
+	// response body.
+	Timeout time.Duration
+
+	// Retries is the number of times a transiently failed request is
+	// repeated, RetryMaxTime caps the time spent on all attempts.
+	Retries        int
+	RetryMaxTime   time.Duration
+	RetryBaseDelay time.Duration
+}
+
+// OptionsFromConfig combines the shared HTTP settings with the TLS settings
+// of one endpoint, see config.HTTP.IdPTLS and config.HTTP.CAServerTLS.
+func OptionsFromConfig(c config.Config, t config.TLS) Options {
+	return Options{
+		ClientCertFile:      c.OAuth.TLSClientCert,
+		ClientKeyFile:       c.OAuth.TLSClientKey,
+		CABundleFile:        t.CABundle,
+		MinTLSVersion:       t.MinVersion,
+		PinnedSHA256:        t.PinSHA256,
+		InsecureSkipVerify:  t.InsecureSkipVerify,
+		Proxy:               c.HTTP.Proxy,
+		ConnectTimeout:      c.HTTP.ConnectTimeout,
+		TLSHandshakeTimeout: c.HTTP.TLSHandshakeTimeout,
+		Timeout:             c.HTTP.Timeout,
+		Retries:             c.HTTP.Retries,
+		RetryMaxTime:        c.HTTP.RetryMaxTime,
+	}
+}
+
+// New builds the HTTP client used for every outgoing request. When a client
+// certificate is configured it is presented on each TLS handshake and
+// reloaded from disk whenever either file changes.
+func New(o Options) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(o)
+	if err != nil {
+		return nil, err
+	}
+
+	connectTimeout := orDefault(o.ConnectTimeout, constants.DefaultConnectTimeout)
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   orDefault(o.TLSHandshakeTimeout, constants.DefaultTLSHandshakeTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	if o.Proxy != "" {
+		proxyURL, err := url.Parse(o.Proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, apperror.ErrUsage(fmt.Sprintf("invalid --proxy %q, expected a URL such as http://proxy.example.com:3128", logging.Redact(o.Proxy)))
+		}
+		t.Proxy = proxyFunc(proxyURL, noProxyFromEnvironment())
+	}
+
+	if o.ClientCertFile != "" {
+		r, err := newCertReloader(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.GetClientCertificate = r.GetClientCertificate
+	}
+
+	var rt http.RoundTripper = &userAgentTransport{base: t, userAgent: UserAgent()}
+	if o.Retries > 0 {
+		rt = &retryTransport{
+			base:       rt,
+			retries:    o.Retries,
+			maxElapsed: orDefault(o.RetryMaxTime, constants.DefaultRetryMaxTime),
+			baseDelay:  orDefault(o.RetryBaseDelay, defaultRetryBaseDelay),
+		}
+	}
+
+	return &http.Client{
+		Transport: rt,
+		Timeout:   orDefault(o.Timeout, constants.DefaultHTTPTimeout),
+	}, nil
+}
+
+// defaultClient is built once, so that its connections are reused.
+var defaultClient = sync.OnceValues(func() (*http.Client, error) {
+	return New(Options{Retries: constants.DefaultRetries})
+})
+
+// OrDefault returns c, or a client with the default settings when none was
+// injected.
+func OrDefault(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+
+	d, err := defaultClient()
+	if err != nil {
+		// only configured files or settings can fail
+		return &http.Client{Timeout: constants.DefaultHTTPTimeout}
+	}
+	return d
+}
+
+// UserAgent identifies ssh-keysign to the IdP and CA server, e.g.
+// "ssh-keysign/1.2.0 (linux; amd64)".
+func UserAgent() string {
+	return fmt.Sprintf("%s/%s (%s; %s)", constants.AppName, meta.Version, runtime.GOOS, runtime.GOARCH)
+}
+
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	r := req.Clone(req.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(r)
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// underlying transport.
+func (t *userAgentTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Unwrap gives access to the underlying *http.Transport.
+func (t *userAgentTransport) Unwrap() http.RoundTripper {
+	return t.base
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
@@ -0,0 +1,281 @@
+package transport_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue writes a client certificate for cn into dir and returns the paths.
+func (ca *testCA) issue(t *testing.T, dir, cn string, serial int64) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func newMTLSServer(t *testing.T, ca *testCA) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  ca.pool,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func trustServer(t *testing.T, c *http.Client, srv *httptest.Server) {
+	t.Helper()
+
+	u, ok := c.Transport.(interface{ Unwrap() http.RoundTripper })
+	require.True(t, ok)
+	tr, ok := u.Unwrap().(*http.Transport)
+	require.True(t, ok)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	tr.TLSClientConfig.RootCAs = pool
+}
+
+func get(t *testing.T, c *http.Client, url string) (string, error) {
+	t.Helper()
+
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b := make([]byte, 64)
+	n, _ := resp.Body.Read(b)
+	return string(b[:n]), nil
+}
+
+func TestNew_PresentsClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newMTLSServer(t, ca)
+	certFile, keyFile := ca.issue(t, t.TempDir(), "host-a", 2)
+
+	c, err := transport.New(transport.Options{ClientCertFile: certFile, ClientKeyFile: keyFile})
+	require.NoError(t, err)
+	trustServer(t, c, srv)
+
+	cn, err := get(t, c, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "host-a", cn)
+}
+
+func TestNew_WithoutClientCertificateIsRejected(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newMTLSServer(t, ca)
+
+	c, err := transport.New(transport.Options{})
+	require.NoError(t, err)
+	trustServer(t, c, srv)
+
+	_, err = get(t, c, srv.URL)
+	assert.Error(t, err)
+}
+
+func TestNew_ReloadsRenewedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newMTLSServer(t, ca)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "before-renewal", 2)
+
+	c, err := transport.New(transport.Options{ClientCertFile: certFile, ClientKeyFile: keyFile})
+	require.NoError(t, err)
+	trustServer(t, c, srv)
+
+	cn, err := get(t, c, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "before-renewal", cn)
+
+	ca.issue(t, dir, "after-renewal", 3)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	c.CloseIdleConnections()
+
+	cn, err = get(t, c, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "after-renewal", cn)
+}
+
+func TestNew_InvalidClientCertificateFails(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0o600))
+
+	_, err := transport.New(transport.Options{ClientCertFile: certFile, ClientKeyFile: certFile})
+	assert.Error(t, err)
+}
+
+func TestNew_SetsUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.UserAgent()))
+	}))
+	defer srv.Close()
+
+	c, err := transport.New(transport.Options{})
+	require.NoError(t, err)
+
+	ua, err := get(t, c, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, transport.UserAgent(), ua)
+	assert.Contains(t, ua, "ssh-keysign/")
+}
+
+func TestNew_RequestHonorsContextAndTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, err := transport.New(transport.Options{Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = get(t, c, srv.URL)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, http.NoBody)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Equal(t, apperror.KCanceled, apperror.KindOf(apperror.ErrNet(err)))
+}
+
+func TestNew_ExplicitProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("via proxy " + r.URL.Host))
+	}))
+	defer proxy.Close()
+
+	t.Setenv("NO_PROXY", "internal.example.test")
+
+	c, err := transport.New(transport.Options{Proxy: proxy.URL})
+	require.NoError(t, err)
+
+	body, err := get(t, c, "http://ca.example.test/rest/key/hostSign")
+	require.NoError(t, err)
+	assert.Equal(t, "via proxy ca.example.test", body)
+
+	req, err := http.NewRequest(http.MethodGet, "http://ca.internal.example.test", http.NoBody)
+	require.NoError(t, err)
+	u, _ := c.Transport.(interface{ Unwrap() http.RoundTripper })
+	tr, _ := u.Unwrap().(*http.Transport)
+	proxyURL, err := tr.Proxy(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxyURL)
+
+	req.URL, _ = url.Parse("http://ca.example.test")
+	proxyURL, err = tr.Proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, proxy.URL, proxyURL.String())
+}
+
+func TestNew_InvalidProxyFails(t *testing.T) {
+	_, err := transport.New(transport.Options{Proxy: "not a url"})
+	require.Error(t, err)
+	assert.Equal(t, apperror.KUsage, apperror.KindOf(err))
+
+	// no host, the password is not repeated in the error
+	_, err = transport.New(transport.Options{Proxy: "http://alice:s3cret@"})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "s3cret")
+}
+
+func TestOrDefault_ReusesDefaultClient(t *testing.T) {
+	injected := &http.Client{}
+	assert.Same(t, injected, transport.OrDefault(injected))
+	assert.Same(t, transport.OrDefault(nil), transport.OrDefault(nil))
+}
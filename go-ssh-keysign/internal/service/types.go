@@ -23,6 +23,7 @@ type CertClient interface {
 type OAuthClient interface {
 	ClientCredentialLogin(ctx context.Context, oauth config.OAuth) (aToken *AccessToken, err error)
 	DeviceFlowLogin(ctx context.Context, oauth config.OAuth) (aToken *AccessToken, err error)
+	TokenExchangeLogin(ctx context.Context, oauth config.OAuth) (aToken *AccessToken, err error)
 }
 
 type CertHandler interface {
@@ -65,6 +66,7 @@ type Runner struct {
 
 type AccessToken struct {
 	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
 	ExpiresIn        uint64 `json:"expires_in"`
 	RefreshExpiresIn uint64 `json:"refresh_expires_in"`
 	TokenType        string `json:"token_type"`
@@ -74,17 +76,14 @@ type AccessToken struct {
 func (a AccessToken) OK(ctx context.Context) bool {
 	p := ctxkeys.PrinterFrom(ctx)
 
-	if len(a.AccessToken) > 10 {
-		p.V(logging.VeryVerbose).Printf("accessToken: %v\n", a.AccessToken[:10]+"...")
-	} else {
-		p.V(logging.VeryVerbose).Printf("accessToken: %v\n", a.AccessToken)
-	}
-
+	// never any part of the token
+	p.V(logging.VeryVerbose).Printf("accessToken: %s (%d bytes)\n", logging.Redacted, len(a.AccessToken))
 	p.V(logging.VeryVerbose).Printf("expiresIn: %v\n", a.ExpiresIn)
 	p.V(logging.VeryVerbose).Printf("tokenType: %v\n", a.TokenType)
 	p.V(logging.VeryVerbose).Printf("scope: %v\n", a.Scope)
 
-	return a.AccessToken != "" && a.ExpiresIn > 0 && a.TokenType != "" && a.Scope != ""
+	// scope is optional in token responses (RFC 6749, section 5.1)
+	return a.AccessToken != "" && a.ExpiresIn > 0 && a.TokenType != ""
 }
 
 type SignRequest struct {
@@ -114,6 +113,7 @@ type ED25519KeyPair struct {
 
 type Keys struct {
 	Filename  string
+	Profile   string
 	PublicKey string
 	KeyPair   *ED25519KeyPair
 }
@@ -128,7 +128,7 @@ func (k Keys) FetchPublicKey() string {
 
 func (k Keys) FetchCertFileName() (string, error) {
 	if k.Filename != "" {
-		return paths.GetCertificateFilePath(k.Filename)
+		return paths.GetCertificateFilePath(k.Filename, k.Profile)
 	}
 
 	return "", nil
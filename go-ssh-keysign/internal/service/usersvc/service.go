@@ -24,6 +24,7 @@ func (u UserService) SignUserKey(ctx context.Context, r *service.Runner) error {
 	cfg := r.Config
 
 	log.Info("user run",
+		zap.String("profile", cfg.Profile),
 		zap.String("key", cfg.User.Key),
 		zap.Strings("principal", cfg.User.Principals),
 		zap.Uint64("duration", cfg.User.DurationSeconds),
@@ -76,6 +77,7 @@ func (UserService) fetchKeys(ctx context.Context, r *service.Runner) (*service.K
 
 		return &service.Keys{
 			Filename:  cfg.User.Key,
+			Profile:   cfg.Profile,
 			PublicKey: key,
 		}, nil
 	}
@@ -101,21 +103,33 @@ func (UserService) fetchAccessToken(ctx context.Context, r *service.Runner) (tok
 	p := ctxkeys.PrinterFrom(ctx)
 	cfg := r.Config
 
+	// a local CA key or Vault signs without an IdP token
+	if r.OAuthClient == nil {
+		return &service.AccessToken{}, nil
+	}
+
 	p.V(logging.Verbose).Println("initiating connection to OAuth")
 
 	var accessToken *service.AccessToken
 
-	if cfg.OAuth.HasClientCredential() {
+	switch {
+	case cfg.OAuth.HasTokenExchange():
+		p.V(logging.Verbose).Println("using token exchange")
+		accessToken, err = r.OAuthClient.TokenExchangeLogin(ctx, cfg.OAuth)
+		if err != nil {
+			return nil, apperror.OpOr("token exchange", apperror.KAuth, err)
+		}
+	case cfg.OAuth.HasClientCredential():
 		p.V(logging.Verbose).Println("using client credential")
 		accessToken, err = r.OAuthClient.ClientCredentialLogin(ctx, cfg.OAuth)
 		if err != nil {
-			return nil, apperror.ErrAuth(err)
+			return nil, apperror.OpOr("client credential login", apperror.KAuth, err)
 		}
-	} else {
+	default:
 		p.V(logging.Verbose).Println("using device flow")
 		accessToken, err = r.OAuthClient.DeviceFlowLogin(ctx, cfg.OAuth)
 		if err != nil {
-			return nil, apperror.ErrAuth(err)
+			return nil, apperror.OpOr("device flow login", apperror.KAuth, err)
 		}
 	}
 
@@ -146,7 +160,7 @@ func (UserService) certSignRequest(ctx context.Context, r *service.Runner, k *se
 		Token:       *token,
 	})
 	if err != nil {
-		return nil, apperror.ErrNet(err)
+		return nil, apperror.OpOr("sign user key", apperror.KNetwork, err)
 	}
 
 	p.V(logging.VeryVerbose).Println("received signed certificate")
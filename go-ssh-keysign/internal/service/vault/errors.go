@@ -0,0 +1,65 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+)
+
+const (
+	maxErrorBody    = 64 << 10
+	unavailableHint = "Vault failed to handle the request; it may be sealed or in standby, try again later"
+)
+
+// readError reads Vault's error body, {"errors": ["..."]}, into a Problem.
+func readError(resp *http.Response) *apperror.Problem {
+	p := &apperror.Problem{
+		Status: resp.StatusCode,
+		Title:  http.StatusText(resp.StatusCode),
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	var e struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &e); err == nil && len(e.Errors) > 0 {
+		p.Detail = strings.Join(e.Errors, "; ")
+	} else {
+		p.Detail = strings.TrimSpace(string(body))
+	}
+
+	return p
+}
+
+// signError maps a failed sign response to an error kind. Vault answers an
+// invalid or expired token and a policy without access to the sign path
+// alike with 403 "permission denied", and checks against the role with 400.
+func signError(p *apperror.Problem, c config.Vault, principals string) error {
+	detail := strings.ToLower(p.Detail)
+
+	switch {
+	case p.Status == http.StatusForbidden:
+		return apperror.WithHint(apperror.ErrAuth(p),
+			fmt.Sprintf("the Vault token may have expired, or its policy lacks update on %s", signPath(c)))
+	case p.Status >= http.StatusInternalServerError:
+		return apperror.ErrServer(p, unavailableHint)
+	case p.Status != http.StatusBadRequest:
+		return apperror.ErrProblem(p)
+	case strings.Contains(detail, "principal"):
+		return apperror.ErrPrincipalNotAllowed(p,
+			fmt.Sprintf("Vault role %q does not allow principals %q; check its allowed_users or allowed_domains", c.Role, principals))
+	case strings.Contains(detail, "extension"), strings.Contains(detail, "critical option"):
+		return apperror.WithHint(apperror.ErrUsage(p.Error()),
+			fmt.Sprintf("Vault role %q does not allow the requested --vault-extensions or --vault-critical-options", c.Role))
+	case strings.Contains(detail, "key"):
+		return apperror.ErrKeyRejected(p, fmt.Sprintf("Vault role %q rejects this key type or size; check its allowed_user_key_lengths", c.Role))
+	}
+
+	return apperror.ErrProblem(p)
+}
@@ -0,0 +1,266 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/constants"
+	"binarycodes/ssh-keysign/internal/ctxkeys"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/transport"
+)
+
+// VaultClient is a service.CertClient that signs with the SSH secrets engine
+// of HashiCorp Vault. The Vault token is taken from the config, or obtained
+// once per run with AppRole or JWT login.
+//
+// Unlike the CA server, Vault signs every requested principal; the role's
+// allowed_users or allowed_domains decide which are permitted.
+type VaultClient struct {
+	HTTPClient *http.Client
+	Config     config.Vault
+
+	mu    sync.Mutex
+	token string
+}
+
+func New(httpClient *http.Client, c config.Vault) *VaultClient {
+	return &VaultClient{HTTPClient: httpClient, Config: c}
+}
+
+// signRequest is the body of POST /v1/<mount>/sign/<role>.
+type signRequest struct {
+	PublicKey       string            `json:"public_key"`
+	CertType        string            `json:"cert_type"`
+	ValidPrincipals string            `json:"valid_principals"`
+	TTL             string            `json:"ttl,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+	CriticalOptions map[string]string `json:"critical_options,omitempty"`
+}
+
+type signResponse struct {
+	Data struct {
+		SerialNumber string `json:"serial_number"`
+		SignedKey    string `json:"signed_key"`
+	} `json:"data"`
+}
+
+type loginResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+func (c *VaultClient) IssueUserCert(ctx context.Context, u *service.UserCertRequestConfig) (*service.SignedResponse, error) {
+	req := signRequest{
+		PublicKey:       u.PubKey,
+		CertType:        "user",
+		ValidPrincipals: strings.Join(u.UserConfig.Principals, ","),
+		TTL:             ttl(u.UserConfig.DurationSeconds),
+		CriticalOptions: c.Config.CriticalOptions,
+	}
+
+	if len(c.Config.Extensions) > 0 {
+		req.Extensions = map[string]string{}
+		for _, e := range c.Config.Extensions {
+			req.Extensions[e] = ""
+		}
+	}
+
+	return c.sign(ctx, req)
+}
+
+// IssueHostCert sends neither extensions nor critical options, OpenSSH
+// defines none for host certificates.
+func (c *VaultClient) IssueHostCert(ctx context.Context, h *service.HostCertRequestConfig) (*service.SignedResponse, error) {
+	return c.sign(ctx, signRequest{
+		PublicKey:       h.PubKey,
+		CertType:        "host",
+		ValidPrincipals: strings.Join(h.HostConfig.Principals, ","),
+		TTL:             ttl(h.HostConfig.DurationSeconds),
+	})
+}
+
+func (c *VaultClient) sign(ctx context.Context, sr signRequest) (*service.SignedResponse, error) {
+	token, err := c.vaultToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp signResponse
+	if err := c.post(ctx, signPath(c.Config), token, sr, &resp, func(p *apperror.Problem) error {
+		return signError(p, c.Config, sr.ValidPrincipals)
+	}); err != nil {
+		return nil, err
+	}
+
+	if resp.Data.SignedKey == "" {
+		return nil, apperror.ErrCert(errors.New("vault returned no signed_key"))
+	}
+
+	ctxkeys.LoggerFrom(ctx).Info("certificate issued by vault",
+		zap.String("type", sr.CertType),
+		zap.String("serial", resp.Data.SerialNumber),
+		zap.String("principals", sr.ValidPrincipals),
+	)
+
+	return &service.SignedResponse{SignedPublicKey: strings.TrimSpace(resp.Data.SignedKey) + "\n"}, nil
+}
+
+func signPath(c config.Vault) string {
+	mount := c.Mount
+	if mount == "" {
+		mount = constants.DefaultVaultMount
+	}
+	return fmt.Sprintf("%s/sign/%s", strings.Trim(mount, "/"), c.Role)
+}
+
+// vaultToken returns the token to sign with, logging in on first use.
+func (c *VaultClient) vaultToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	var (
+		token string
+		err   error
+	)
+
+	switch method := c.Config.Auth(); method {
+	case config.VaultAuthToken:
+		token, err = ambientToken(c.Config.Token)
+	case config.VaultAuthAppRole:
+		token, err = c.login(ctx, method, map[string]string{"role_id": c.Config.RoleID, "secret_id": c.Config.SecretID})
+	case config.VaultAuthJWT:
+		token, err = c.login(ctx, method, map[string]string{"role": c.Config.JWTRole, "jwt": c.Config.JWT})
+	default:
+		err = apperror.ErrUsage(fmt.Sprintf("unsupported --vault-auth-method %q", method))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.token = token
+	return token, nil
+}
+
+// ambientToken falls back to what the vault CLI uses: VAULT_TOKEN and the
+// token helper file written by `vault login`.
+func ambientToken(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+
+	if t := os.Getenv("VAULT_TOKEN"); t != "" {
+		return t, nil
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		if b, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+			if t := strings.TrimSpace(string(b)); t != "" {
+				return t, nil
+			}
+		}
+	}
+
+	return "", apperror.WithHint(apperror.ErrAuth(errors.New("no Vault token")),
+		"set --vault-token, VAULT_TOKEN or run vault login, or use --vault-auth-method approle|jwt")
+}
+
+func (c *VaultClient) login(ctx context.Context, method string, body map[string]string) (string, error) {
+	mount := c.Config.AuthMount
+	if mount == "" {
+		mount = method
+	}
+
+	var resp loginResponse
+	if err := c.post(ctx, "auth/"+strings.Trim(mount, "/")+"/login", "", body, &resp, func(p *apperror.Problem) error {
+		if p.Status >= http.StatusInternalServerError {
+			return apperror.ErrServer(p, unavailableHint)
+		}
+		return apperror.WithHint(apperror.ErrAuth(fmt.Errorf("vault %s login: %w", method, p)),
+			"check the credentials and --vault-auth-mount "+mount)
+	}); err != nil {
+		return "", err
+	}
+
+	if resp.Auth.ClientToken == "" {
+		return "", apperror.ErrAuth(fmt.Errorf("vault %s login returned no client_token", method))
+	}
+
+	ctxkeys.LoggerFrom(ctx).Info("logged in to vault", zap.String("method", method), zap.String("mount", mount))
+	return resp.Auth.ClientToken, nil
+}
+
+// post sends body as JSON to /v1/<path> and decodes a 200 response into out.
+// Failed responses are read into a Problem and passed to onError.
+func (c *VaultClient) post(ctx context.Context, path, token string, body, out any, onError func(*apperror.Problem) error) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return apperror.ErrNet(err)
+	}
+
+	url := strings.TrimRight(c.Config.Addr, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return apperror.ErrNet(err)
+	}
+	// signing the same key again is safe, a login may use up a secret ID
+	if path == signPath(c.Config) {
+		req = transport.ReplaySafe(req, func() ([]byte, error) { return b, nil })
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Request", "true")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.Config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Config.Namespace)
+	}
+
+	resp, err := transport.OrDefault(c.HTTPClient).Do(req)
+	if err != nil {
+		return apperror.ErrNet(err)
+	}
+
+	log := ctxkeys.LoggerFrom(ctx)
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return onError(readError(resp))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return apperror.ErrNet(err)
+	}
+
+	return nil
+}
+
+func ttl(seconds uint64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return strconv.FormatUint(seconds, 10) + "s"
+}
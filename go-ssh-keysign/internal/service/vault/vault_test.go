@@ -0,0 +1,211 @@
+package vault_test
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"binarycodes/ssh-keysign/internal/apperror"
+	"binarycodes/ssh-keysign/internal/config"
+	"binarycodes/ssh-keysign/internal/service"
+	"binarycodes/ssh-keysign/internal/service/vault"
+)
+
+const signedKey = "ssh-ed25519-cert-v01@openssh.com AAAAsigned\n"
+
+// fakeVault mimics the parts of the Vault HTTP API the client uses: AppRole
+// and JWT login, and the sign endpoint of an SSH secrets engine at "ssh".
+type fakeVault struct {
+	*httptest.Server
+
+	logins   atomic.Int32
+	lastSign map[string]any
+	// signStatus and signErrors make the sign endpoint fail.
+	signStatus int
+	signErrors []string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+
+	f := &fakeVault{}
+	mux := http.NewServeMux()
+
+	login := func(want map[string]string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			f.logins.Add(1)
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if !maps.Equal(want, body) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["invalid credentials"]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"s.login","lease_duration":3600}}`))
+		}
+	}
+	mux.HandleFunc("POST /v1/auth/approle/login", login(map[string]string{"role_id": "rid", "secret_id": "sid"}))
+	mux.HandleFunc("POST /v1/auth/ci-jwt/login", login(map[string]string{"role": "ci", "jwt": "eyJ.jwt"}))
+
+	mux.HandleFunc("POST /v1/ssh/sign/{role}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		f.lastSign = map[string]any{"role": r.PathValue("role"), "token": r.Header.Get("X-Vault-Token"), "namespace": r.Header.Get("X-Vault-Namespace")}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&f.lastSign))
+
+		if f.signStatus != 0 {
+			w.WriteHeader(f.signStatus)
+			_ = json.NewEncoder(w).Encode(map[string][]string{"errors": f.signErrors})
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"serial_number":"5a1b","signed_key":"` + "ssh-ed25519-cert-v01@openssh.com AAAAsigned\\n" + `"}}`))
+	})
+
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func userRequest() *service.UserCertRequestConfig {
+	return &service.UserCertRequestConfig{
+		UserConfig: config.User{Principals: []string{"alice", "devops"}, DurationSeconds: 3600},
+		PubKey:     "ssh-ed25519 AAAAkey alice@laptop",
+	}
+}
+
+func TestIssueUserCert_TokenMapsRequest(t *testing.T) {
+	f := newFakeVault(t)
+
+	c := vault.New(f.Client(), config.Vault{
+		Addr:            f.URL,
+		Namespace:       "team-a",
+		Role:            "users",
+		Token:           "s.configured",
+		Extensions:      []string{"permit-pty"},
+		CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+	})
+
+	resp, err := c.IssueUserCert(context.Background(), userRequest())
+	require.NoError(t, err)
+	assert.Equal(t, signedKey, resp.SignedPublicKey)
+
+	assert.Equal(t, int32(0), f.logins.Load())
+	assert.Equal(t, map[string]any{
+		"role":             "users",
+		"token":            "s.configured",
+		"namespace":        "team-a",
+		"public_key":       "ssh-ed25519 AAAAkey alice@laptop",
+		"cert_type":        "user",
+		"valid_principals": "alice,devops",
+		"ttl":              "3600s",
+		"extensions":       map[string]any{"permit-pty": ""},
+		"critical_options": map[string]any{"source-address": "10.0.0.0/8"},
+	}, f.lastSign)
+}
+
+func TestIssueHostCert_AppRoleLoginOnce(t *testing.T) {
+	f := newFakeVault(t)
+
+	c := vault.New(f.Client(), config.Vault{
+		Addr:            f.URL,
+		Role:            "hosts",
+		RoleID:          "rid",
+		SecretID:        "sid",
+		CriticalOptions: map[string]string{"force-command": "true"},
+	})
+
+	req := &service.HostCertRequestConfig{
+		HostConfig: config.Host{Principals: []string{"web.example.test"}, DurationSeconds: 60},
+		PubKey:     "ssh-ed25519 AAAAkey",
+	}
+
+	for range 2 {
+		_, err := c.IssueHostCert(context.Background(), req)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(1), f.logins.Load())
+	assert.Equal(t, "s.login", f.lastSign["token"])
+	assert.Equal(t, "host", f.lastSign["cert_type"])
+	assert.NotContains(t, f.lastSign, "critical_options")
+}
+
+func TestIssueUserCert_JWTLogin(t *testing.T) {
+	f := newFakeVault(t)
+
+	c := vault.New(f.Client(), config.Vault{
+		Addr:      f.URL,
+		Role:      "users",
+		AuthMount: "ci-jwt",
+		JWTRole:   "ci",
+		JWT:       "eyJ.jwt",
+	})
+
+	_, err := c.IssueUserCert(context.Background(), userRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "s.login", f.lastSign["token"])
+}
+
+func TestIssueUserCert_LoginRejected(t *testing.T) {
+	f := newFakeVault(t)
+
+	c := vault.New(f.Client(), config.Vault{Addr: f.URL, Role: "users", RoleID: "rid", SecretID: "wrong"})
+
+	_, err := c.IssueUserCert(context.Background(), userRequest())
+	require.Error(t, err)
+	assert.Equal(t, apperror.KAuth, apperror.KindOf(err))
+	assert.Contains(t, err.Error(), "invalid credentials")
+	assert.Contains(t, apperror.HintOf(err), "--vault-auth-mount")
+}
+
+func TestIssueUserCert_NoToken(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("HOME", t.TempDir())
+
+	c := vault.New(nil, config.Vault{Addr: "http://127.0.0.1:1", Role: "users"})
+
+	_, err := c.IssueUserCert(context.Background(), userRequest())
+	require.Error(t, err)
+	assert.Equal(t, apperror.KAuth, apperror.KindOf(err))
+	assert.Contains(t, apperror.HintOf(err), "VAULT_TOKEN")
+}
+
+func TestIssueUserCert_SignErrors(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		errors []string
+		want   apperror.Kind
+	}{
+		"principal": {http.StatusBadRequest, []string{"devops is not a valid value for valid_principals"}, apperror.KPrincipalNotAllowed},
+		"extension": {http.StatusBadRequest, []string{"extensions [permit-pty] are not on allowed list"}, apperror.KUsage},
+		"key":       {http.StatusBadRequest, []string{"public_key failed to meet the key requirements"}, apperror.KKeyRejected},
+		"policy":    {http.StatusForbidden, []string{"permission denied"}, apperror.KAuth},
+		"sealed":    {http.StatusServiceUnavailable, []string{"Vault is sealed"}, apperror.KServerError},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := newFakeVault(t)
+			f.signStatus, f.signErrors = tc.status, tc.errors
+
+			c := vault.New(f.Client(), config.Vault{Addr: f.URL, Role: "users", Token: "s.configured"})
+
+			_, err := c.IssueUserCert(context.Background(), userRequest())
+			require.Error(t, err)
+			assert.Equal(t, tc.want, apperror.KindOf(err))
+			assert.Contains(t, err.Error(), tc.errors[0])
+			assert.NotEmpty(t, apperror.HintOf(err))
+		})
+	}
+}